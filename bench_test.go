@@ -54,3 +54,103 @@ func BenchmarkExprEval10(b *testing.B) {
 func BenchmarkExprEval100(b *testing.B) {
 	bench(100, true, b)
 }
+
+func benchOptimize(optimize bool, b *testing.B) {
+	env := map[string]Var{"x": NewVar(1)}
+	e, err := Parse("x*(2+3*(42-1))/(1+2**4)", env, map[string]Func{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if optimize {
+		e = Optimize(e)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.Eval()
+	}
+}
+
+func BenchmarkExprEvalConst(b *testing.B) {
+	benchOptimize(false, b)
+}
+
+func BenchmarkExprEvalOptimized(b *testing.B) {
+	benchOptimize(true, b)
+}
+
+func benchCompile(compile bool, b *testing.B) {
+	env := map[string]Var{"x": NewVar(1), "y": NewVar(2)}
+	e, err := Parse("x=(x*y+3)/(y-x*x+10)-(x>y ? x : y), x", env, map[string]Func{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	eval := e.Eval
+	if compile {
+		eval = Compile(e)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		eval()
+	}
+}
+
+func BenchmarkExprEvalTree(b *testing.B) {
+	benchCompile(false, b)
+}
+
+func BenchmarkExprEvalCompiled(b *testing.B) {
+	benchCompile(true, b)
+}
+
+func benchBatch(batch bool, b *testing.B) {
+	vars := map[string]Var{}
+	e, err := Parse("(x*y+3)/(y-x*x+10) - (x > y ? x : y)", vars, map[string]Func{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	const rows = 1000000
+	xs, ys := make([]Num, rows), make([]Num, rows)
+	for i := range xs {
+		xs[i], ys[i] = Num(i%100), Num(i%7)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batch {
+			EvalBatch(e, map[string][]Num{"x": xs, "y": ys})
+		} else {
+			res := make([]Num, rows)
+			for row := range res {
+				vars["x"].Set(xs[row])
+				vars["y"].Set(ys[row])
+				res[row] = e.Eval()
+			}
+		}
+	}
+}
+
+func BenchmarkEvalRows(b *testing.B) {
+	benchBatch(false, b)
+}
+
+func BenchmarkEvalBatch(b *testing.B) {
+	benchBatch(true, b)
+}
+
+func benchPow(input string, b *testing.B) {
+	e, err := Parse(input, map[string]Var{"x": NewVar(1.5)}, map[string]Func{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.Eval()
+	}
+}
+
+func BenchmarkPowInt(b *testing.B) {
+	benchPow("x**7", b)
+}
+
+func BenchmarkPowFrac(b *testing.B) {
+	benchPow("x**7.5", b)
+}
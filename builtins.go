@@ -0,0 +1,180 @@
+package expr
+
+import (
+	"errors"
+	"math"
+)
+
+var ErrLoopLimit = errors.New("loop iteration limit exceeded")
+
+// MaxIterations limits the number of iterations of the "while" builtin
+var MaxIterations = 1000000
+
+// Reports that the builtin is called with the wrong number of arguments,
+// returns 0
+func badArity(c *FuncContext) Num {
+	c.state.fail(ErrBadArity)
+	return 0
+}
+
+// Wraps a single-argument math function, returns 0 if the number of
+// arguments is wrong
+func mathFunc1(f func(float64) float64) Func {
+	return func(c *FuncContext) Num {
+		if len(c.Args) != 1 {
+			return badArity(c)
+		}
+		return Num(f(float64(c.Arg(0))))
+	}
+}
+
+// Wraps a two-argument math function, returns 0 if the number of arguments
+// is wrong
+func mathFunc2(f func(float64, float64) float64) Func {
+	return func(c *FuncContext) Num {
+		if len(c.Args) != 2 {
+			return badArity(c)
+		}
+		return Num(f(float64(c.Arg(0)), float64(c.Arg(1))))
+	}
+}
+
+// Returns the smallest (or the largest) of all arguments, or 0 if there are
+// no arguments
+func extremum(less bool) Func {
+	return func(c *FuncContext) Num {
+		if len(c.Args) == 0 {
+			return 0
+		}
+		res := c.Arg(0)
+		for i := 1; i < len(c.Args); i++ {
+			if n := c.Arg(i); (less && n < res) || (!less && n > res) {
+				res = n
+			}
+		}
+		return res
+	}
+}
+
+func sumFunc(c *FuncContext) Num {
+	sum := Num(0)
+	for i := range c.Args {
+		sum = sum + c.Arg(i)
+	}
+	return sum
+}
+
+func lenFunc(c *FuncContext) Num {
+	return Num(len(c.Args))
+}
+
+// Wraps a three-argument function, returns 0 if the number of arguments is
+// wrong
+func func3(f func(a, b, c Num) Num) Func {
+	return func(c *FuncContext) Num {
+		if len(c.Args) != 3 {
+			return badArity(c)
+		}
+		return f(c.Arg(0), c.Arg(1), c.Arg(2))
+	}
+}
+
+// Limits x to lo..hi range
+func clamp(x, lo, hi Num) Num {
+	return Num(math.Min(math.Max(float64(x), float64(lo)), float64(hi)))
+}
+
+// Interpolates linearly between a and b
+func lerp(a, b, t Num) Num {
+	return a + (b-a)*t
+}
+
+// Normalizes truth value to 0 or 1
+func boolFunc(c *FuncContext) Num {
+	if len(c.Args) != 1 {
+		return badArity(c)
+	}
+	return boolNum(c.Arg(0) != 0)
+}
+
+// Evaluates only the selected branch, else branch is optional
+func ifFunc(c *FuncContext) Num {
+	if len(c.Args) != 2 && len(c.Args) != 3 {
+		return badArity(c)
+	}
+	if c.Arg(0) != 0 {
+		return c.Arg(1)
+	}
+	return c.Arg(2)
+}
+
+// Same as "if", but both branches are required
+func selectFunc(c *FuncContext) Num {
+	if len(c.Args) != 3 {
+		return badArity(c)
+	}
+	return ifFunc(c)
+}
+
+// Evaluates the body, which is all the arguments after the condition, while
+// the condition is true. Returns the last result of the body or 0 if it has
+// never been evaluated. Loop stops early when evaluation is cancelled, or
+// after MaxIterations iterations reporting ErrLoopLimit.
+func whileFunc(c *FuncContext) Num {
+	if len(c.Args) < 2 {
+		return badArity(c)
+	}
+	res := Num(0)
+	for i := 0; c.Arg(0) != 0; i++ {
+		if i == MaxIterations {
+			c.state.fail(ErrLoopLimit)
+			break
+		}
+		if c.Err() != nil {
+			break
+		}
+		for j := 1; j < len(c.Args); j++ {
+			res = c.Arg(j)
+		}
+	}
+	return res
+}
+
+// Builtins returns a new map of commonly used math functions. The map can be
+// extended with custom functions and passed to Parse. Functions called with
+// the wrong number of arguments return 0 and report ErrBadArity, except for
+// min and max that accept any number of arguments, and "sum" and "len" that
+// return the sum and the number of their arguments, see ParseVector.
+// Function "bool(x)" returns 1 if x is true (not zero) and 0 otherwise.
+// Like math.Pow, "pow(x, y)" is NaN for negative x and non-integer y, while
+// "cbrt(x)" is the real cube root of any x, see Parser.OddRoots.
+// Control flow functions "if(cond, then, else)", "select(cond, a, b)" and
+// "while(cond, body...)" only evaluate arguments when needed.
+func Builtins() map[string]Func {
+	return map[string]Func{
+		"sqrt":   mathFunc1(math.Sqrt),
+		"cbrt":   mathFunc1(math.Cbrt),
+		"abs":    mathFunc1(math.Abs),
+		"floor":  mathFunc1(math.Floor),
+		"ceil":   mathFunc1(math.Ceil),
+		"round":  mathFunc1(math.Round),
+		"sin":    mathFunc1(math.Sin),
+		"cos":    mathFunc1(math.Cos),
+		"tan":    mathFunc1(math.Tan),
+		"exp":    mathFunc1(math.Exp),
+		"log":    mathFunc1(math.Log),
+		"log2":   mathFunc1(math.Log2),
+		"log10":  mathFunc1(math.Log10),
+		"pow":    mathFunc2(math.Pow),
+		"min":    extremum(true),
+		"max":    extremum(false),
+		"sum":    sumFunc,
+		"len":    lenFunc,
+		"clamp":  func3(clamp),
+		"lerp":   func3(lerp),
+		"bool":   boolFunc,
+		"if":     ifFunc,
+		"select": selectFunc,
+		"while":  whileFunc,
+	}
+}
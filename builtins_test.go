@@ -0,0 +1,150 @@
+package expr
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBuiltins(t *testing.T) {
+	funcs := Builtins()
+	for input, result := range map[string]Num{
+		"sqrt(16)":     4,
+		"abs(-3)":      3,
+		"floor(2.7)":   2,
+		"ceil(2.2)":    3,
+		"round(2.5)":   3,
+		"round(-2.5)":  -3,
+		"sin(0)":       0,
+		"cos(0)":       1,
+		"tan(0)":       0,
+		"exp(0)":       1,
+		"exp(1e0)":     math.E,
+		"log(1)":       0,
+		"log2(8)":      3,
+		"log10(1000)":  3,
+		"pow(2, 10)":   1024,
+		"cbrt(27)":     3,
+		"cbrt(-8)":     -2,
+		"min(3, 5, 1)": 1,
+		"max(3, 5, 1)": 5,
+		"min(7)":       7,
+		"max(-7)":      -7,
+
+		"clamp(15, 0, 10)":  10,
+		"clamp(-5, 0, 10)":  0,
+		"clamp(5, 0, 10)":   5,
+		"clamp(0.5, 0, 1)":  0.5,
+		"lerp(0, 10, 0.5)":  5,
+		"lerp(0, 10, 0)":    0,
+		"lerp(0, 10, 1)":    10,
+		"lerp(2, -2, 0.25)": 1,
+		"lerp(0, 10, 2)":    20,
+		"3 && 4":            4,
+		"bool(3 && 4)":      1,
+		"bool(0 || -2)":     1,
+		"bool(0)":           0,
+		"bool(0.5)":         1,
+
+		// Wrong number of arguments
+		"sqrt()":            0,
+		"sqrt(4, 9)":        0,
+		"pow(2)":            0,
+		"min()":             0,
+		"max()":             0,
+		"clamp(1, 2)":       0,
+		"clamp(1, 2, 3, 4)": 0,
+		"lerp()":            0,
+		"lerp(1, 2)":        0,
+		"bool()":            0,
+		"bool(1, 2)":        0,
+	} {
+		if e, err := Parse(input, map[string]Var{}, funcs); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); math.Abs(float64(n-result)) > 1e-9 {
+			t.Error(input, e, n, result)
+		}
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	env := map[string]Var{"x": NewVar(4), "y": NewVar(-2)}
+	funcs := Builtins()
+	for input, result := range map[string]Num{
+		"max(1, min(9, 3), 2)":       3,
+		"min(max(1, 2), max(3, 4))":  2,
+		"max(min(), 1)":              1,
+		"max(-1, -2)":                -1,
+		"min(x, y, 0)":               -2,
+		"max(x, y, 0)":               4,
+		"max(x*2, y*-5, 7)":          10,
+		"min(1, 2, 3, 4, 5, 6, 0.5)": 0.5,
+		"max(2, 2, 2)":               2,
+	} {
+		if e, err := Parse(input, env, funcs); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != result {
+			t.Error(input, e, n, result)
+		}
+	}
+}
+
+func TestControlFlow(t *testing.T) {
+	calls := ""
+	funcs := Builtins()
+	funcs["f"] = func(c *FuncContext) Num {
+		calls = calls + "f"
+		return 1
+	}
+	funcs["g"] = func(c *FuncContext) Num {
+		calls = calls + "g"
+		return -1
+	}
+	for _, test := range []struct {
+		input string
+		n     Num
+		calls string
+		err   error
+	}{
+		{"if(x>0, f(), g())", 1, "f", nil},
+		{"if(x<0, f(), g())", -1, "g", nil},
+		{"if(x<0, f())", 0, "", nil},
+		{"if(x)", 0, "", ErrBadArity},
+		{"select(x>0, f(), g())", 1, "f", nil},
+		{"select(x<0, f(), g())", -1, "g", nil},
+		{"select(x, f())", 0, "", ErrBadArity},
+		{"select(x, f(), g(), f())", 0, "", ErrBadArity},
+		{"select(f() > 0, select(g() > 0, 1, f()), 3)", 1, "fgf", nil},
+		{"i=0, s=0, while(i<10, s=s+i, i=i+1), s", 45, "", nil},
+		{"i=0, while(i<3, i=i+1, f())", 1, "fff", nil},
+		{"while(0, f())", 0, "", nil},
+		{"while(1)", 0, "", ErrBadArity},
+	} {
+		calls = ""
+		if e, err := Parse(test.input, map[string]Var{"x": NewVar(5)}, funcs); err != nil {
+			t.Error(test.input, err)
+		} else if n, err := EvalErr(e); n != test.n || calls != test.calls || err != test.err {
+			t.Error(test.input, n, calls, err)
+		}
+	}
+
+	// Assignments in the untaken branch don't happen
+	vars := map[string]Var{"x": NewVar(5)}
+	if e, err := Parse("a = 1, b = 1, select(x > 0, a = 2, b = 2)", vars, funcs); err != nil {
+		t.Error(err)
+	} else if n := e.Eval(); n != 2 || vars["a"].Get() != 2 || vars["b"].Get() != 1 {
+		t.Error(n, vars)
+	}
+
+	defer func(n int) { MaxIterations = n }(MaxIterations)
+	MaxIterations = 100
+	e, err := Parse("i=0, while(1, i=i+1)", map[string]Var{}, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := EvalErr(e); n != 100 || err != ErrLoopLimit {
+		t.Error(n, err)
+	}
+	if n := e.Eval(); n != 100 {
+		t.Error(n)
+	}
+}
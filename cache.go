@@ -0,0 +1,97 @@
+package expr
+
+import (
+	clist "container/list"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Cache remembers parsed expressions, so that parsing the same input again
+// only takes cloning the expression tree. Least recently used expressions are
+// evicted when the cache is full. Cache is safe for concurrent use.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *clist.List
+	entries map[cacheKey]*clist.Element
+}
+
+// Expressions are cached by input and by the names of variables that shadow
+// constants, as they are parsed differently
+type cacheKey struct {
+	input    string
+	shadowed string
+}
+
+type cacheEntry struct {
+	key cacheKey
+	e   Expr
+	err error
+}
+
+// NewCache returns a cache that keeps up to size most recently parsed
+// expressions
+func NewCache(size int) *Cache {
+	return &Cache{size: size, lru: clist.New(), entries: map[cacheKey]*clist.Element{}}
+}
+
+// Parse returns the expression like Parse does, but the input is only parsed
+// if it is not in the cache. Each call returns a new copy of the expression
+// with variables bound to vars, see Clone, so expressions returned for the
+// same input don't share variables unless they are given the same vars.
+// Variables named like constants, such as "pi", refer to the variables like
+// in Parse. Functions are bound when the input is parsed for the first time,
+// so all calls for the same input are expected to use the same funcs. Parse
+// errors are cached too.
+func (c *Cache) Parse(input string, vars map[string]Var, funcs map[string]Func) (Expr, error) {
+	// Variables that shadow constants are parsed with placeholders and bound
+	// to vars when the expression is cloned
+	var shadowed []string
+	parseVars := map[string]Var{}
+	for name := range vars {
+		if _, ok := consts[name]; ok {
+			shadowed = append(shadowed, name)
+			parseVars[name] = NewVar(0)
+		}
+	}
+	sort.Strings(shadowed)
+	key := cacheKey{input: input, shadowed: strings.Join(shadowed, " ")}
+
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+
+	var entry *cacheEntry
+	if ok {
+		entry = el.Value.(*cacheEntry)
+	} else {
+		// Variables of the cached expression are never used
+		e, err := Parse(input, parseVars, funcs)
+		entry = &cacheEntry{key: key, e: e, err: err}
+		c.mu.Lock()
+		if _, ok := c.entries[key]; !ok && c.size > 0 {
+			c.entries[key] = c.lru.PushFront(entry)
+			if c.lru.Len() > c.size {
+				oldest := c.lru.Back()
+				c.lru.Remove(oldest)
+				delete(c.entries, oldest.Value.(*cacheEntry).key)
+			}
+		}
+		c.mu.Unlock()
+	}
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	return Clone(entry.e, vars), nil
+}
+
+// Len returns the number of cached expressions
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,119 @@
+package expr
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	calls := 0
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			calls++
+			return c.Arg(0) * 2
+		},
+	}
+	c := NewCache(2)
+	cached := func(input string) bool {
+		_, ok := c.entries[cacheKey{input: input}]
+		return ok
+	}
+
+	x1 := NewVar(1)
+	vars1 := map[string]Var{"x": x1}
+	e1, err := c.Parse("y = f(x) + 1", vars1, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached("y = f(x) + 1") || c.Len() != 1 {
+		t.Error(c.Len())
+	}
+	vars2 := map[string]Var{"x": NewVar(10)}
+	e2, err := c.Parse("y = f(x) + 1", vars2, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 1 {
+		t.Error(c.Len())
+	}
+	// Hits return independent copies bound to the given variables
+	if n := e1.Eval(); n != 3 || vars1["y"].Get() != 3 {
+		t.Error(n, vars1["y"])
+	}
+	if n := e2.Eval(); n != 21 || vars2["y"].Get() != 21 {
+		t.Error(n, vars2["y"])
+	}
+	if vars1["y"] == vars2["y"] || calls != 2 {
+		t.Error(vars1, vars2, calls)
+	}
+	x1.Set(2)
+	if n := e1.Eval(); n != 5 {
+		t.Error(n)
+	}
+
+	// Errors are cached
+	for i := 0; i < 2; i++ {
+		if _, err := c.Parse("1 +", map[string]Var{}, funcs); !errors.Is(err, ErrOperandMissing) {
+			t.Error(err)
+		}
+	}
+	if c.Len() != 2 {
+		t.Error(c.Len())
+	}
+
+	// Least recently used entry is evicted
+	c.Parse("y = f(x) + 1", map[string]Var{}, funcs)
+	c.Parse("2 * 3", map[string]Var{}, funcs)
+	if c.Len() != 2 || !cached("y = f(x) + 1") || !cached("2 * 3") || cached("1 +") {
+		t.Error(c.Len(), c.entries)
+	}
+
+	// Variables named like constants are used like in Parse
+	pi := NewVar(3)
+	for i := 0; i < 2; i++ {
+		if e, err := c.Parse("pi * 2", map[string]Var{"pi": pi}, funcs); err != nil || e.Eval() != 6 {
+			t.Error(e, err)
+		}
+	}
+	if e, err := c.Parse("pi * 2", map[string]Var{}, funcs); err != nil || e.Eval() != 2*math.Pi {
+		t.Error(e, err)
+	}
+	if e, err := c.Parse("pi = 4, pi", map[string]Var{"pi": pi}, funcs); err != nil || e.Eval() != 4 || pi.Get() != 4 {
+		t.Error(e, err, pi.Get())
+	}
+
+	// Zero size cache never keeps anything
+	c = NewCache(0)
+	if e, err := c.Parse("2 * 3", map[string]Var{}, funcs); err != nil || e.Eval() != 6 || c.Len() != 0 {
+		t.Error(e, err, c.Len())
+	}
+}
+
+// Should pass with -race
+func TestCacheConcurrent(t *testing.T) {
+	c := NewCache(4)
+	inputs := []string{"x+1", "x*2", "x-3", "x/4", "x**2", "-x"}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				x := NewVar(Num(j))
+				input := inputs[(i+j)%len(inputs)]
+				e, err := c.Parse(input, map[string]Var{"x": x}, map[string]Func{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				want, _ := Parse(input, map[string]Var{"x": x}, map[string]Func{})
+				if n, m := e.Eval(), want.Eval(); n != m {
+					t.Error(input, n, m)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,142 @@
+package expr
+
+// Clone returns a deep copy of the expression tree with variables rebound by
+// name to the ones in vars. Variables missing from vars are copied with their
+// current values and added to vars, so changing variables of the clone never
+// affects the original expression. Functions, their environments, string
+// variables and custom expressions are shared.
+func Clone(e Expr, vars map[string]Var) Expr {
+	c := &cloner{vars: vars, copies: map[Var]Var{}}
+	return c.clone(e)
+}
+
+type cloner struct {
+	vars map[string]Var
+	// Copies of unnamed variables
+	copies map[Var]Var
+}
+
+func (c *cloner) clone(e Expr) Expr {
+	switch e := e.(type) {
+	case *constExpr:
+		return &constExpr{value: e.value}
+	case namedVar:
+		return c.cloneVar(e)
+	case *unaryExpr:
+		return &unaryExpr{op: e.op, arg: c.clone(e.arg), def: e.def}
+	case *binaryExpr:
+		return &binaryExpr{op: e.op, a: c.clone(e.a), b: c.clone(e.b), def: e.def, eps: e.eps}
+	case *ternaryExpr:
+		return &ternaryExpr{cond: c.clone(e.cond), a: c.clone(e.a), b: c.clone(e.b)}
+	case *strCompareExpr:
+		return &strCompareExpr{op: e.op, a: c.clone(e.a), b: c.clone(e.b)}
+	case *FuncContext:
+		f := *e
+		f.Vars, f.state = c.vars, nil
+		f.Args = make([]Expr, len(e.Args))
+		for i, arg := range e.Args {
+			f.Args[i] = c.clone(arg)
+		}
+		return &f
+	}
+	// Custom expressions and string variables are shared
+	return e
+}
+
+func (c *cloner) cloneVar(v namedVar) Var {
+	name := v.varName()
+	if name != "" {
+		if dup, ok := c.vars[name]; ok {
+			nameVar(dup, name)
+			return dup
+		}
+	} else if dup, ok := c.copies[v]; ok {
+		return dup
+	}
+	var dup Var
+	if _, ok := v.(*atomicVar); ok {
+		dup = &atomicVar{name: name}
+	} else {
+		dup = &varExpr{name: name}
+	}
+	dup.Set(v.Get())
+	if name != "" {
+		c.vars[name] = dup
+	} else {
+		c.copies[v] = dup
+	}
+	return dup
+}
+
+// Equal reports whether two expression trees have the same structure: the
+// same node types, operators, constant values and names of variables and
+// functions. Unnamed variables are equal if they are used in the same places
+// in both trees. Custom expressions are only equal to themselves.
+func Equal(a, b Expr) bool {
+	return (&comparer{pairs: map[Var]Var{}, paired: map[Var]bool{}}).equal(a, b)
+}
+
+type comparer struct {
+	// Unnamed variables of the first tree mapped to the ones of the second
+	pairs  map[Var]Var
+	paired map[Var]bool
+}
+
+func (c *comparer) equal(a, b Expr) bool {
+	switch a := a.(type) {
+	case *constExpr:
+		b, ok := b.(*constExpr)
+		return ok && (a.value == b.value || (a.value != a.value && b.value != b.value))
+	case namedVar:
+		b, ok := b.(namedVar)
+		if !ok || a.varName() != b.varName() {
+			return false
+		} else if a.varName() != "" {
+			return true
+		}
+		if v, ok := c.pairs[a]; ok {
+			return v == b
+		} else if c.paired[b] {
+			return false
+		}
+		c.pairs[a], c.paired[b] = b, true
+		return true
+	case *unaryExpr:
+		b, ok := b.(*unaryExpr)
+		return ok && a.op == b.op && a.def == b.def && c.equal(a.arg, b.arg)
+	case *binaryExpr:
+		b, ok := b.(*binaryExpr)
+		return ok && a.op == b.op && a.def == b.def && a.eps == b.eps && c.equal(a.a, b.a) && c.equal(a.b, b.b)
+	case *ternaryExpr:
+		b, ok := b.(*ternaryExpr)
+		return ok && c.equal(a.cond, b.cond) && c.equal(a.a, b.a) && c.equal(a.b, b.b)
+	case *strExpr:
+		b, ok := b.(*strExpr)
+		return ok && a.value == b.value
+	case *strVarExpr:
+		b, ok := b.(*strVarExpr)
+		return ok && a.name == b.name
+	case *strCompareExpr:
+		b, ok := b.(*strCompareExpr)
+		return ok && a.op == b.op && c.equal(a.a, b.a) && c.equal(a.b, b.b)
+	case *vecExpr:
+		b, ok := b.(*vecExpr)
+		return ok && c.equalList(a.items, b.items)
+	case *FuncContext:
+		b, ok := b.(*FuncContext)
+		return ok && a.name == b.name && c.equalList(a.Args, b.Args)
+	}
+	return a == b
+}
+
+func (c *comparer) equalList(a, b []Expr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !c.equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
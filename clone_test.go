@@ -0,0 +1,116 @@
+package expr
+
+import "testing"
+
+func TestClone(t *testing.T) {
+	vars := map[string]Var{"x": NewVar(5)}
+	e, err := Parse("y = x * 2, y + add3(x, -1, x > 2 ? 1 : 0)", vars, map[string]Func{
+		"add3": func(c *FuncContext) Num {
+			return c.Args[0].Eval() + c.Args[1].Eval() + c.Args[2].Eval()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clone into an empty map copies all variables
+	cloneVars := map[string]Var{}
+	clone := Clone(e, cloneVars)
+	if len(cloneVars) != 2 || cloneVars["x"] == vars["x"] || cloneVars["y"] == vars["y"] {
+		t.Fatal(cloneVars)
+	}
+	if n := cloneVars["x"].Get(); n != 5 {
+		t.Error(n)
+	}
+	cloneVars["x"].Set(1)
+	if n := clone.Eval(); n != 2 {
+		t.Error(n)
+	}
+	if n := e.Eval(); n != 15 {
+		t.Error(n)
+	}
+	if x, y := vars["x"].Get(), vars["y"].Get(); x != 5 || y != 10 {
+		t.Error(x, y)
+	}
+	if x, y := cloneVars["x"].Get(), cloneVars["y"].Get(); x != 1 || y != 2 {
+		t.Error(x, y)
+	}
+
+	// Existing variables are reused
+	z := NewAtomicVar(3)
+	clone = Clone(e, map[string]Var{"x": z})
+	if n := clone.Eval(); n != 9 {
+		t.Error(n)
+	}
+	if s := Format(clone); s != Format(e) {
+		t.Error(s, Format(e))
+	}
+
+	// Unnamed variables are copied once
+	v := NewVar(4)
+	sum := &binaryExpr{op: plus, a: v, b: &binaryExpr{op: assign, a: v, b: &constExpr{value: 1}}}
+	clone = Clone(sum, map[string]Var{})
+	if n := clone.Eval(); n != 5 || v.Get() != 4 {
+		t.Error(n, v.Get())
+	}
+	if n := clone.Eval(); n != 2 {
+		t.Error(n)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	funcs := Builtins()
+	funcs["f"] = func(c *FuncContext) Num { return 0 }
+	parse := func(input string) Expr {
+		e, err := Parse(input, map[string]Var{}, funcs)
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		return e
+	}
+	for _, test := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"1+2", "1+2", true},
+		{"1+2", "2+1", false},
+		{"1+2", "(1)+(2)", true},
+		{"1+2", "1-2", false},
+		{"1+2", "3", false},
+		{"x*(y+1)", "x * (y + 1)", true},
+		{"x*(y+1)", "x*(z+1)", false},
+		{"-x", "!x", false},
+		{"-x", "x", false},
+		{"a ? b : c", "a ? b : c", true},
+		{"a ? b : c", "a ? c : b", false},
+		{"f(x, 2)", "f(x, 2)", true},
+		{"f(x, 2)", "f(x)", false},
+		{"f(x)", "sqrt(x)", false},
+		{"x = 1, x", "x = 1, x", true},
+		{"0.5", "1/2", false},
+		{"nan", "nan", true},
+		{"a < b < c", "a < b < c", true},
+	} {
+		if eq := Equal(parse(test.a), parse(test.b)); eq != test.equal {
+			t.Error(test.a, test.b, eq)
+		}
+	}
+
+	// Unnamed variables must be used in the same places
+	u, v, w := NewVar(0), NewVar(0), NewVar(0)
+	sum := func(a, b Var) Expr { return &binaryExpr{op: plus, a: a, b: b} }
+	if !Equal(sum(u, u), sum(v, v)) || !Equal(sum(u, v), sum(v, w)) {
+		t.Error("same usage")
+	}
+	if Equal(sum(u, u), sum(v, w)) || Equal(sum(u, v), sum(w, w)) {
+		t.Error("different usage")
+	}
+	p := &Parser{ChainComparisons: true}
+	if a, err := p.Parse("1 < f(1) < 3", map[string]Var{}, funcs); err != nil {
+		t.Fatal(err)
+	} else if b, err := p.Parse("1 < f(1) < 3", map[string]Var{}, funcs); err != nil {
+		t.Fatal(err)
+	} else if !Equal(a, b) || !Equal(a, Clone(a, map[string]Var{})) {
+		t.Error(a, b)
+	}
+}
@@ -0,0 +1,242 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrBatchLength = errors.New("input columns have different lengths")
+
+// Compiled program instruction codes
+type opcode int
+
+const (
+	opConst    opcode = iota // Push constant
+	opVar                    // Push variable value
+	opExpr                   // Push the result of evaluating an expression tree
+	opUnary                  // Replace top value with the result of unary operator
+	opBinary                 // Replace two top values with the result of binary operator
+	opAssign                 // Store top value into a variable, keep it on stack
+	opPop                    // Discard top value
+	opJump                   // Jump unconditionally
+	opJumpZero               // Pop top value and jump if it is zero
+	opJumpAnd                // Jump if top value is zero, replacing it with 0, pop otherwise
+	opJumpOr                 // Jump if top value is non-zero, pop otherwise
+)
+
+type instr struct {
+	code opcode
+	op   arithOp
+	def  *customOp
+	n    Num
+	v    Var
+	e    Expr
+	jump int
+}
+
+type compiler struct {
+	prog     []instr
+	depth    int
+	maxDepth int
+}
+
+// Appends instruction and updates current stack depth, returns instruction
+// index
+func (c *compiler) emit(i instr, delta int) int {
+	c.prog = append(c.prog, i)
+	c.depth += delta
+	if c.depth > c.maxDepth {
+		c.maxDepth = c.depth
+	}
+	return len(c.prog) - 1
+}
+
+func (c *compiler) compile(e Expr) {
+	switch e := e.(type) {
+	case *constExpr:
+		c.emit(instr{code: opConst, n: e.value}, 1)
+	case Var:
+		c.emit(instr{code: opVar, v: e}, 1)
+	case *unaryExpr:
+		c.compile(e.arg)
+		c.emit(instr{code: opUnary, op: e.op, def: e.def}, 0)
+	case *ternaryExpr:
+		c.compile(e.cond)
+		jumpElse := c.emit(instr{code: opJumpZero}, -1)
+		c.compile(e.a)
+		jumpEnd := c.emit(instr{code: opJump}, -1)
+		c.prog[jumpElse].jump = len(c.prog)
+		c.compile(e.b)
+		c.prog[jumpEnd].jump = len(c.prog)
+	case *binaryExpr:
+		switch e.op {
+		case logicalAnd, logicalOr:
+			code := opJumpAnd
+			if e.op == logicalOr {
+				code = opJumpOr
+			}
+			c.compile(e.a)
+			jump := c.emit(instr{code: code}, -1)
+			c.compile(e.b)
+			c.prog[jump].jump = len(c.prog)
+		case assign:
+			c.compile(e.b)
+			if v, ok := e.a.(Var); ok {
+				c.emit(instr{code: opAssign, v: v}, 0)
+			}
+		case comma:
+			c.compile(e.a)
+			c.emit(instr{code: opPop}, -1)
+			c.compile(e.b)
+		default:
+			c.compile(e.a)
+			c.compile(e.b)
+			c.emit(instr{code: opBinary, op: e.op, def: e.def, n: e.eps}, -1)
+		}
+	default:
+		// Function calls and custom expressions are evaluated as trees
+		c.emit(instr{code: opExpr, e: e}, 1)
+	}
+}
+
+// Compile flattens the expression tree into a sequence of instructions and
+// returns a function that evaluates them using a preallocated value stack. It
+// gives the same results as Eval and observes variable changes, but the
+// returned function must not be called from multiple goroutines at once.
+func Compile(e Expr) func() Num {
+	c := &compiler{}
+	c.compile(e)
+	prog := c.prog
+	stack := make([]Num, c.maxDepth)
+	return func() Num {
+		return run(prog, stack, nil)
+	}
+}
+
+// CompileWith compiles the expression like Compile does, but the returned
+// function takes the values of the named variables as arguments, in the
+// order of names. Variables keep the values they are given, missing
+// arguments leave them unchanged and extra arguments are ignored.
+func CompileWith(e Expr, names ...string) func(inputs ...Num) Num {
+	all := namedVars(e)
+	vars := make([][]Var, len(names))
+	for i, name := range names {
+		vars[i] = all[name]
+	}
+	run := Compile(e)
+	return func(inputs ...Num) Num {
+		for i := 0; i < len(inputs) && i < len(vars); i++ {
+			for _, v := range vars[i] {
+				v.Set(inputs[i])
+			}
+		}
+		return run()
+	}
+}
+
+// EvalBatch evaluates the expression once for each row of the input, which
+// maps variable names to the columns of their values, and returns the result
+// of each row. The expression is compiled once, see Compile, and its named
+// variables are set to the row values before each evaluation, leaving them
+// with the values of the last row. Columns must have the same length,
+// otherwise ErrBatchLength is returned. The first evaluation error is returned
+// along with all the results, like EvalErr does, with the index of the row.
+func EvalBatch(e Expr, input map[string][]Num) ([]Num, error) {
+	names := make([]string, 0, len(input))
+	rows := -1
+	for name, column := range input {
+		if rows >= 0 && len(column) != rows {
+			return nil, ErrBatchLength
+		}
+		rows = len(column)
+		names = append(names, name)
+	}
+	if rows < 0 {
+		rows = 0
+	}
+	sort.Strings(names)
+	all := namedVars(e)
+	vars := make([][]Var, len(names))
+	columns := make([][]Num, len(names))
+	for i, name := range names {
+		vars[i], columns[i] = all[name], input[name]
+	}
+	c := &compiler{}
+	c.compile(e)
+	stack := make([]Num, c.maxDepth)
+	res := make([]Num, rows)
+	s := &evalState{}
+	var err error
+	for row := range res {
+		for i, column := range columns {
+			for _, v := range vars[i] {
+				v.Set(column[row])
+			}
+		}
+		res[row] = run(c.prog, stack, s)
+		if s.err != nil && err == nil {
+			err = fmt.Errorf("row %d: %w", row, s.err)
+		}
+	}
+	return res, err
+}
+
+func run(prog []instr, stack []Num, s *evalState) Num {
+	sp := 0
+	for pc := 0; pc < len(prog); pc++ {
+		i := &prog[pc]
+		switch i.code {
+		case opConst:
+			stack[sp] = i.n
+			sp++
+		case opVar:
+			stack[sp] = i.v.Get()
+			sp++
+		case opExpr:
+			stack[sp] = eval(i.e, s)
+			sp++
+		case opUnary:
+			if i.def != nil {
+				stack[sp-1] = normalizeZero(i.op, i.def.apply(stack[sp-1], 0))
+			} else {
+				stack[sp-1] = applyUnary(i.op, stack[sp-1])
+			}
+		case opBinary:
+			sp--
+			if i.def != nil {
+				stack[sp-1] = normalizeZero(i.op, i.def.apply(stack[sp-1], stack[sp]))
+			} else {
+				stack[sp-1] = applyBinary(i.op, stack[sp-1], stack[sp], i.n, s)
+			}
+		case opAssign:
+			i.v.Set(stack[sp-1])
+		case opPop:
+			sp--
+		case opJump:
+			pc = i.jump - 1
+		case opJumpZero:
+			sp--
+			if stack[sp] == 0 {
+				pc = i.jump - 1
+			}
+		case opJumpAnd:
+			if stack[sp-1] == 0 {
+				stack[sp-1] = 0
+				pc = i.jump - 1
+			} else {
+				sp--
+			}
+		case opJumpOr:
+			if stack[sp-1] != 0 {
+				pc = i.jump - 1
+			} else {
+				sp--
+			}
+		}
+	}
+	if sp == 0 {
+		return 0
+	}
+	return stack[sp-1]
+}
@@ -0,0 +1,157 @@
+package expr
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	funcs := Builtins()
+	funcs["inc"] = func(c *FuncContext) Num {
+		return c.Args[0].Eval() + 1
+	}
+	for _, input := range []string{
+		"",
+		"2",
+		"x",
+		"-x+2*3",
+		"!x, !0, ^x",
+		"2**3**2",
+		"7%4 + 7%%4 + 7/4",
+		"x/0 + x%0",
+		"1<<3 >> 1",
+		"x<2, x<=2, x>2, x>=2, x==2, x!=2",
+		"x&3 | 8 ^ 1",
+		"x && 4, 0 && 4, x && 0",
+		"x || 4, 0 || 4, 0 || 0",
+		"x ? 1 : 2",
+		"0 ? 1 : 2",
+		"x ? 0 ? 1 : 2 : 3",
+		"y=x*2, y+1",
+		"y=z=3, y+z",
+		"x=x+1, x=x+1, x",
+		"inc(x) + inc(inc(1))",
+		"max(x, 2, inc(4)) * sqrt(16)",
+		"x>1 && (y=5), y",
+		"x=2+3*(x/(42+inc(x))),x",
+	} {
+		env1 := map[string]Var{"x": NewVar(5)}
+		env2 := map[string]Var{"x": NewVar(5)}
+		e1, err := Parse(input, env1, funcs)
+		if err != nil {
+			t.Error(input, err)
+			continue
+		}
+		e2, _ := Parse(input, env2, funcs)
+		f := Compile(e2)
+		for i := 0; i < 3; i++ {
+			if a, b := e1.Eval(), f(); a != b {
+				t.Error(input, a, b)
+			}
+		}
+		for name, v := range env1 {
+			if v.Get() != env2[name].Get() {
+				t.Error(input, name, v.Get(), env2[name].Get())
+			}
+		}
+	}
+}
+
+func TestCompileVars(t *testing.T) {
+	x := NewVar(1)
+	e, err := Parse("x*2+1", map[string]Var{"x": x}, map[string]Func{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := Compile(e)
+	if n := f(); n != 3 {
+		t.Error(n)
+	}
+	x.Set(10)
+	if n := f(); n != 21 {
+		t.Error(n)
+	}
+	if n := testing.AllocsPerRun(100, func() { f() }); n != 0 {
+		t.Error("allocations:", n)
+	}
+}
+
+func TestCompileWith(t *testing.T) {
+	vars := map[string]Var{"x": NewVar(1), "y": NewAtomicVar(2)}
+	e, err := Parse("x*10 + y + z", vars, map[string]Func{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := CompileWith(e, "y", "x", "w")
+	for _, test := range []struct {
+		inputs []Num
+		n      Num
+	}{
+		{[]Num{3, 4}, 43},
+		{[]Num{5, 6, 7}, 65},
+		{[]Num{8}, 68},
+		{nil, 68},
+	} {
+		if n := f(test.inputs...); n != test.n {
+			t.Error(test.inputs, n, test.n)
+		}
+	}
+	if x, y := vars["x"].Get(), vars["y"].Get(); x != 6 || y != 8 {
+		t.Error(x, y)
+	}
+	inputs := []Num{1, 2}
+	if n := testing.AllocsPerRun(100, func() { f(inputs...) }); n != 0 {
+		t.Error("allocations:", n)
+	}
+}
+
+func TestEvalBatch(t *testing.T) {
+	funcs := Builtins()
+	for _, input := range []string{
+		"x*2 + y",
+		"z = x > y ? x : y, z*z",
+		"sqrt(x*x + y*y)",
+		"x && y || 3",
+		"acc = acc + x, acc",
+		"42",
+	} {
+		xs := []Num{1, -2, 3.5, 0, 7}
+		ys := []Num{4, 5, 0, -1, 7}
+		vars := map[string]Var{}
+		e, err := Parse(input, vars, funcs)
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		res, err := EvalBatch(e, map[string][]Num{"x": xs, "y": ys, "unused": xs})
+		if err != nil || len(res) != len(xs) {
+			t.Fatal(input, res, err)
+		}
+
+		// Same results as setting the variables and evaluating each row
+		e2, _ := Parse(input, map[string]Var{}, funcs)
+		x, y := NewVar(0), NewVar(0)
+		e2 = Clone(e2, map[string]Var{"x": x, "y": y})
+		for i := range xs {
+			x.Set(xs[i])
+			y.Set(ys[i])
+			if n := e2.Eval(); n != res[i] {
+				t.Error(input, i, n, res[i])
+			}
+		}
+		if vars["x"] != nil && vars["x"].Get() != xs[len(xs)-1] {
+			t.Error(input, vars["x"])
+		}
+	}
+
+	e, _ := Parse("x / y", map[string]Var{}, funcs)
+	res, err := EvalBatch(e, map[string][]Num{"x": {1, 2, 3}, "y": {1, 0, 0}})
+	if !errors.Is(err, ErrDivisionByZero) || err.Error() != "row 1: division by zero" || len(res) != 3 || res[0] != 1 {
+		t.Error(res, err)
+	}
+	if res, err := EvalBatch(e, map[string][]Num{"x": {1, 2, 3}, "y": {1}}); err != ErrBatchLength || res != nil {
+		t.Error(res, err)
+	}
+	if res, err := EvalBatch(e, map[string][]Num{}); err != nil || len(res) != 0 {
+		t.Error(res, err)
+	}
+}
@@ -0,0 +1,139 @@
+package expr
+
+import (
+	"errors"
+	"math"
+)
+
+var ErrNotDifferentiable = errors.New("expression is not differentiable")
+
+// Derivative returns the simplified derivative of the expression with respect
+// to the variable with the given name. Only arithmetic operators, conditional
+// operator and calls of sin, cos, tan, exp, log and sqrt functions are
+// supported, the latter are recognized by name and are expected to work like
+// the builtin ones. Other operators and functions return ErrNotDifferentiable.
+// Resulting expression shares variables and subexpressions with the original
+// one.
+func Derivative(e Expr, varName string) (Expr, error) {
+	d, err := derive(e, varName)
+	if err != nil {
+		return nil, err
+	}
+	return Simplify(d), nil
+}
+
+func derive(e Expr, x string) (Expr, error) {
+	switch e := e.(type) {
+	case *constExpr:
+		return &constExpr{value: 0}, nil
+	case namedVar:
+		if e.varName() == x {
+			return &constExpr{value: 1}, nil
+		}
+		return &constExpr{value: 0}, nil
+	case *unaryExpr:
+		if e.op&^opFlags != unaryMinus {
+			return nil, ErrNotDifferentiable
+		}
+		d, err := derive(e.arg, x)
+		if err != nil {
+			return nil, err
+		}
+		return newUnaryExpr(unaryMinus, d), nil
+	case *binaryExpr:
+		return deriveBinary(e, x)
+	case *ternaryExpr:
+		a, err := derive(e.a, x)
+		if err != nil {
+			return nil, err
+		}
+		b, err := derive(e.b, x)
+		if err != nil {
+			return nil, err
+		}
+		return &ternaryExpr{cond: e.cond, a: a, b: b}, nil
+	case *FuncContext:
+		return deriveCall(e, x)
+	}
+	return nil, ErrNotDifferentiable
+}
+
+func deriveBinary(e *binaryExpr, x string) (Expr, error) {
+	bin := func(op arithOp, a, b Expr) Expr {
+		return &binaryExpr{op: op, a: a, b: b}
+	}
+	num := func(n Num) Expr {
+		return &constExpr{value: n}
+	}
+	// Integer operators and odd roots are not differentiable
+	switch e.op &^ zeroOp {
+	case plus, minus, multiply, divide, power:
+	default:
+		return nil, ErrNotDifferentiable
+	}
+	da, err := derive(e.a, x)
+	if err != nil {
+		return nil, err
+	}
+	db, err := derive(e.b, x)
+	if err != nil {
+		return nil, err
+	}
+	a, b := e.a, e.b
+	switch e.op &^ zeroOp {
+	case plus, minus:
+		return bin(e.op, da, db), nil
+	case multiply:
+		// (a*b)' = a'*b + a*b'
+		return bin(plus, bin(multiply, da, b), bin(multiply, a, db)), nil
+	case divide:
+		// (a/b)' = (a'*b - a*b') / b**2
+		return bin(divide, bin(minus, bin(multiply, da, b), bin(multiply, a, db)),
+			bin(power, b, num(2))), nil
+	}
+	if isConstValue(Simplify(db), 0) {
+		// (a**n)' = n * a**(n-1) * a'
+		return bin(multiply, bin(multiply, b, bin(power, a, bin(minus, b, num(1)))), da), nil
+	}
+	// (a**b)' = a**b * (b'*log(a) + b*a'/a)
+	return bin(multiply, e, bin(plus,
+		bin(multiply, db, call("log", math.Log, a)),
+		bin(divide, bin(multiply, b, da), a))), nil
+}
+
+func deriveCall(f *FuncContext, x string) (Expr, error) {
+	if len(f.Args) != 1 {
+		return nil, ErrNotDifferentiable
+	}
+	u := f.Args[0]
+	du, err := derive(u, x)
+	if err != nil {
+		return nil, err
+	}
+	var d Expr
+	switch f.name {
+	case "sin":
+		d = call("cos", math.Cos, u)
+	case "cos":
+		d = newUnaryExpr(unaryMinus, call("sin", math.Sin, u))
+	case "tan":
+		d = &binaryExpr{op: divide, a: &constExpr{value: 1},
+			b: &binaryExpr{op: power, a: call("cos", math.Cos, u), b: &constExpr{value: 2}}}
+	case "exp":
+		d = f
+	case "log":
+		d = &binaryExpr{op: divide, a: &constExpr{value: 1}, b: u}
+	case "sqrt":
+		d = &binaryExpr{op: divide, a: &constExpr{value: 1},
+			b: &binaryExpr{op: multiply, a: &constExpr{value: 2}, b: f}}
+	default:
+		return nil, ErrNotDifferentiable
+	}
+	// Chain rule: f(u)' = f'(u) * u'
+	return &binaryExpr{op: multiply, a: d, b: du}, nil
+}
+
+// Returns a call of the single-argument math function
+func call(name string, f func(float64) float64, arg Expr) Expr {
+	return &FuncContext{f: mathFunc1(f), name: name, Args: []Expr{arg}}
+}
@@ -0,0 +1,81 @@
+package expr
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestDerivative(t *testing.T) {
+	for input, s := range map[string]string{
+		"x**2":          "2*x",
+		"sin(x)":        "cos(x)",
+		"cos(x)":        "-sin(x)",
+		"exp(2*x)":      "exp(2*x)*2",
+		"log(x)":        "1/x",
+		"sqrt(x)":       "1/(2*sqrt(x))",
+		"3*x + y":       "3",
+		"x*y":           "y",
+		"x*x":           "x+x",
+		"-x":            "-1",
+		"5":             "0",
+		"y":             "0",
+		"x**3 - x":      "(3*(x**2))-1",
+		"1/x":           "(-1)/(x**2)",
+		"sin(x**2)":     "cos(x**2)*(2*x)",
+		"x > 0 ? x : 0": "(x>0) ? 1 : 0",
+	} {
+		vars := map[string]Var{"x": NewVar(3), "y": NewVar(4)}
+		e, err := Parse(input, vars, Builtins())
+		if err != nil {
+			t.Error(input, err)
+			continue
+		}
+		if d, err := Derivative(e, "x"); err != nil {
+			t.Error(input, err)
+		} else if Format(d) != s {
+			t.Error(input, Format(d), s)
+		}
+	}
+
+	// Check numerically against finite differences
+	for _, input := range []string{
+		"x**2 * sin(x) / (1 + x)", "tan(x) - sqrt(x)", "2**x", "x**x", "exp(cos(x)) * log(x)",
+	} {
+		x := NewVar(0)
+		e, err := Parse(input, map[string]Var{"x": x}, Builtins())
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		d, err := Derivative(e, "x")
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		for _, at := range []Num{0.5, 1, 1.3} {
+			const h = 1e-6
+			x.Set(at + h)
+			f1 := e.Eval()
+			x.Set(at - h)
+			f0 := e.Eval()
+			x.Set(at)
+			if n, approx := d.Eval(), (f1-f0)/(2*h); math.Abs(float64(n-approx)) > 1e-5 {
+				t.Error(input, at, n, approx)
+			}
+		}
+	}
+
+	for _, input := range []string{
+		"x = 2", "x > 2", "x % 2", "x && 1", "!x", "f(x)", "min(x, 1)", "x, 2",
+	} {
+		e, err := Parse(input, map[string]Var{}, map[string]Func{
+			"f":   func(c *FuncContext) Num { return 0 },
+			"min": extremum(true),
+		})
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		if _, err := Derivative(e, "x"); !errors.Is(err, ErrNotDifferentiable) {
+			t.Error(input, err)
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package expr
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 	"unicode"
 )
 
@@ -14,13 +20,73 @@ var (
 	ErrParen                = errors.New("parenthesis mismatch")
 	ErrUnexpectedNumber     = errors.New("unexpected number")
 	ErrUnexpectedIdentifier = errors.New("unexpected identifier")
+	ErrUnexpectedString     = errors.New("unexpected string")
 
 	ErrBadCall        = errors.New("function call expected")
 	ErrBadVar         = errors.New("variable expected in assignment")
 	ErrBadOp          = errors.New("unknown operator or function")
 	ErrOperandMissing = errors.New("missing operand")
+	ErrBadNumber      = errors.New("malformed number")
+	ErrBadString      = errors.New("malformed string")
+	ErrTernary        = errors.New("conditional operator mismatch")
+	ErrComment        = errors.New("unterminated comment")
+	ErrBadArity       = errors.New("wrong number of function arguments")
+	ErrUnknownVar     = errors.New("unknown variable")
+	ErrTooComplex     = errors.New("expression is too complex")
+	ErrTooDeep        = errors.New("parentheses nested too deep")
+	ErrAssign         = errors.New(`assignment is not allowed, use "==" to compare`)
+	ErrUnassigned     = errors.New("variable is used before it is assigned")
+
+	ErrDivisionByZero = errors.New("division by zero")
+	ErrBadInteger     = errors.New("bitwise operand is not a safe integer")
+	ErrNoFunc         = errors.New("function is not defined")
+	ErrSideEffect     = errors.New("expression has side effects")
+	ErrTooManyVars    = errors.New("too many variables")
+	ErrTimeout        = errors.New("evaluation timed out")
 )
 
+// ParseError describes a syntax error and the position in the input where it
+// was detected. It wraps one of the sentinel errors above, so errors.Is can be
+// used to check the error kind.
+type ParseError struct {
+	Err   error
+	Pos   int    // Offset in runes, length of the input if at the end of it
+	Token string // Offending token, empty if at the end of the input
+	End   int    // Offset in runes right after the offending token
+	Index int    // Index of the offending token among the Tokenize results
+	Line  int    // Line of Pos starting from 1
+	Col   int    // Column of Pos in runes starting from 1
+}
+
+func (e *ParseError) Error() string {
+	at := fmt.Sprint(e.Pos)
+	if e.Line > 1 {
+		// Offsets are hard to find in multi-line input
+		at = fmt.Sprintf("%d:%d", e.Line, e.Col)
+	}
+	if e.Token == "" {
+		return fmt.Sprintf("%v at %s", e.Err, at)
+	}
+	return fmt.Sprintf("%v at %s near %q", e.Err, at, e.Token)
+}
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// StatementError is returned by ParseAll for the statement that could not be
+// parsed. It wraps the error returned by Parse.
+type StatementError struct {
+	Index int // Index of the statement among the comma-separated statements
+	Err   error
+}
+
+func (e *StatementError) Error() string {
+	return fmt.Sprintf("statement %d: %v", e.Index, e.Err)
+}
+func (e *StatementError) Unwrap() error {
+	return e.Err
+}
+
 // Supported arithmetic operations
 type arithOp int
 
@@ -33,6 +99,8 @@ const (
 	multiply
 	divide
 	remainder
+	modulo
+	floorDivide
 
 	plus
 	minus
@@ -44,6 +112,9 @@ const (
 	lessOrEquals
 	greaterThan
 	greaterOrEquals
+	compare
+	minimum
+	maximum
 	equals
 	notEquals
 
@@ -52,30 +123,152 @@ const (
 	bitwiseOr
 
 	logicalAnd
+	logicalXor
 	logicalOr
 
+	conditional
+	conditionalElse
+
 	assign
+	addAssign
+	subAssign
+	mulAssign
+	divAssign
+	// Vector index "@", only recognized by ParseVector
+	index
 	comma
 )
 
+// Flags of arithmetic operators set by parser options: operators that operate
+// on int64 values, see IntMode, the bit width of "^", see BitWidth, odd roots
+// of "**", see OddRoots, operators that never give negative zero, see
+// NormalizeZero, the division by zero mode, see DivByZero, and truncated
+// remainder, see RemainderMode
+const (
+	intOp      arithOp = 1 << 30
+	widthShift         = 23
+	widthMask  arithOp = 127 << widthShift
+	oddRootOp  arithOp = 1 << 22
+	zeroOp     arithOp = 1 << 21
+	divNaNOp   arithOp = 1 << 20
+	divErrorOp arithOp = 1 << 19
+	truncOp    arithOp = 1 << 18
+	opFlags            = intOp | widthMask | oddRootOp | zeroOp | divNaNOp | divErrorOp | truncOp
+)
+
+// Operators that have integer versions
+var intOps = map[arithOp]bool{
+	plus: true, minus: true, multiply: true, divide: true, power: true,
+	remainder: true, modulo: true, floorDivide: true,
+}
+
+// Operators that divide by their right operand
+var divOps = map[arithOp]bool{
+	divide: true, remainder: true, modulo: true, floorDivide: true,
+}
+
+// Binary operators that may give negative zero
+var signedZeroOps = map[arithOp]bool{
+	plus: true, minus: true, multiply: true, divide: true, power: true,
+	remainder: true, modulo: true, floorDivide: true, minimum: true, maximum: true,
+}
+
+// Built-in operators, never modified. Parsers use OpTable that may also
+// contain user-defined operators.
 var ops = map[string]arithOp{
 	"-u": unaryMinus, "!u": unaryLogicalNot, "^u": unaryBitwiseNot,
-	"**": power, "*": multiply, "/": divide, "%": remainder,
+	"**": power, "*": multiply, "/": divide, "%": remainder, "%%": modulo, "//": floorDivide,
+	"×": multiply, "÷": divide,
 	"+": plus, "-": minus,
 	"<<": shl, ">>": shr,
-	"<": lessThan, "<=": lessOrEquals, ">": greaterThan, ">=": greaterOrEquals,
+	"<": lessThan, "<=": lessOrEquals, ">": greaterThan, ">=": greaterOrEquals, "<=>": compare,
+	"<?": minimum, ">?": maximum,
 	"==": equals, "!=": notEquals,
 	"&": bitwiseAnd, "^": bitwiseXor, "|": bitwiseOr,
-	"&&": logicalAnd, "||": logicalOr,
-	"=": assign, ",": comma,
+	"&&": logicalAnd, "^^": logicalXor, "||": logicalOr,
+	"?": conditional, ":": conditionalElse,
+	"=": assign, "+=": addAssign, "-=": subAssign, "*=": mulAssign, "/=": divAssign,
+	",": comma,
+}
+
+// Returns operator symbol as it appears in the input
+func (op arithOp) symbol() (sym string) {
+	op &^= opFlags
+	for s, o := range ops {
+		if o == op && (sym == "" || s < sym) {
+			sym = s
+		}
+	}
+	if isUnary(op) {
+		sym = sym[:len(sym)-1]
+	}
+	return sym
 }
 
 func isUnary(op arithOp) bool {
+	op &^= opFlags
 	return op >= unaryMinus && op <= unaryBitwiseNot
 }
+
+// Operators of the same precedence level bind left-to-right (or right-to-left
+// for right-associative ones), lower level binds tighter. Like in Python,
+// power binds tighter than unary operators on its left, so -2**2 is -4, but
+// looser than unary operators on its right, so 2**-1 is 0.5.
+func precedence(op arithOp) int {
+	op &^= opFlags
+	switch op {
+	case power:
+		return 1
+	case unaryMinus, unaryLogicalNot, unaryBitwiseNot:
+		return 2
+	case multiply, divide, remainder, modulo, floorDivide:
+		return 3
+	case plus, minus:
+		return 4
+	case shl, shr:
+		return 5
+	case lessThan, lessOrEquals, greaterThan, greaterOrEquals, compare, minimum, maximum:
+		return 6
+	case equals, notEquals:
+		return 7
+	case bitwiseAnd:
+		return 8
+	case bitwiseXor:
+		return 9
+	case bitwiseOr:
+		return 10
+	case logicalAnd:
+		return 11
+	case logicalXor:
+		return 12
+	case logicalOr:
+		return 13
+	case conditional, conditionalElse:
+		return 14
+	case assign, addAssign, subAssign, mulAssign, divAssign:
+		return 15
+	case comma:
+		return 16
+	case index:
+		// Binds tighter than any other operator
+		return 0
+	}
+	return 0
+}
 func isLeftAssoc(op arithOp) bool {
-	return !isUnary(op) && op != assign && op != power && op != comma
+	op &^= opFlags
+	return !isUnary(op) && !isAssign(op) && op != power && op != comma &&
+		op != conditional && op != conditionalElse
+}
+func isAssign(op arithOp) bool {
+	return op >= assign && op <= divAssign
+}
+
+// Compound assignment operators and the operators they apply before assignment
+var compoundOps = map[arithOp]arithOp{
+	addAssign: plus, subAssign: minus, mulAssign: multiply, divAssign: divide,
 }
+
 func boolNum(b bool) Num {
 	if b {
 		return 1
@@ -84,10 +277,135 @@ func boolNum(b bool) Num {
 	}
 }
 
+// Expr is an expression that can be evaluated. Operands are always evaluated
+// left-to-right, function arguments are evaluated when the function asks for
+// them. The right operand of "&&" and "||" is only evaluated if the left one
+// doesn't decide the result, and only one branch of "?:" is evaluated.
 type Expr interface {
 	Eval() Num
 }
 
+// Evaluation state shared by all nodes of the expression being evaluated. Nil
+// state means that errors are silently ignored.
+type evalState struct {
+	ctx   context.Context
+	err   error
+	trace func(node Expr, result Num)
+}
+
+func (s *evalState) fail(err error) {
+	if s != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+// Checks if evaluation has been cancelled, cancellation error replaces any
+// other evaluation error
+func (s *evalState) cancelled() bool {
+	if s == nil || s.ctx == nil {
+		return false
+	}
+	if err := s.ctx.Err(); err != nil {
+		s.err = err
+		return true
+	}
+	return false
+}
+
+// Expression nodes that can report errors while being evaluated
+type evaluator interface {
+	eval(s *evalState) Num
+}
+
+func eval(e Expr, s *evalState) (res Num) {
+	if s == nil {
+		return e.Eval()
+	}
+	if n, ok := e.(evaluator); ok {
+		res = n.eval(s)
+	} else {
+		res = e.Eval()
+	}
+	if s.trace != nil {
+		s.trace(e, res)
+	}
+	return res
+}
+
+// EvalErr evaluates the expression like Eval does, but also returns the first
+// error that happened during evaluation, such as ErrDivisionByZero
+func EvalErr(e Expr) (Num, error) {
+	s := &evalState{}
+	n := eval(e, s)
+	return n, s.err
+}
+
+// EvalTrace evaluates the expression like Eval does and calls fn after each
+// node is evaluated, so operands are reported before their operators. Nodes
+// that are not evaluated, like the other branch of a condition, are not
+// reported. Function arguments are only reported if the function evaluates
+// them with FuncContext.Arg.
+func EvalTrace(e Expr, fn func(node Expr, result Num)) Num {
+	return eval(e, &evalState{trace: fn})
+}
+
+// EvalWith evaluates the expression with the named variables temporarily set
+// to the given values, and restores their previous values afterwards.
+// Variables that are not in overrides keep their values. Since variables are
+// modified, expressions sharing them must not be evaluated concurrently.
+func EvalWith(e Expr, overrides map[string]Num) Num {
+	vars := namedVars(e)
+	for name, n := range overrides {
+		for _, v := range vars[name] {
+			defer v.Set(v.Get())
+			v.Set(n)
+		}
+	}
+	return e.Eval()
+}
+
+// EvalContext evaluates the expression like EvalErr does, but stops early and
+// returns the context error if the context is cancelled during evaluation.
+func EvalContext(ctx context.Context, e Expr) (Num, error) {
+	s := &evalState{ctx: ctx}
+	if s.cancelled() {
+		return 0, s.err
+	}
+	n := eval(e, s)
+	if s.cancelled() {
+		return 0, s.err
+	}
+	return n, s.err
+}
+
+// EvalTimeout evaluates the expression like EvalContext does on a separate
+// goroutine and returns ErrTimeout if the evaluation takes longer than d.
+// Evaluation is cancelled on timeout, but since the goroutine can't be
+// stopped, it keeps running until the next cancellation check, so functions
+// that loop for a long time should check FuncContext.Err.
+func EvalTimeout(e Expr, d time.Duration) (Num, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	type result struct {
+		n   Num
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := EvalContext(ctx, e)
+		done <- result{n, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err == context.DeadlineExceeded {
+			return 0, ErrTimeout
+		}
+		return res.n, res.err
+	case <-ctx.Done():
+		return 0, ErrTimeout
+	}
+}
+
 // Constant expression always returns the same value when evaluated
 type constExpr struct {
 	value Num
@@ -109,8 +427,25 @@ type Var interface {
 }
 type varExpr struct {
 	value Num
+	name  string
+}
+
+// Variables that remember the name they are referred to in expressions
+type namedVar interface {
+	Var
+	varName() string
+	setVarName(name string)
 }
 
+// Names the variable, unless it already has a name
+func nameVar(v Var, name string) {
+	if v, ok := v.(namedVar); ok && v.varName() == "" {
+		v.setVarName(name)
+	}
+}
+
+// NewVar returns a variable that is not synchronized, so it must not be
+// modified while another goroutine evaluates it. Use NewAtomicVar for that.
 func NewVar(value Num) Var {
 	return &varExpr{value: value}
 }
@@ -123,21 +458,173 @@ func (e *varExpr) Set(value Num) {
 func (e *varExpr) Get() Num {
 	return e.value
 }
+func (e *varExpr) varName() string {
+	return e.name
+}
+func (e *varExpr) setVarName(name string) {
+	e.name = name
+}
 func (e *varExpr) String() string {
+	if e.name != "" {
+		return fmt.Sprintf("{%s=%v}", e.name, e.value)
+	}
 	return fmt.Sprintf("{%v}", e.value)
 }
 
+// Variable that can be safely modified and evaluated from multiple goroutines
+type atomicVar struct {
+	bits uint64
+	name string
+}
+
+// NewAtomicVar returns a variable that is safe for concurrent use
+func NewAtomicVar(value Num) Var {
+	v := &atomicVar{}
+	v.Set(value)
+	return v
+}
+func (e *atomicVar) Eval() Num {
+	return e.Get()
+}
+func (e *atomicVar) Set(value Num) {
+	atomic.StoreUint64(&e.bits, math.Float64bits(float64(value)))
+}
+func (e *atomicVar) Get() Num {
+	return Num(math.Float64frombits(atomic.LoadUint64(&e.bits)))
+}
+func (e *atomicVar) varName() string {
+	return e.name
+}
+func (e *atomicVar) setVarName(name string) {
+	e.name = name
+}
+func (e *atomicVar) String() string {
+	if e.name != "" {
+		return fmt.Sprintf("{%s=%v}", e.name, e.Get())
+	}
+	return fmt.Sprintf("{%v}", e.Get())
+}
+
 type Func func(f *FuncContext) Num
 
+// FuncSpec describes a function and the number of arguments it accepts.
+// Negative MaxArgs means that the number of arguments is not limited. Pure
+// functions have no side effects and return the same result for the same
+// arguments, see ParsePure.
+type FuncSpec struct {
+	Fn      Func
+	MinArgs int
+	MaxArgs int
+	Pure    bool
+}
+
+// FuncContext is a function call in the expression. Each call in the
+// expression has its own context that lives as long as the expression, so
+// functions may keep their state in Env between evaluations.
 type FuncContext struct {
 	f    Func
+	name string
+	// Source text of the arguments, if parsed
+	raw  []string
 	Args []Expr
 	Vars map[string]Var
-	Env  interface{}
+	// Env is initialized with the value given to ParseWithEnv. Assigning Env
+	// only affects this call, state shared by all calls should be kept in a
+	// pointer or a map passed to ParseWithEnv.
+	Env interface{}
+	// Evaluation state, only set in the copy of the context given to the
+	// function, so that the expression can be evaluated concurrently
+	state *evalState
 }
 
 func (f *FuncContext) Eval() Num {
-	return f.f(f)
+	return f.eval(nil)
+}
+func (f *FuncContext) eval(s *evalState) Num {
+	if s.cancelled() {
+		return 0
+	}
+	if f.f == nil {
+		// Context built without a function, e.g. if funcs was modified
+		s.fail(ErrNoFunc)
+		return 0
+	}
+	if s == nil {
+		return f.f(f)
+	}
+	c := *f
+	c.state = s
+	res := f.f(&c)
+	if !sameEnv(c.Env, f.Env) {
+		// Env replaced by the function is kept for the next evaluations
+		f.Env = c.Env
+	}
+	return res
+}
+
+// Reports whether a and b are the same Env value, values of types that can't
+// be compared, like maps, are the same if they refer to the same data
+func sameEnv(a, b interface{}) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta == nil || ta != tb {
+		return ta == tb
+	} else if ta.Comparable() {
+		return a == b
+	}
+	switch ta.Kind() {
+	case reflect.Map, reflect.Func, reflect.Slice:
+		va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+		return va.Pointer() == vb.Pointer() && (ta.Kind() != reflect.Slice || va.Len() == vb.Len())
+	}
+	return false
+}
+
+// Err returns a non-nil error if the current evaluation has been cancelled.
+// Functions that take long to complete should check it periodically and
+// return early.
+func (f *FuncContext) Err() error {
+	if f.state.cancelled() {
+		return f.state.err
+	}
+	return nil
+}
+
+// Name returns the name the function is called by in the expression
+func (f *FuncContext) Name() string {
+	return f.name
+}
+
+// RawArg returns the source text of i-th argument as it appears in the input,
+// without the surrounding whitespace and comments, or the formatted argument
+// if the call was not parsed from text, see Format. Returns an empty string
+// if there is no such argument.
+func (f *FuncContext) RawArg(i int) string {
+	if i < 0 || i >= len(f.Args) {
+		return ""
+	} else if len(f.raw) == len(f.Args) {
+		return f.raw[i]
+	}
+	return Format(f.Args[i])
+}
+
+// NArgs returns the number of arguments the function is called with
+func (f *FuncContext) NArgs() int {
+	return len(f.Args)
+}
+
+// Arg evaluates i-th argument, or returns 0 if there is no such argument.
+// Unlike Args[i].Eval(), evaluation errors are reported to EvalErr.
+func (f *FuncContext) Arg(i int) Num {
+	return f.ArgOr(i, 0)
+}
+
+// ArgOr evaluates i-th argument like Arg does, or returns def if there is no
+// such argument
+func (f *FuncContext) ArgOr(i int, def Num) Num {
+	if i < 0 || i >= len(f.Args) {
+		return def
+	}
+	return eval(f.Args[i], f.state)
 }
 
 func (f *FuncContext) String() string {
@@ -148,106 +635,424 @@ func (f *FuncContext) String() string {
 type unaryExpr struct {
 	op  arithOp
 	arg Expr
+	// Definition of user-defined operator, nil for built-in ones
+	def *customOp
 }
 
 func newUnaryExpr(op arithOp, arg Expr) Expr {
 	return &unaryExpr{op: op, arg: arg}
 }
-func (e *unaryExpr) Eval() (res Num) {
-	switch e.op {
+func (e *unaryExpr) Eval() Num {
+	return e.eval(nil)
+}
+func (e *unaryExpr) eval(s *evalState) Num {
+	if e.def != nil {
+		return normalizeZero(e.op, e.def.apply(eval(e.arg, s), 0))
+	}
+	return applyUnary(e.op, eval(e.arg, s))
+}
+func (e *unaryExpr) symbol() string {
+	if e.def != nil {
+		return e.def.symbol
+	}
+	return e.op.symbol()
+}
+func (e *unaryExpr) precedence() int {
+	if e.def != nil {
+		return e.def.precedence
+	}
+	return precedence(e.op)
+}
+
+// Applies unary operator to the evaluated argument
+func applyUnary(op arithOp, a Num) (res Num) {
+	switch op &^ opFlags {
 	case unaryMinus:
-		res = -e.arg.Eval()
+		res = -a
 	case unaryBitwiseNot:
 		// Bitwise operation can only be applied to integer values
-		res = Num(^int64(e.arg.Eval()))
+		res = Num(^int64(a))
+		if w := uint(op&widthMask) >> widthShift; w > 0 {
+			// Unsigned complement of the lowest w bits
+			res = Num(^uint64(int64(a)) & (1<<w - 1))
+		}
 	case unaryLogicalNot:
-		res = boolNum(e.arg.Eval() == 0)
+		res = boolNum(a == 0)
 	}
-	return res
+	return normalizeZero(op, res)
+}
+
+// Replaces negative zero with 0 if the operator has zeroOp flag
+func normalizeZero(op arithOp, n Num) Num {
+	if op&zeroOp != 0 && n == 0 {
+		return 0
+	}
+	return n
 }
 func (e *unaryExpr) String() string {
 	return fmt.Sprintf("<%v>(%v)", e.op, e.arg)
 }
 
+// Conditional expression evaluates only one of its branches depending on the
+// condition value
+type ternaryExpr struct {
+	cond Expr
+	a    Expr
+	b    Expr
+}
+
+func (e *ternaryExpr) Eval() Num {
+	return e.eval(nil)
+}
+func (e *ternaryExpr) eval(s *evalState) Num {
+	if eval(e.cond, s) != 0 {
+		return eval(e.a, s)
+	}
+	return eval(e.b, s)
+}
+
+func (e *ternaryExpr) String() string {
+	return fmt.Sprintf("<%v>(%v, %v, %v)", conditional, e.cond, e.a, e.b)
+}
+
 type binaryExpr struct {
 	op arithOp
 	a  Expr
 	b  Expr
+	// Definition of user-defined operator, nil for built-in ones
+	def *customOp
+	// Largest difference of operands that "==", "!=" and "<=>" consider
+	// equal, see EqualEpsilon
+	eps Num
 }
 
 func newBinaryExpr(op arithOp, a, b Expr) (Expr, error) {
-	if op == assign {
-		if _, ok := a.(*varExpr); !ok {
+	if isAssign(op) {
+		if _, ok := a.(Var); !ok {
 			return nil, ErrBadVar
 		}
 	}
+	if base, ok := compoundOps[op]; ok {
+		// Compound assignment "x op= y" is the same as "x = x op y"
+		return &binaryExpr{op: assign, a: a, b: &binaryExpr{op: base, a: a, b: b}}, nil
+	}
 	return &binaryExpr{op: op, a: a, b: b}, nil
 }
 
-func (e *binaryExpr) Eval() (res Num) {
+func (e *binaryExpr) Eval() Num {
+	return e.eval(nil)
+}
+func (e *binaryExpr) symbol() string {
+	if e.def != nil {
+		return e.def.symbol
+	}
+	return e.op.symbol()
+}
+func (e *binaryExpr) precedence() int {
+	if e.def != nil {
+		return e.def.precedence
+	}
+	return precedence(e.op)
+}
+func (e *binaryExpr) isLeftAssoc() bool {
+	if e.def != nil {
+		return e.def.assoc == LeftAssoc
+	}
+	return isLeftAssoc(e.op)
+}
+func (e *binaryExpr) eval(s *evalState) (res Num) {
+	if s.cancelled() {
+		return 0
+	}
+	if e.def != nil {
+		return normalizeZero(e.op, e.def.apply(eval(e.a, s), eval(e.b, s)))
+	}
 	switch e.op {
+	case logicalAnd:
+		if a := eval(e.a, s); a != 0 {
+			if b := eval(e.b, s); b != 0 {
+				res = b
+			}
+		}
+	case logicalOr:
+		if a := eval(e.a, s); a != 0 {
+			res = a
+		} else if b := eval(e.b, s); b != 0 {
+			res = b
+		}
+	case assign:
+		res = eval(e.b, s)
+		if v, ok := e.a.(Var); ok {
+			v.Set(res)
+		}
+	case comma:
+		eval(e.a, s)
+		res = eval(e.b, s)
+	default:
+		res = applyBinary(e.op, eval(e.a, s), eval(e.b, s), e.eps, s)
+	}
+	return res
+}
+
+// DivMode defines the result of division or remainder by zero
+type DivMode int
+
+const (
+	// DivZero returns 0, EvalErr reports ErrDivisionByZero
+	DivZero DivMode = iota
+	// DivNaN follows IEEE 754: 1/0 is +Inf, -1/0 is -Inf, 0/0 and remainder
+	// by zero are NaN, no error is reported
+	DivNaN
+	// DivError returns NaN, EvalErr reports ErrDivisionByZero
+	DivError
+)
+
+// Returns the result of division by zero in DivZero or DivError mode
+func divByZero(op arithOp, s *evalState) Num {
+	s.fail(ErrDivisionByZero)
+	if op&divErrorOp != 0 {
+		return Num(math.NaN())
+	}
+	return 0
+}
+
+// Applies arithmetic, bitwise or comparison operator to the evaluated operands
+func applyBinary(op arithOp, a, b, eps Num, s *evalState) (res Num) {
+	if op&intOp != 0 {
+		return applyInt(op&^intOp, a, b, s)
+	}
+	switch op &^ opFlags {
 	case power:
-		res = Num(math.Pow(float64(e.a.Eval()), float64(e.b.Eval())))
+		res = pow(a, b, op&oddRootOp != 0)
 	case multiply:
-		res = e.a.Eval() * e.b.Eval()
+		res = a * b
 	case divide:
-		tmp := e.b.Eval()
-		if tmp != 0 {
-			res = e.a.Eval() / tmp
+		if b != 0 || op&divNaNOp != 0 {
+			res = a / b
+		} else {
+			res = divByZero(op, s)
 		}
 	case remainder:
-		tmp := e.b.Eval()
-		if tmp != 0 {
-			res = Num(math.Remainder(float64(e.a.Eval()), float64(tmp)))
+		if b != 0 || op&divNaNOp != 0 {
+			if op&truncOp != 0 {
+				res = Num(math.Mod(float64(a), float64(b)))
+			} else {
+				res = Num(math.Remainder(float64(a), float64(b)))
+			}
+		} else {
+			res = divByZero(op, s)
+		}
+	case modulo:
+		if b != 0 || op&divNaNOp != 0 {
+			res = Num(math.Mod(float64(a), float64(b)))
+		} else {
+			res = divByZero(op, s)
+		}
+	case floorDivide:
+		if b != 0 || op&divNaNOp != 0 {
+			res = Num(math.Floor(float64(a / b)))
+		} else {
+			res = divByZero(op, s)
 		}
 	case plus:
-		res = e.a.Eval() + e.b.Eval()
+		res = a + b
 	case minus:
-		res = e.a.Eval() - e.b.Eval()
+		res = a - b
 	case shl:
-		res = Num(int64(e.a.Eval()) << uint(e.b.Eval()))
+		res = shift(toInt(a, s), shiftCount(b, s))
 	case shr:
-		res = Num(int64(e.a.Eval()) >> uint(e.b.Eval()))
+		res = shift(toInt(a, s), -shiftCount(b, s))
+	// Comparisons follow IEEE 754: NaN is unordered, so any comparison with NaN
+	// is false except for "!=", which is true. NaN is non-zero, so logical
+	// operators treat it as true.
 	case lessThan:
-		res = boolNum(e.a.Eval() < e.b.Eval())
+		res = boolNum(a < b)
 	case lessOrEquals:
-		res = boolNum(e.a.Eval() <= e.b.Eval())
+		res = boolNum(a <= b)
 	case greaterThan:
-		res = boolNum(e.a.Eval() > e.b.Eval())
+		res = boolNum(a > b)
 	case greaterOrEquals:
-		res = boolNum(e.a.Eval() >= e.b.Eval())
+		res = boolNum(a >= b)
+	case compare:
+		// Three-way comparison, NaN if operands are unordered
+		switch {
+		case equal(a, b, eps):
+			res = 0
+		case a < b:
+			res = -1
+		case a > b:
+			res = 1
+		default:
+			res = Num(math.NaN())
+		}
+	// Smaller and larger operand, same as min() and max() with two arguments
+	case minimum:
+		res = a
+		if b < a {
+			res = b
+		}
+	case maximum:
+		res = a
+		if b > a {
+			res = b
+		}
 	case equals:
-		res = boolNum(e.a.Eval() == e.b.Eval())
+		res = boolNum(equal(a, b, eps))
 	case notEquals:
-		res = boolNum(e.a.Eval() != e.b.Eval())
+		res = boolNum(!equal(a, b, eps))
 	case bitwiseAnd:
-		return Num(int64(e.a.Eval()) & int64(e.b.Eval()))
+		res = Num(toInt(a, s) & toInt(b, s))
 	case bitwiseXor:
-		return Num(int64(e.a.Eval()) ^ int64(e.b.Eval()))
+		res = Num(toInt(a, s) ^ toInt(b, s))
 	case bitwiseOr:
-		return Num(int64(e.a.Eval()) | int64(e.b.Eval()))
-	case logicalAnd:
-		if a := e.a.Eval(); a != 0 {
-			if b := e.b.Eval(); b != 0 {
-				res = b
-			}
+		res = Num(toInt(a, s) | toInt(b, s))
+	case logicalXor:
+		res = boolNum((a != 0) != (b != 0))
+	}
+	return normalizeZero(op, res)
+}
+
+// RemMode defines how "%" operator computes the remainder
+type RemMode int
+
+const (
+	// RemIEEE gives IEEE 754 remainder a-n*b, where n is a/b rounded to the
+	// nearest integer, so 7%4 is -1 and the result may be negative for
+	// positive operands
+	RemIEEE RemMode = iota
+	// RemTruncated gives a-n*b, where n is a/b truncated towards zero, like
+	// "%%" operator and "%" in C or Go, so 7%4 is 3 and the result has the
+	// sign of a
+	RemTruncated
+)
+
+// Largest exponent that is computed by repeated multiplication
+const maxIntPow = 64
+
+// Raises a to the power of b, small non-negative integer exponents are
+// computed by squaring, which is faster than math.Pow. With oddRoots negative
+// a has real roots for exponents 1/n where n is odd, see OddRoots.
+func pow(a, b Num, oddRoots bool) Num {
+	if b < 0 || b > maxIntPow || b != Num(int(b)) {
+		if oddRoots && a < 0 && isOddRoot(b) {
+			return -Num(math.Pow(float64(-a), float64(b)))
 		}
-	case logicalOr:
-		if a := e.a.Eval(); a != 0 {
-			res = a
-		} else if b := e.b.Eval(); b != 0 {
-			res = b
+		return Num(math.Pow(float64(a), float64(b)))
+	}
+	res := Num(1)
+	for n := int(b); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			res = res * a
 		}
-	case assign:
-		res = e.b.Eval()
-		e.a.(*varExpr).Set(res)
-	case comma:
-		e.a.Eval()
-		res = e.b.Eval()
+		a = a * a
 	}
 	return res
 }
 
+// Reports whether the exponent is 1/n for an odd integer n
+func isOddRoot(b Num) bool {
+	n := 1 / float64(b)
+	return n == math.Trunc(n) && math.Abs(math.Mod(n, 2)) == 1
+}
+
+// Applies arithmetic operator to the operands converted to int64, like
+// bitwise operators do. Results wrap around on overflow. Both "%" and "%%"
+// are the truncated remainder, like "%" in Go, and "//" rounds the quotient
+// down. Negative exponents give 0, the truncated fraction, except for bases 1
+// and -1, and 0 that is handled like in float mode, as is division by zero.
+func applyInt(op arithOp, a, b Num, s *evalState) Num {
+	x, y := toInt(a, s), toInt(b, s)
+	switch op &^ opFlags {
+	case plus:
+		return Num(x + y)
+	case minus:
+		return Num(x - y)
+	case multiply:
+		return Num(x * y)
+	case divide:
+		if y != 0 {
+			return Num(x / y)
+		}
+	case remainder, modulo:
+		if y != 0 {
+			return Num(x % y)
+		}
+	case floorDivide:
+		if y != 0 {
+			q := x / y
+			if x%y != 0 && (x < 0) != (y < 0) {
+				q--
+			}
+			return Num(q)
+		}
+	case power:
+		if y >= 0 || x == 1 || x == -1 {
+			if y < 0 {
+				y = -y
+			}
+			res := int64(1)
+			for ; y > 0; y >>= 1 {
+				if y&1 != 0 {
+					res = res * x
+				}
+				x = x * x
+			}
+			return Num(res)
+		} else if x != 0 {
+			return 0
+		}
+	}
+	return applyBinary(op, Num(x), Num(y), 0, s)
+}
+
+// Reports whether the numbers differ by at most eps
+func equal(a, b, eps Num) bool {
+	return a == b || math.Abs(float64(a-b)) <= float64(eps)
+}
+
+// Largest integer that float64 represents exactly along with all smaller ones
+const maxSafeInt = 1<<53 - 1
+
+// Converts operand of a bitwise operator to an integer. Fractions are
+// truncated, values outside of int64 range are saturated and NaN becomes 0.
+// Operands that are not integers or are not in the safe integer range, where
+// float64 may have already lost precision, are reported as ErrBadInteger.
+// Results of bitwise operators are not checked and may lose precision too.
+func toInt(a Num, s *evalState) int64 {
+	if a != Num(math.Trunc(float64(a))) || a > maxSafeInt || a < -maxSafeInt {
+		s.fail(ErrBadInteger)
+	}
+	switch {
+	case a != a:
+		return 0
+	case a >= math.MaxInt64:
+		return math.MaxInt64
+	case a <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(a)
+}
+
+// Converts shift count to an integer in -64..64 range
+func shiftCount(n Num, s *evalState) int64 {
+	count := toInt(n, s)
+	if count > 64 {
+		return 64
+	} else if count < -64 {
+		return -64
+	}
+	return count
+}
+
+// Shifts a left by n bits, or right if n is negative. Shifting by 64 bits or
+// more gives 0, or -1 when shifting a negative number right.
+func shift(a, n int64) Num {
+	if n >= 0 {
+		return Num(a << uint(n))
+	}
+	return Num(a >> uint(-n))
+}
+
 func (e *binaryExpr) String() string {
 	return fmt.Sprintf("<%v>(%v, %v)", e.op, e.a, e.b)
 }
@@ -258,25 +1063,138 @@ const (
 	tokOp
 	tokOpen
 	tokClose
+	tokString
 )
 
-func tokenize(input []rune) (tokens []string, err error) {
+// Token kind, text and its offset in the input, unary operators have "u"
+// appended
+type token struct {
+	kind  int
+	text  string
+	pos   int
+	end   int
+	index int
+}
+
+// Returns token text as it appeared in the input
+func (t token) source() string {
+	if t.kind == tokOp && len(t.text) > 1 && strings.HasSuffix(t.text, "u") {
+		return t.text[:len(t.text)-1]
+	}
+	return t.text
+}
+
+// Sets the line and column of the error position in the input
+func (e *ParseError) locate(input []rune) {
+	e.Line, e.Col = 1, 1
+	for _, c := range input[:e.Pos] {
+		if c == '\n' {
+			e.Line, e.Col = e.Line+1, 1
+		} else {
+			e.Col++
+		}
+	}
+}
+
+func (t token) wrap(err error) error {
+	return &ParseError{Err: err, Pos: t.pos, Token: t.source(), End: t.end, Index: t.index}
+}
+
+// Returns true if c may appear in an identifier after its first letter. A
+// lone "_" is an identifier too.
+func isWordChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsNumber(c) || c == '_'
+}
+
+// Checks that underscores in a number only appear between two digits
+func validSeparators(num []rune) bool {
+	// Exponent marks are not digits, except in hexadecimal numbers
+	hex := len(num) > 1 && num[0] == '0' && (num[1] == 'x' || num[1] == 'X')
+	isDigit := func(c rune) bool {
+		return (hex || (c != 'e' && c != 'E')) && (unicode.IsLetter(c) || unicode.IsNumber(c))
+	}
+	for i, c := range num {
+		if c == '_' && (i == 0 || i == len(num)-1 || !isDigit(num[i-1]) || !isDigit(num[i+1])) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses decimal floating point numbers and integers with 0x, 0o or 0b prefix,
+// underscores separating digits are ignored
+func parseNumber(s string) (Num, error) {
+	s = strings.Replace(s, "_", "", -1)
+	if len(s) > 1 && s[0] == '0' && strings.ContainsRune("xXoObB", rune(s[1])) {
+		n, err := strconv.ParseUint(s, 0, 64)
+		return Num(n), err
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	return Num(n), err
+}
+
+func tokenize(input []rune, table *OpTable) (tokens []token, err error) {
+	defer func() {
+		if pe, ok := err.(*ParseError); ok {
+			pe.locate(input)
+		}
+	}()
+	// Token texts are sliced from a single string copy of the input, offs maps
+	// rune positions to byte offsets in that string
+	src := string(input)
+	offs := make([]int, 0, len(input)+1)
+	for i := range src {
+		offs = append(offs, i)
+	}
+	offs = append(offs, len(src))
+	text := func(from, to int) string { return src[offs[from]:offs[to]] }
+
 	pos := 0
 	expected := tokOpen | tokNumber | tokWord
 	for pos < len(input) {
-		tok := []rune{}
 		c := input[pos]
 		if unicode.IsSpace(c) {
 			pos++
 			continue
 		}
+		if c == '#' {
+			// Line comment
+			for pos < len(input) && input[pos] != '\n' {
+				pos++
+			}
+			continue
+		}
+		if c == '/' && pos+1 < len(input) && input[pos+1] == '*' {
+			// Block comment
+			end := pos + 2
+			for end+1 < len(input) && (input[end] != '*' || input[end+1] != '/') {
+				end++
+			}
+			if end+1 >= len(input) {
+				return nil, token{text: "/*", pos: pos, end: pos + 2, index: len(tokens)}.wrap(ErrComment)
+			}
+			pos = end + 2
+			continue
+		}
+		start, kind, unary := pos, 0, false
+		bad := token{text: text(pos, pos+1), pos: pos, end: pos + 1, index: len(tokens)}
 		if unicode.IsNumber(c) {
 			if expected&tokNumber == 0 {
-				return nil, ErrUnexpectedNumber
+				return nil, bad.wrap(ErrUnexpectedNumber)
 			}
 			expected = tokOp | tokClose
-			for (c == '.' || unicode.IsNumber(c)) && pos < len(input) {
-				tok = append(tok, input[pos])
+			kind = tokNumber
+			isDigit := func(c rune) bool { return c == '.' || c == '_' || unicode.IsNumber(c) }
+			decimal := true
+			if c == '0' && pos+1 < len(input) && strings.ContainsRune("xXoObB", input[pos+1]) {
+				// Hexadecimal, octal or binary integer, digits are validated when
+				// the number is parsed
+				pos++
+				c = input[pos]
+				isDigit = func(c rune) bool { return c == '_' || unicode.IsLetter(c) || unicode.IsNumber(c) }
+				decimal = false
+			}
+			for isDigit(c) && pos < len(input) {
 				pos++
 				if pos < len(input) {
 					c = input[pos]
@@ -284,13 +1202,30 @@ func tokenize(input []rune) (tokens []string, err error) {
 					c = 0
 				}
 			}
-		} else if unicode.IsLetter(c) {
+			if decimal && (c == 'e' || c == 'E') {
+				// Exponent is only consumed if followed by digits, otherwise "e" is
+				// left to be an identifier
+				exp := pos + 1
+				if exp < len(input) && (input[exp] == '+' || input[exp] == '-') {
+					exp++
+				}
+				if exp < len(input) && unicode.IsNumber(input[exp]) {
+					pos = exp
+					for pos < len(input) && isDigit(input[pos]) && input[pos] != '.' {
+						pos++
+					}
+				}
+			}
+			if !validSeparators(input[start:pos]) {
+				return nil, token{text: text(start, pos), pos: start, end: pos, index: len(tokens)}.wrap(ErrBadNumber)
+			}
+		} else if unicode.IsLetter(c) || (c == '_' && (pos+1 == len(input) || !isWordChar(input[pos+1]))) {
 			if expected&tokWord == 0 {
-				return nil, ErrUnexpectedIdentifier
+				return nil, bad.wrap(ErrUnexpectedIdentifier)
 			}
 			expected = tokOp | tokOpen | tokClose
-			for (unicode.IsLetter(c) || unicode.IsNumber(c) || c == '_') && pos < len(input) {
-				tok = append(tok, input[pos])
+			kind = tokWord
+			for isWordChar(c) && pos < len(input) {
 				pos++
 				if pos < len(input) {
 					c = input[pos]
@@ -298,49 +1233,86 @@ func tokenize(input []rune) (tokens []string, err error) {
 					c = 0
 				}
 			}
-		} else if c == '(' || c == ')' {
-			tok = append(tok, c)
+			if _, ok := table.unary[text(start, pos)]; ok {
+				// Word unary operator, like "not"
+				kind, unary = tokOp, true
+				expected = tokNumber | tokWord | tokOpen
+			}
+		} else if c == '"' {
+			if expected&tokNumber == 0 {
+				return nil, bad.wrap(ErrUnexpectedString)
+			}
+			expected = tokOp | tokClose
+			kind = tokString
+			// Escape sequences are validated when the string is parsed
+			for pos++; pos < len(input) && input[pos] != '"'; pos++ {
+				if input[pos] == '\\' && pos+1 < len(input) {
+					pos++
+				}
+			}
+			if pos == len(input) {
+				return nil, token{text: text(start, pos), pos: start, end: pos, index: len(tokens)}.wrap(ErrBadString)
+			}
+			pos++
+		} else if strings.ContainsRune("()[]", c) {
+			kind = tokOpen
+			if c == ')' || c == ']' {
+				kind = tokClose
+			}
 			pos++
-			if c == '(' && (expected&tokOpen) != 0 {
+			// Square brackets are either a vector or an index that follows an
+			// operand, see ParseVector
+			if (c == '(' && (expected&tokOpen) != 0) || (c == '[' && (expected&(tokOpen|tokOp)) != 0) {
 				expected = tokNumber | tokWord | tokOpen | tokClose
-			} else if c == ')' && (expected&tokClose) != 0 {
+			} else if kind == tokClose && (expected&tokClose) != 0 {
 				expected = tokOp | tokClose
 			} else {
-				return nil, ErrParen
+				return nil, bad.wrap(ErrParen)
 			}
 		} else {
+			kind = tokOp
 			if expected&tokOp == 0 {
-				if c != '-' && c != '^' && c != '!' {
-					return nil, ErrOperandMissing
+				// Longest unary operator that matches the input
+				end := 0
+				for i := pos + 1; i <= len(input) && table.unaryPrefixes[text(pos, i)]; i++ {
+					if _, ok := table.unary[text(pos, i)]; ok {
+						end = i
+					}
 				}
-				tok = append(tok, c, 'u')
-				pos++
+				if end == 0 {
+					return nil, bad.wrap(ErrOperandMissing)
+				}
+				unary = true
+				pos = end
 			} else {
-				var lastOp string
-				for !unicode.IsLetter(c) && !unicode.IsNumber(c) && !unicode.IsSpace(c) &&
-					c != '_' && c != '(' && c != ')' && pos < len(input) {
-					if _, ok := ops[string(tok)+string(input[pos])]; ok {
-						tok = append(tok, input[pos])
-						lastOp = string(tok)
-					} else if lastOp == "" {
-						tok = append(tok, input[pos])
-					} else {
-						break
-					}
-					pos++
-					if pos < len(input) {
-						c = input[pos]
-					} else {
-						c = 0
+				// Longest operator that matches the input
+				end := 0
+				for i := pos + 1; i <= len(input) && table.isPrefix(text(pos, i)); i++ {
+					if _, ok := table.ops[text(pos, i)]; ok {
+						end = i
 					}
 				}
-				if lastOp == "" {
-					return nil, ErrBadOp
+				if end == 0 {
+					for pos < len(input) && !unicode.IsLetter(input[pos]) && !unicode.IsNumber(input[pos]) &&
+						!unicode.IsSpace(input[pos]) && !strings.ContainsRune("_()[]", input[pos]) {
+						pos++
+					}
+					return nil, token{text: text(start, pos), pos: start, end: pos, index: len(tokens)}.wrap(ErrBadOp)
 				}
+				pos = end
 			}
 			expected = tokNumber | tokWord | tokOpen
+			if text(start, pos) == "," {
+				// Trailing comma is rejected by the parser unless allowed
+				expected |= tokClose
+			}
 		}
-		tokens = append(tokens, string(tok))
+		tok := token{kind: kind, text: text(start, pos), pos: start, end: pos, index: len(tokens)}
+		if unary {
+			// Unary operators are marked with "u" suffix
+			tok.text = table.unary[tok.text]
+		}
+		tokens = append(tokens, tok)
 	}
 	return tokens, nil
 }
@@ -397,86 +1369,708 @@ const (
 	parenForbidden
 )
 
+// Named constants that are used for identifiers not found in variables
+var consts = map[string]Num{
+	"pi":  math.Pi,
+	"e":   math.E,
+	"tau": 2 * math.Pi,
+	"inf": Num(math.Inf(1)),
+	"nan": Num(math.NaN()),
+}
+
+// Constants returns a new map of the predefined constants "pi", "e", "tau",
+// "inf" and "nan". The map can be modified and used as Parser.Consts.
+func Constants() map[string]Num {
+	res := make(map[string]Num, len(consts))
+	for name, n := range consts {
+		res[name] = n
+	}
+	return res
+}
+
+// Parser state and options shared by all Parse variants
+type parser struct {
+	vars  map[string]Var
+	funcs map[string]Func
+	// Functions with known arity
+	specs map[string]FuncSpec
+	// String literals and string variables are only allowed in typed
+	// expressions
+	typed bool
+	strs  map[string]StrVar
+	// Assignments and functions that are not pure are not allowed
+	pure bool
+	// Vectors and indexing are only allowed in vector expressions
+	vector bool
+	// Units of measurement, see ParseUnits
+	units map[string]Unit
+	// Auto-created variables go to scope instead of vars if it's not nil
+	scope map[string]Var
+	// Comparisons that may be continued by the next comparison operator,
+	// mapped to their last comparison
+	chain map[Expr]*binaryExpr
+	// Variable "_" holding the result of the previous statement, if used
+	prev Var
+	// Auto-created variables mapped to their first occurrence, only tracked
+	// if AssignBeforeUse or DeclaredAssign is set
+	auto map[Var]token
+	// Number of auto-created variables
+	created int
+	ops     *OpTable
+	Parser
+}
+
+// Parser holds parsing options. Zero value parses the same way Parse does.
+type Parser struct {
+	// Strict makes unknown identifiers an error, see ParseStrict
+	Strict bool
+	// ChainComparisons makes "a < b < c" mean "a < b && b < c" like in
+	// Python, with b evaluated only once. Only "<", "<=", ">" and ">=" can be
+	// chained.
+	ChainComparisons bool
+	// Env is the initial environment of all function calls, see
+	// ParseWithEnv
+	Env interface{}
+	// Ops are the operators recognized by the parser, DefaultOps() if nil
+	Ops *OpTable
+	// MaxCost makes expressions which Cost is greater than MaxCost an error,
+	// ErrTooComplex. Zero means no limit.
+	MaxCost int
+	// NoAssign makes assignments an error, ErrAssign, so that "x = 5" meant
+	// as a comparison doesn't modify x
+	NoAssign bool
+	// MaxDepth limits how deep parentheses, including function calls, may be
+	// nested, ErrTooDeep is returned otherwise. Zero means DefaultMaxDepth.
+	MaxDepth int
+	// Consts are the named constants, identifiers that are not variables
+	// become constant values that can't be assigned. Nil means the
+	// predefined constants, see Constants.
+	Consts map[string]Num
+	// AssignBeforeUse makes it an error, ErrUnassigned, to read a variable
+	// that is not in vars before it is assigned, like "y" in "y = y + 1" or
+	// in "z = y, y = 1". Variables assigned in only one branch of a condition,
+	// or on the right of "&&" and "||", are not considered assigned after it.
+	AssignBeforeUse bool
+	// DeclaredAssign makes it an error, ErrUnknownVar, to assign a variable
+	// that is not in vars, so that a typo like "totl = 1" doesn't create a
+	// new variable. Unlike Strict, unknown variables can still be read.
+	DeclaredAssign bool
+	// DivByZero defines the result of division or remainder by zero, see
+	// DivMode. By default it is 0 and EvalErr reports ErrDivisionByZero.
+	DivByZero DivMode
+	// EqualEpsilon is the largest difference between numbers that "==",
+	// "!=" and "<=>" consider equal. Zero means exact comparison.
+	EqualEpsilon Num
+	// RemainderMode defines how "%" computes the remainder, see RemMode
+	RemainderMode RemMode
+	// IntMode makes "+", "-", "*", "/", "**", "%", "%%" and "//" operate on
+	// int64 values, like bitwise operators do, so "7/2" is 3, "2**-1" is 0 and
+	// "7%4" is 3. Operands that are not safe integers are truncated and
+	// reported as ErrBadInteger.
+	IntMode bool
+	// MaxVars limits the number of variables created for unknown
+	// identifiers, ErrTooManyVars is returned otherwise. Zero means no limit.
+	MaxVars int
+	// BitWidth makes "^x" the unsigned complement of the lowest BitWidth bits
+	// of x, so with BitWidth 32 "^2" is 4294967293 rather than -3. Zero means
+	// the signed complement of the int64 value, widths above 64 mean 64.
+	BitWidth int
+	// OddRoots makes "**" return the real root of negative numbers when the
+	// exponent is 1/n for an odd integer n, so "(-8)**(1/3)" is -2. By
+	// default "**" follows math.Pow, which gives NaN for a negative base and
+	// a finite exponent that is not an integer. The "pow" builtin always
+	// follows math.Pow, and "cbrt" returns the real cube root in both modes.
+	OddRoots bool
+	// NormalizeZero makes operators return 0 instead of negative zero, e.g.
+	// for "-0" or "0*-1". Negative zero is equal to 0 when compared, but it
+	// is printed as "-0" and it gives -Inf when divided by in DivNaN mode.
+	NormalizeZero bool
+	// TrailingComma allows a single comma after the last function argument,
+	// like "f(x, y,)"
+	TrailingComma bool
+	// BoolLogic makes "&&" and "||" return 1 or 0 instead of the value of
+	// their last evaluated operand, e.g. "3 && 4" is 1 rather than 4
+	BoolLogic bool
+}
+
+// DefaultMaxDepth is the parentheses nesting limit used unless the parser
+// has its own
+const DefaultMaxDepth = 1000
+
+// Parse parses the input using the parser options, see Parse
+func (p *Parser) Parse(input string, vars map[string]Var, funcs map[string]Func) (Expr, error) {
+	return (&parser{vars: vars, funcs: funcs, Parser: *p}).parse(input)
+}
+
+// Parse parses the input and returns the expression tree. Identifiers are
+// looked up in funcs, vars and then among the predefined constants, see
+// Constants. Unknown identifiers become new variables initialized to zero and
+// added to vars. Identifier "_" is the variable that holds the result of the
+// previous comma-separated statement, e.g. "2+3, _*2" is 10.
 func Parse(input string, vars map[string]Var, funcs map[string]Func) (Expr, error) {
+	p := &parser{vars: vars, funcs: funcs}
+	return p.parse(input)
+}
+
+// MustParse is like Parse but panics if the input can't be parsed. It is
+// meant for expressions known to be valid, such as package-level formulas.
+func MustParse(input string, vars map[string]Var, funcs map[string]Func) Expr {
+	e, err := Parse(input, vars, funcs)
+	if err != nil {
+		panic(fmt.Sprintf("expr: MustParse(%q): %v", input, err))
+	}
+	return e
+}
+
+// ParseWithSpecs parses the input like Parse does, but also checks that
+// functions are called with the number of arguments allowed by their specs,
+// returning ErrBadArity otherwise.
+func ParseWithSpecs(input string, vars map[string]Var, specs map[string]FuncSpec) (Expr, error) {
+	funcs := map[string]Func{}
+	for name, spec := range specs {
+		funcs[name] = spec.Fn
+	}
+	p := &parser{vars: vars, funcs: funcs, specs: specs}
+	return p.parse(input)
+}
+
+// ParsePure parses the input like ParseWithSpecs does, but returns
+// ErrSideEffect if the expression has assignments or calls functions which
+// specs are not marked as Pure, so that evaluating it never changes any
+// state and always gives the same result for the same variable values.
+func ParsePure(input string, vars map[string]Var, specs map[string]FuncSpec) (Expr, error) {
+	funcs := map[string]Func{}
+	for name, spec := range specs {
+		funcs[name] = spec.Fn
+	}
+	p := &parser{vars: vars, funcs: funcs, specs: specs, pure: true}
+	return p.parse(input)
+}
+
+// ParseIsolated parses the input like Parse does, but never modifies vars.
+// Unknown identifiers are created as new variables in a separate scope that
+// is returned along with the expression, so expressions parsed with the same
+// base variables don't share any auto-created variables.
+func ParseIsolated(input string, vars map[string]Var, funcs map[string]Func) (Expr, map[string]Var, error) {
+	p := &parser{vars: vars, funcs: funcs, scope: map[string]Var{}}
+	e, err := p.parse(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, p.scope, nil
+}
+
+// ParseAll parses the input like Parse does and returns the statements
+// separated by top-level commas as separate expressions, see Statements.
+// Statements share variables, so they should be evaluated in order. Syntax
+// errors are returned as a StatementError with the index of the statement
+// that has the error.
+func ParseAll(input string, vars map[string]Var, funcs map[string]Func) ([]Expr, error) {
+	p := &parser{vars: vars, funcs: funcs}
+	e, err := p.parse(input)
+	if err != nil {
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			return nil, err
+		}
+		// Count top-level commas before the error position
+		index := 0
+		tokens, _ := tokenize([]rune(input)[:pe.Pos], p.ops)
+		for depth, i := 0, 0; i < len(tokens); i++ {
+			switch tokens[i].text {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			case ",":
+				if depth == 0 {
+					index++
+				}
+			}
+		}
+		return nil, &StatementError{Index: index, Err: err}
+	}
+	return list(e), nil
+}
+
+// ParseStrict parses the input like Parse does, but returns ErrUnknownVar
+// for identifiers that are neither variables, functions nor constants. The
+// identifier is reported as the Token of the returned ParseError.
+func ParseStrict(input string, vars map[string]Var, funcs map[string]Func) (Expr, error) {
+	return (&Parser{Strict: true}).Parse(input, vars, funcs)
+}
+
+// ParseWithEnv parses the input like Parse does and sets Env of all function
+// calls to env
+func ParseWithEnv(input string, vars map[string]Var, funcs map[string]Func, env interface{}) (Expr, error) {
+	return (&Parser{Env: env}).Parse(input, vars, funcs)
+}
+
+// Validate checks that the input is a valid expression, without keeping the
+// tree. Unknown identifiers are accepted as variables like Parse does, but no
+// variable map is modified.
+func Validate(input string, funcs map[string]Func) error {
+	_, err := Parse(input, map[string]Var{}, funcs)
+	return err
+}
+
+// ParseReader reads the whole input from r and parses it like Parse does.
+// Errors returned by r are returned as is.
+func ParseReader(r io.Reader, vars map[string]Var, funcs map[string]Func) (Expr, error) {
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(string(input), vars, funcs)
+}
+
+// Parses the input, errors are annotated with the input string
+func (p *parser) parse(input string) (Expr, error) {
+	if p.ops = p.Ops; p.ops == nil {
+		p.ops = DefaultOps()
+	}
+	if p.AssignBeforeUse || p.DeclaredAssign {
+		p.auto = map[Var]token{}
+	}
+	e, err := p.parseExpr(input)
+	if err == nil && p.MaxCost > 0 && Cost(e) > p.MaxCost {
+		err = ErrTooComplex
+	}
+	if err == nil && p.prev != nil {
+		// "a, b" becomes "(_ = a), b" if "_" is used. Function arguments are
+		// not affected, since they are no longer comma expressions.
+		Walk(e, func(e Expr) bool {
+			if b, ok := e.(*binaryExpr); ok && b.op == comma {
+				b.a = &binaryExpr{op: assign, a: p.prev, b: b.a}
+			}
+			return true
+		})
+	}
+	if err == nil && p.IntMode {
+		Walk(e, func(e Expr) bool {
+			if b, ok := e.(*binaryExpr); ok && intOps[b.op&^opFlags] {
+				b.op |= intOp
+			}
+			return true
+		})
+	}
+	if err == nil && p.BitWidth > 0 {
+		width := arithOp(p.BitWidth)
+		if width > 64 {
+			width = 64
+		}
+		Walk(e, func(e Expr) bool {
+			if u, ok := e.(*unaryExpr); ok && u.op&^opFlags == unaryBitwiseNot {
+				u.op |= width << widthShift
+			}
+			return true
+		})
+	}
+	if err == nil && p.DivByZero != DivZero {
+		flag := divNaNOp
+		if p.DivByZero == DivError {
+			flag = divErrorOp
+		}
+		Walk(e, func(e Expr) bool {
+			if b, ok := e.(*binaryExpr); ok && divOps[b.op&^opFlags] {
+				b.op |= flag
+			}
+			return true
+		})
+	}
+	if err == nil && p.EqualEpsilon != 0 {
+		Walk(e, func(e Expr) bool {
+			if b, ok := e.(*binaryExpr); ok && b.def == nil {
+				switch b.op &^ opFlags {
+				case equals, notEquals, compare:
+					b.eps = p.EqualEpsilon
+				}
+			}
+			return true
+		})
+	}
+	if err == nil && p.RemainderMode == RemTruncated {
+		Walk(e, func(e Expr) bool {
+			if b, ok := e.(*binaryExpr); ok && b.op&^opFlags == remainder {
+				b.op |= truncOp
+			}
+			return true
+		})
+	}
+	if err == nil && p.OddRoots {
+		Walk(e, func(e Expr) bool {
+			if b, ok := e.(*binaryExpr); ok && b.op&^opFlags == power {
+				b.op |= oddRootOp
+			}
+			return true
+		})
+	}
+	if err == nil && p.NormalizeZero {
+		Walk(e, func(e Expr) bool {
+			if u, ok := e.(*unaryExpr); ok {
+				u.op |= zeroOp
+			} else if b, ok := e.(*binaryExpr); ok && (b.def != nil || signedZeroOps[b.op&^opFlags]) {
+				b.op |= zeroOp
+			}
+			return true
+		})
+	}
+	if err == nil && p.DeclaredAssign {
+		Walk(e, func(e Expr) bool {
+			if b, ok := e.(*binaryExpr); ok && isAssign(b.op) {
+				// Variable "_" is assigned implicitly
+				if v, ok := b.a.(Var); ok {
+					if tok, ok := p.auto[v]; ok && tok.text != "_" {
+						err = tok.wrap(ErrUnknownVar)
+					}
+				}
+			}
+			return err == nil
+		})
+		if err != nil {
+			p.forgetAuto()
+		}
+	}
+	if err == nil && p.AssignBeforeUse {
+		if v := p.unassigned(e, map[Var]bool{}); v != nil {
+			err = p.auto[v].wrap(ErrUnassigned)
+			p.forgetAuto()
+		}
+	}
+	if pe, ok := err.(*ParseError); ok {
+		pe.locate([]rune(input))
+	}
+	if err != nil {
+		return nil, inputError(input, err)
+	}
+	return e, nil
+}
+
+// Removes auto-created variables from vars when the expression is rejected
+func (p *parser) forgetAuto() {
+	if p.scope == nil {
+		for _, tok := range p.auto {
+			delete(p.vars, tok.text)
+		}
+	}
+}
+
+// Returns the first auto-created variable that is read before it is assigned,
+// in evaluation order. Assigned variables are added to the set.
+func (p *parser) unassigned(e Expr, assigned map[Var]bool) Var {
+	// Branches that may not be evaluated get their own copy of the set
+	branch := func(e Expr) (Var, map[Var]bool) {
+		copied := make(map[Var]bool, len(assigned))
+		for v := range assigned {
+			copied[v] = true
+		}
+		return p.unassigned(e, copied), copied
+	}
+	switch e := e.(type) {
+	case Var:
+		if _, ok := p.auto[e]; ok && !assigned[e] {
+			return e
+		}
+	case *unaryExpr:
+		return p.unassigned(e.arg, assigned)
+	case *binaryExpr:
+		if e.op == assign {
+			if v := p.unassigned(e.b, assigned); v != nil {
+				return v
+			}
+			if v, ok := e.a.(Var); ok {
+				assigned[v] = true
+			}
+			return nil
+		}
+		if v := p.unassigned(e.a, assigned); v != nil {
+			return v
+		}
+		if e.op == logicalAnd || e.op == logicalOr {
+			v, _ := branch(e.b)
+			return v
+		}
+		return p.unassigned(e.b, assigned)
+	case *ternaryExpr:
+		if v := p.unassigned(e.cond, assigned); v != nil {
+			return v
+		}
+		v, a := branch(e.a)
+		if v != nil {
+			return v
+		}
+		v, b := branch(e.b)
+		if v != nil {
+			return v
+		}
+		for v := range a {
+			if b[v] {
+				assigned[v] = true
+			}
+		}
+	case *FuncContext:
+		for _, arg := range e.Args {
+			if v := p.unassigned(arg, assigned); v != nil {
+				return v
+			}
+		}
+	case *vecExpr:
+		for _, item := range e.items {
+			if v := p.unassigned(item, assigned); v != nil {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func inputError(input string, err error) error {
+	return fmt.Errorf("expr %q: %w", input, err)
+}
+
+func (p *parser) parseExpr(input string) (Expr, error) {
+	vars, funcs, ops, constants := p.vars, p.funcs, p.ops.ops, p.Consts
+	if constants == nil {
+		constants = consts
+	}
 	os := stringStack{}
 	es := exprStack{}
+	// Token indices of the opening parentheses of function calls
+	calls := []int{}
 
+	runes := []rune(input)
 	paren := parenAllowed
-	if tokens, err := tokenize([]rune(input)); err != nil {
+	depth, maxDepth := 0, p.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	if tokens, err := tokenize(runes, p.ops); err != nil {
 		return nil, err
 	} else {
-		for _, token := range tokens {
+		for i, tok := range tokens {
+			token := tok.text
 			parenNext := parenAllowed
 			if token == "(" {
+				if depth++; depth > maxDepth {
+					return nil, tok.wrap(ErrTooDeep)
+				}
 				if paren == parenExpected {
 					os.Push("{")
+					calls = append(calls, i)
 				} else if paren == parenAllowed {
 					os.Push("(")
 				} else {
-					return nil, ErrBadCall
+					return nil, tok.wrap(ErrBadCall)
 				}
 			} else if paren == parenExpected {
-				return nil, ErrBadCall
+				return nil, tok.wrap(ErrBadCall)
+			} else if token == "[" {
+				if !p.vector {
+					return nil, tok.wrap(ErrBadOp)
+				}
+				if depth++; depth > maxDepth {
+					return nil, tok.wrap(ErrTooDeep)
+				}
+				// Brackets right after an operand are an index, otherwise a vector
+				if paren == parenForbidden {
+					os.Push("[[")
+				} else {
+					os.Push("[")
+				}
+			} else if token == "]" {
+				if tokens[i-1].text == "," {
+					return nil, tok.wrap(ErrParen)
+				}
+				for len(os) > 0 && !isOpen(os.Peek()) {
+					if expr, err := p.bind(os.Pop(), &es); err != nil {
+						return nil, tok.wrap(err)
+					} else {
+						es.Push(expr)
+					}
+				}
+				if open := os.Peek(); open != "[" && open != "[[" {
+					return nil, tok.wrap(ErrParen)
+				}
+				depth--
+				if open := os.Pop(); open == "[" {
+					items := []Expr{}
+					if tokens[i-1].text != "[" {
+						items = list(es.Pop())
+					}
+					es.Push(&vecExpr{items: items})
+				} else if tokens[i-1].text == "[" {
+					return nil, tok.wrap(ErrOperandMissing)
+				} else {
+					index := es.Pop()
+					v, ok := es.Pop().(*vecExpr)
+					if !ok {
+						return nil, tok.wrap(ErrTypeMismatch)
+					}
+					es.Push(v.index(index))
+				}
+				parenNext = parenForbidden
 			} else if token == ")" {
-				for len(os) > 0 && os.Peek() != "(" && os.Peek() != "{" {
-					if expr, err := bind(os.Pop(), funcs, &es); err != nil {
-						return nil, err
+				if i > 0 && tokens[i-1].text == "," {
+					// Trailing comma is only allowed in function arguments
+					open := len(os) - 1
+					for open >= 0 && !isOpen(os[open]) {
+						open--
+					}
+					if !p.TrailingComma || open < 0 || os[open] != "{" {
+						return nil, tok.wrap(ErrParen)
+					}
+					os.Pop()
+				}
+				for len(os) > 0 && !isOpen(os.Peek()) {
+					if expr, err := p.bind(os.Pop(), &es); err != nil {
+						return nil, tok.wrap(err)
 					} else {
 						es.Push(expr)
 					}
 				}
-				if len(os) == 0 {
-					return nil, ErrParen
+				if open := os.Peek(); open != "(" && open != "{" {
+					return nil, tok.wrap(ErrParen)
 				}
+				depth--
 				if open := os.Pop(); open == "{" {
-					f := funcs[os.Pop()]
-					args := list(es.Pop())
-					es.Push(&FuncContext{f: f, Vars: vars, Args: args})
+					name := os.Pop()
+					args := []Expr{}
+					if tokens[i-1].text != "(" {
+						args = list(es.Pop())
+					}
+					if p.vector {
+						args = spread(args)
+					}
+					if spec, ok := p.specs[name]; ok {
+						if len(args) < spec.MinArgs || (spec.MaxArgs >= 0 && len(args) > spec.MaxArgs) {
+							return nil, tok.wrap(ErrBadArity)
+						}
+					}
+					f := funcs[name]
+					if f == nil {
+						return nil, tok.wrap(ErrBadCall)
+					}
+					if p.pure && !p.specs[name].Pure {
+						return nil, tok.wrap(ErrSideEffect)
+					}
+					open := calls[len(calls)-1]
+					calls = calls[:len(calls)-1]
+					raw := rawArgs(runes, tokens[open+1:i])
+					es.Push(&FuncContext{f: f, name: name, raw: raw, Vars: vars, Args: args, Env: p.Env})
+				}
+				parenNext = parenForbidden
+			} else if tok.kind == tokNumber {
+				if n, err := parseNumber(token); err != nil {
+					return nil, tok.wrap(ErrBadNumber)
+				} else {
+					es.Push(&constExpr{value: n})
 				}
 				parenNext = parenForbidden
-			} else if n, err := strconv.ParseFloat(token, 64); err == nil {
-				// Number
-				es.Push(&constExpr{value: Num(n)})
+			} else if tok.kind == tokString {
+				if !p.typed {
+					return nil, tok.wrap(ErrUnexpectedString)
+				} else if str, err := strconv.Unquote(token); err != nil {
+					return nil, tok.wrap(ErrBadString)
+				} else {
+					es.Push(&strExpr{value: str})
+				}
 				parenNext = parenForbidden
-			} else if _, ok := funcs[token]; ok {
+			} else if f, ok := funcs[token]; ok && tok.kind == tokWord {
 				// Function
+				if f == nil {
+					return nil, tok.wrap(ErrBadCall)
+				}
 				os.Push(token)
 				parenNext = parenExpected
-			} else if op, ok := ops[token]; ok {
+			} else if token == ":" {
+				// Bind everything up to the matching "?" and replace it with ":",
+				// which is later bound as a three-operand conditional expression
+				for len(os) > 0 && os.Peek() != "?" {
+					if isOpen(os.Peek()) {
+						return nil, tok.wrap(ErrTernary)
+					}
+					if expr, err := p.bind(os.Pop(), &es); err != nil {
+						return nil, tok.wrap(err)
+					} else {
+						es.Push(expr)
+					}
+				}
+				if len(os) == 0 {
+					return nil, tok.wrap(ErrTernary)
+				}
+				os.Pop()
+				os.Push(token)
+			} else if op, ok := ops[token]; ok && tok.kind == tokOp {
+				if p.NoAssign && isAssign(op) {
+					return nil, tok.wrap(ErrAssign)
+				}
+				if p.pure && isAssign(op) {
+					return nil, tok.wrap(ErrSideEffect)
+				}
 				o2 := os.Peek()
-				for ops[o2] != 0 && ((isLeftAssoc(op) && op >= ops[o2]) || op > ops[o2]) {
-					if expr, err := bind(o2, funcs, &es); err != nil {
-						return nil, err
+				prec, prec2 := p.ops.precedence(op), p.ops.precedence(ops[o2])
+				// Prefix unary operators have no left operand to bind
+				for !p.ops.isUnary(op) && ops[o2] != 0 && ((p.ops.isLeftAssoc(op) && prec >= prec2) || prec > prec2) {
+					if expr, err := p.bind(o2, &es); err != nil {
+						return nil, tok.wrap(err)
 					} else {
+						if p.ChainComparisons && isRelational(op) && isRelational(ops[o2]) {
+							p.continueChain(expr)
+						}
 						es.Push(expr)
 					}
 					os.Pop()
 					o2 = os.Peek()
+					prec2 = p.ops.precedence(ops[o2])
 				}
 				os.Push(token)
 			} else {
 				// Variable
-				if v, ok := vars[token]; ok {
+				if v, ok := p.strs[token]; ok && p.typed {
+					es.Push(&strVarExpr{v: v, name: token})
+				} else if u, ok := p.units[token]; ok {
+					es.Push(&unitExpr{unit: u, name: token})
+				} else if v, ok := vars[token]; ok {
+					nameVar(v, token)
+					es.Push(v)
+				} else if n, ok := constants[token]; ok {
+					es.Push(&constExpr{value: n})
+				} else if v, ok := p.scope[token]; ok {
 					es.Push(v)
+				} else if p.Strict && token != "_" {
+					return nil, tok.wrap(ErrUnknownVar)
+				} else if p.created++; p.MaxVars > 0 && p.created > p.MaxVars {
+					return nil, tok.wrap(ErrTooManyVars)
 				} else {
-					v = NewVar(0)
-					vars[token] = v
+					v = &varExpr{name: token}
+					if p.auto != nil {
+						p.auto[v] = tok
+					}
+					if p.scope != nil {
+						p.scope[token] = v
+					} else {
+						vars[token] = v
+					}
 					es.Push(v)
 				}
+				if token == "_" {
+					p.prev, _ = es.Peek().(Var)
+				}
 				parenNext = parenForbidden
 			}
 			paren = parenNext
 		}
+		end := token{pos: len(runes), end: len(runes), index: len(tokens)}
 		if paren == parenExpected {
-			return nil, ErrBadCall
+			return nil, end.wrap(ErrBadCall)
 		}
 		for len(os) > 0 {
 			op := os.Pop()
-			if op == "(" || op == ")" {
-				return nil, ErrParen
+			if op == "(" || op == "[" || op == "[[" {
+				return nil, end.wrap(ErrParen)
 			}
-			if expr, err := bind(op, funcs, &es); err != nil {
-				return nil, err
+			if expr, err := p.bind(op, &es); err != nil {
+				return nil, end.wrap(err)
 			} else {
 				es.Push(expr)
 			}
@@ -490,21 +2084,104 @@ func Parse(input string, vars map[string]Var, funcs map[string]Func) (Expr, erro
 	}
 }
 
-func bind(name string, funcs map[string]Func, stack *exprStack) (Expr, error) {
-	if op, ok := ops[name]; ok {
-		if isUnary(op) {
-			if stack.Peek() == nil {
-				return nil, ErrOperandMissing
-			} else {
-				return newUnaryExpr(op, stack.Pop()), nil
+// Returns the source text of function arguments, given the tokens between
+// the parentheses
+func rawArgs(input []rune, tokens []token) []string {
+	raw := []string{}
+	depth, start := 0, 0
+	for i, tok := range tokens {
+		switch {
+		case tok.kind == tokOpen:
+			depth++
+		case tok.kind == tokClose:
+			depth--
+		case tok.text == "," && depth == 0:
+			raw = append(raw, string(input[tokens[start].pos:tokens[i-1].end]))
+			start = i + 1
+		}
+	}
+	if start < len(tokens) {
+		raw = append(raw, string(input[tokens[start].pos:tokens[len(tokens)-1].end]))
+	}
+	return raw
+}
+
+// Returns true if s marks an opening parenthesis or bracket on the operator
+// stack: "(" for grouping, "{" for function call, "[" for vector and "[[" for
+// index
+func isOpen(s string) bool {
+	return s == "(" || s == "{" || s == "[" || s == "[["
+}
+
+// Binds operator like bind does, but also rewrites chained comparisons
+func (p *parser) bind(name string, stack *exprStack) (Expr, error) {
+	e, err := bind(name, p.ops, stack)
+	if b, ok := e.(*binaryExpr); ok && b.op == index {
+		// "v @ i" is the same as "v[i]"
+		if v, ok := b.a.(*vecExpr); ok {
+			return v.index(b.b), nil
+		}
+		return nil, ErrTypeMismatch
+	}
+	if b, ok := e.(*binaryExpr); ok && p.BoolLogic && (b.op == logicalAnd || b.op == logicalOr) {
+		// "a && b" becomes "!!(a && b)"
+		return newUnaryExpr(unaryLogicalNot, newUnaryExpr(unaryLogicalNot, e)), nil
+	}
+	if err != nil || !p.ChainComparisons {
+		return e, err
+	}
+	if cmp, ok := e.(*binaryExpr); ok && isRelational(cmp.op) {
+		if last, ok := p.chain[cmp.a]; ok {
+			// "a < b < c" becomes "a < (t = b) && t < c", unless b is a
+			// constant or a variable that can be evaluated twice
+			mid := last.b
+			switch mid.(type) {
+			case *constExpr, namedVar:
+			default:
+				t := &varExpr{}
+				last.b = &binaryExpr{op: assign, a: t, b: mid}
+				mid = t
 			}
-		} else {
+			delete(p.chain, cmp.a)
+			return &binaryExpr{op: logicalAnd, a: cmp.a, b: &binaryExpr{op: cmp.op, a: mid, b: cmp.b}}, nil
+		}
+	}
+	return e, nil
+}
+
+// Marks comparison as the one that is continued by the next comparison
+func (p *parser) continueChain(e Expr) {
+	if p.chain == nil {
+		p.chain = map[Expr]*binaryExpr{}
+	}
+	last, ok := e.(*binaryExpr)
+	if ok && last.op == logicalAnd {
+		last, ok = last.b.(*binaryExpr)
+	}
+	if ok {
+		p.chain[e] = last
+	}
+}
+
+func isRelational(op arithOp) bool {
+	return op >= lessThan && op <= greaterOrEquals
+}
+
+func bind(name string, t *OpTable, stack *exprStack) (Expr, error) {
+	if op, ok := t.ops[name]; ok {
+		if op == conditional {
+			// Conditional operator without the matching ":"
+			return nil, ErrTernary
+		} else if op == conditionalElse {
 			b := stack.Pop()
 			a := stack.Pop()
-			if a == nil || b == nil {
+			cond := stack.Pop()
+			if a == nil || b == nil || cond == nil {
 				return nil, ErrOperandMissing
 			}
-			return newBinaryExpr(op, a, b)
+			return &ternaryExpr{cond: cond, a: a, b: b}, nil
+		} else {
+			return t.bind(op, stack)
 		}
 	} else {
 		return nil, ErrBadCall
@@ -1,6 +1,11 @@
 package expr
 
-import "testing"
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+)
 
 func TestConstExpr(t *testing.T) {
 	e := &constExpr{value: 3}
@@ -21,6 +26,76 @@ func TestVar(t *testing.T) {
 	if n := e.Get(); n != 5 {
 		t.Error(n)
 	}
+	if s := fmt.Sprint(e); s != "{5}" {
+		t.Error(s)
+	}
+	if s := fmt.Sprint(&varExpr{value: 2, name: "x"}); s != "{x=2}" {
+		t.Error(s)
+	}
+}
+
+func TestAtomicVar(t *testing.T) {
+	e := NewAtomicVar(3)
+	if n := e.Eval(); n != 3 {
+		t.Error(n)
+	}
+	e.Set(-0.5)
+	if n := e.Get(); n != -0.5 {
+		t.Error(n)
+	}
+
+	// Should pass with -race
+	x := NewAtomicVar(0)
+	sum, err := Parse("x*2+1", map[string]Var{"x": x}, map[string]Func{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				x.Set(Num(j))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if n := sum.Eval(); n < 1 || n > 1999 {
+					t.Error(n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Should pass with -race
+func TestFuncConcurrent(t *testing.T) {
+	x := NewAtomicVar(4)
+	e, err := Parse("sqrt(x) + max(x, 1)", map[string]Var{"x": x}, Builtins())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				n, err := e.Eval(), error(nil)
+				if i%2 == 1 {
+					n, err = EvalErr(e)
+				}
+				if n != 6 || err != nil {
+					t.Error(n, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
 }
 
 func TestFuncExpr(t *testing.T) {
@@ -62,6 +137,57 @@ func TestFuncExpr(t *testing.T) {
 	}
 }
 
+func TestFuncContextArgs(t *testing.T) {
+	f := func(c *FuncContext) Num {
+		return Num(c.NArgs())*1000 + c.Arg(0)*100 + c.Arg(1)*10 + c.ArgOr(2, 7)
+	}
+	for _, test := range []struct {
+		args []Expr
+		n    Num
+	}{
+		{[]Expr{}, 7},
+		{[]Expr{&constExpr{1}}, 1107},
+		{[]Expr{&constExpr{1}, &constExpr{2}}, 2127},
+		{[]Expr{&constExpr{1}, &constExpr{2}, &constExpr{3}}, 3123},
+		{[]Expr{&constExpr{1}, &constExpr{2}, &constExpr{3}, &constExpr{4}}, 4123},
+	} {
+		c := &FuncContext{f: f, Args: test.args}
+		if n := c.Eval(); n != test.n {
+			t.Error(test.args, n, test.n)
+		}
+	}
+	c := &FuncContext{f: f, Args: []Expr{&constExpr{1}}}
+	if n := c.Arg(-1); n != 0 {
+		t.Error(n)
+	}
+	if n := c.ArgOr(-1, 5); n != 5 {
+		t.Error(n)
+	}
+	if n := c.ArgOr(0, 5); n != 1 {
+		t.Error(n)
+	}
+
+	// Arguments evaluated with Arg report errors
+	c = &FuncContext{f: f, Args: []Expr{&binaryExpr{op: divide, a: &constExpr{1}, b: &constExpr{0}}}}
+	if _, err := EvalErr(c); err != ErrDivisionByZero {
+		t.Error(err)
+	}
+}
+
+func TestNilFunc(t *testing.T) {
+	c := &FuncContext{Args: []Expr{&constExpr{1}}}
+	if n := c.Eval(); n != 0 {
+		t.Error(n)
+	}
+	if n, err := EvalErr(c); n != 0 || err != ErrNoFunc {
+		t.Error(n, err)
+	}
+	e := &binaryExpr{op: plus, a: &constExpr{2}, b: c}
+	if n := Compile(e)(); n != 2 {
+		t.Error(n)
+	}
+}
+
 func TestUnaryExpr(t *testing.T) {
 	for e, res := range map[Expr]Num{
 		newUnaryExpr(unaryMinus, &constExpr{5}):      -5,
@@ -77,43 +203,201 @@ func TestUnaryExpr(t *testing.T) {
 
 func TestBinaryExpr(t *testing.T) {
 	for e, res := range map[Expr]Num{
-		&binaryExpr{power, &constExpr{9}, &constExpr{4}}:      6561,
-		&binaryExpr{multiply, &constExpr{9}, &constExpr{4}}:   36,
-		&binaryExpr{divide, &constExpr{9}, &constExpr{4}}:     9.0 / 4.0,
-		&binaryExpr{remainder, &constExpr{9}, &constExpr{4}}:  1,
-		&binaryExpr{remainder, &constExpr{9}, &constExpr{9}}:  0,
-		&binaryExpr{remainder, &constExpr{9}, &constExpr{0}}:  0,
-		&binaryExpr{remainder, &constExpr{-9}, &constExpr{9}}: 0,
-		&binaryExpr{remainder, &constExpr{-9}, &constExpr{8}}: -1,
-
-		&binaryExpr{plus, &constExpr{5}, &constExpr{3}}:  8,
-		&binaryExpr{minus, &constExpr{9}, &constExpr{4}}: 5,
-
-		&binaryExpr{shl, &constExpr{5}, &constExpr{1}}: 10,
-		&binaryExpr{shr, &constExpr{9}, &constExpr{1}}: 4,
-
-		&binaryExpr{lessThan, &constExpr{5}, &constExpr{5}}:        0,
-		&binaryExpr{lessOrEquals, &constExpr{9}, &constExpr{9}}:    1,
-		&binaryExpr{greaterThan, &constExpr{5}, &constExpr{3}}:     1,
-		&binaryExpr{greaterOrEquals, &constExpr{9}, &constExpr{4}}: 1,
-		&binaryExpr{equals, &constExpr{5}, &constExpr{3}}:          0,
-		&binaryExpr{equals, &constExpr{5}, NewVar(5)}:              1,
-		&binaryExpr{notEquals, &constExpr{9}, &constExpr{0}}:       1,
-		&binaryExpr{notEquals, &constExpr{5}, NewVar(5)}:           0,
-
-		&binaryExpr{bitwiseAnd, &constExpr{10}, &constExpr{7}}: 2,
-		&binaryExpr{bitwiseOr, &constExpr{9}, &constExpr{4}}:   13,
-		&binaryExpr{bitwiseXor, &constExpr{9}, &constExpr{2}}:  11,
+		&binaryExpr{op: power, a: &constExpr{9}, b: &constExpr{4}}:      6561,
+		&binaryExpr{op: multiply, a: &constExpr{9}, b: &constExpr{4}}:   36,
+		&binaryExpr{op: divide, a: &constExpr{9}, b: &constExpr{4}}:     9.0 / 4.0,
+		&binaryExpr{op: remainder, a: &constExpr{9}, b: &constExpr{4}}:  1,
+		&binaryExpr{op: remainder, a: &constExpr{9}, b: &constExpr{9}}:  0,
+		&binaryExpr{op: remainder, a: &constExpr{9}, b: &constExpr{0}}:  0,
+		&binaryExpr{op: remainder, a: &constExpr{-9}, b: &constExpr{9}}: 0,
+		&binaryExpr{op: remainder, a: &constExpr{-9}, b: &constExpr{8}}: -1,
+		&binaryExpr{op: modulo, a: &constExpr{9}, b: &constExpr{4}}:     1,
+		&binaryExpr{op: modulo, a: &constExpr{-9}, b: &constExpr{4}}:    -1,
+		&binaryExpr{op: modulo, a: &constExpr{9}, b: &constExpr{-4}}:    1,
+		&binaryExpr{op: modulo, a: &constExpr{-9}, b: &constExpr{-4}}:   -1,
+		&binaryExpr{op: modulo, a: &constExpr{7}, b: &constExpr{4}}:     3,
+		&binaryExpr{op: modulo, a: &constExpr{5.5}, b: &constExpr{2}}:   1.5,
+		&binaryExpr{op: modulo, a: &constExpr{9}, b: &constExpr{0}}:     0,
+
+		&binaryExpr{op: plus, a: &constExpr{5}, b: &constExpr{3}}:  8,
+		&binaryExpr{op: minus, a: &constExpr{9}, b: &constExpr{4}}: 5,
+
+		&binaryExpr{op: shl, a: &constExpr{5}, b: &constExpr{1}}: 10,
+		&binaryExpr{op: shr, a: &constExpr{9}, b: &constExpr{1}}: 4,
+		// Shift by 64 bits or more shifts all bits out, negative count
+		// shifts in the opposite direction
+		&binaryExpr{op: shl, a: &constExpr{1}, b: &constExpr{63}}:    Num(math.MinInt64),
+		&binaryExpr{op: shl, a: &constExpr{1}, b: &constExpr{64}}:    0,
+		&binaryExpr{op: shl, a: &constExpr{1}, b: &constExpr{1e30}}:  0,
+		&binaryExpr{op: shl, a: &constExpr{1}, b: &constExpr{-1}}:    0,
+		&binaryExpr{op: shl, a: &constExpr{8}, b: &constExpr{-2}}:    2,
+		&binaryExpr{op: shr, a: &constExpr{256}, b: &constExpr{40}}:  0,
+		&binaryExpr{op: shr, a: &constExpr{-256}, b: &constExpr{70}}: -1,
+		&binaryExpr{op: shr, a: &constExpr{1}, b: &constExpr{-3}}:    8,
+		&binaryExpr{op: shr, a: &constExpr{1}, b: &constExpr{-1e30}}: 0,
+
+		&binaryExpr{op: lessThan, a: &constExpr{5}, b: &constExpr{5}}:        0,
+		&binaryExpr{op: lessOrEquals, a: &constExpr{9}, b: &constExpr{9}}:    1,
+		&binaryExpr{op: greaterThan, a: &constExpr{5}, b: &constExpr{3}}:     1,
+		&binaryExpr{op: greaterOrEquals, a: &constExpr{9}, b: &constExpr{4}}: 1,
+		&binaryExpr{op: compare, a: &constExpr{1}, b: &constExpr{2}}:         -1,
+		&binaryExpr{op: compare, a: &constExpr{2}, b: &constExpr{2}}:         0,
+		&binaryExpr{op: compare, a: &constExpr{3}, b: &constExpr{2}}:         1,
+		&binaryExpr{op: compare, a: &constExpr{-0.5}, b: &constExpr{-7}}:     1,
+		&binaryExpr{op: minimum, a: &constExpr{-0.5}, b: &constExpr{-7}}:     -7,
+		&binaryExpr{op: maximum, a: &constExpr{-0.5}, b: &constExpr{-7}}:     -0.5,
+		&binaryExpr{op: equals, a: &constExpr{5}, b: &constExpr{3}}:          0,
+		&binaryExpr{op: equals, a: &constExpr{5}, b: NewVar(5)}:              1,
+		&binaryExpr{op: notEquals, a: &constExpr{9}, b: &constExpr{0}}:       1,
+		&binaryExpr{op: notEquals, a: &constExpr{5}, b: NewVar(5)}:           0,
+
+		&binaryExpr{op: bitwiseAnd, a: &constExpr{10}, b: &constExpr{7}}: 2,
+		&binaryExpr{op: bitwiseOr, a: &constExpr{9}, b: &constExpr{4}}:   13,
+		&binaryExpr{op: bitwiseXor, a: &constExpr{9}, b: &constExpr{2}}:  11,
 
 		// Returns last argument if true, or 0 if false
-		&binaryExpr{logicalAnd, &constExpr{9}, &constExpr{4}}: 4,
-		&binaryExpr{logicalAnd, &constExpr{9}, &constExpr{0}}: 0,
+		&binaryExpr{op: logicalAnd, a: &constExpr{9}, b: &constExpr{4}}: 4,
+		&binaryExpr{op: logicalAnd, a: &constExpr{9}, b: &constExpr{0}}: 0,
 		// Returns first argument if true, or second if false
-		&binaryExpr{logicalOr, &constExpr{3}, &constExpr{4}}: 3,
-		&binaryExpr{logicalOr, &constExpr{0}, &constExpr{4}}: 4,
-		&binaryExpr{logicalOr, &constExpr{0}, &constExpr{0}}: 0,
+		&binaryExpr{op: logicalOr, a: &constExpr{3}, b: &constExpr{4}}: 3,
+		&binaryExpr{op: logicalOr, a: &constExpr{0}, b: &constExpr{4}}: 4,
+		&binaryExpr{op: logicalOr, a: &constExpr{0}, b: &constExpr{0}}: 0,
+		// Returns 1 if exactly one argument is true
+		&binaryExpr{op: logicalXor, a: &constExpr{0}, b: &constExpr{0}}: 0,
+		&binaryExpr{op: logicalXor, a: &constExpr{0}, b: &constExpr{4}}: 1,
+		&binaryExpr{op: logicalXor, a: &constExpr{3}, b: &constExpr{0}}: 1,
+		&binaryExpr{op: logicalXor, a: &constExpr{3}, b: &constExpr{4}}: 0,
 
-		&binaryExpr{assign, NewVar(0), &constExpr{4}}: 4,
+		&binaryExpr{op: assign, a: NewVar(0), b: &constExpr{4}}:       4,
+		&binaryExpr{op: assign, a: NewAtomicVar(0), b: &constExpr{4}}: 4,
+	} {
+		if n := e.Eval(); n != res {
+			t.Error(e, n, res)
+		}
+	}
+}
+
+// Documents what "%" gives in both remainder modes, and how it relates to
+// "%%" and "//"
+func TestRemainderMatrix(t *testing.T) {
+	rem := func(mode RemMode, a, b Num) Num {
+		op := remainder
+		if mode == RemTruncated {
+			op |= truncOp
+		}
+		return (&binaryExpr{op: op, a: &constExpr{a}, b: &constExpr{b}}).Eval()
+	}
+	// Nearest quotient, ties are rounded to even, so 6%4 is 6-2*4 = -2 but
+	// 2%4 is 2-0*4 = 2
+	for _, test := range []struct{ a, b, ieee, trunc Num }{
+		{5, 3, -1, 2},
+		{-5, 3, 1, -2},
+		{5, -3, -1, 2},
+		{-5, -3, 1, -2},
+		{4, 3, 1, 1},
+		{2, 4, 2, 2},
+		{6, 4, -2, 2},
+		{10, 4, 2, 2},
+		{0, 3, 0, 0},
+		{3, 3, 0, 0},
+		{2.5, 1, 0.5, 0.5},
+		{3.5, 1, -0.5, 0.5},
+		{7.5, 2, -0.5, 1.5},
+		{1, 0.3, 0.1, 0.1},
+	} {
+		if n := rem(RemIEEE, test.a, test.b); math.Abs(float64(n-test.ieee)) > 1e-9 {
+			t.Error("ieee", test.a, test.b, n, test.ieee)
+		}
+		if n := rem(RemTruncated, test.a, test.b); math.Abs(float64(n-test.trunc)) > 1e-9 {
+			t.Error("truncated", test.a, test.b, n, test.trunc)
+		}
+	}
+
+	for a := -12; a <= 12; a++ {
+		for b := -5; b <= 5; b++ {
+			if b == 0 {
+				continue
+			}
+			x, y := Num(a), Num(b)
+			// Truncated remainder is the same as Go's integer "%"
+			if n := rem(RemTruncated, x, y); n != Num(a%b) {
+				t.Error("truncated", a, b, n)
+			}
+			// IEEE remainder is at most half of the divisor away from zero
+			n := rem(RemIEEE, x, y)
+			if math.Abs(float64(n)) > math.Abs(float64(y))/2 {
+				t.Error("ieee", a, b, n)
+			}
+			if q := (x - n) / y; q != Num(math.RoundToEven(float64(x/y))) {
+				t.Error("ieee", a, b, n, q)
+			}
+			// "%%" is always truncated, while "//" rounds the quotient down
+			mod := (&binaryExpr{op: modulo, a: &constExpr{x}, b: &constExpr{y}}).Eval()
+			if mod != Num(a%b) {
+				t.Error("modulo", a, b, mod)
+			}
+			div := (&binaryExpr{op: floorDivide, a: &constExpr{x}, b: &constExpr{y}}).Eval()
+			if div != Num(math.Floor(float64(a)/float64(b))) {
+				t.Error("floor divide", a, b, div)
+			}
+		}
+	}
+}
+
+func TestNaNInf(t *testing.T) {
+	nan, inf := &constExpr{Num(math.NaN())}, &constExpr{Num(math.Inf(1))}
+	one := &constExpr{1}
+	for _, eps := range []Num{0, 1e-9} {
+		for i, test := range []struct {
+			e   Expr
+			res Num
+		}{
+			{&binaryExpr{op: lessThan, a: nan, b: one}, 0},
+			{&binaryExpr{op: lessThan, a: one, b: nan}, 0},
+			{&binaryExpr{op: lessOrEquals, a: nan, b: nan}, 0},
+			{&binaryExpr{op: greaterThan, a: nan, b: one}, 0},
+			{&binaryExpr{op: greaterOrEquals, a: nan, b: nan}, 0},
+			{&binaryExpr{op: equals, a: nan, b: nan}, 0},
+			{&binaryExpr{op: equals, a: nan, b: one}, 0},
+			{&binaryExpr{op: notEquals, a: nan, b: nan}, 1},
+			{&binaryExpr{op: notEquals, a: nan, b: one}, 1},
+			{&binaryExpr{op: logicalAnd, a: nan, b: one}, 1},
+			{&binaryExpr{op: logicalXor, a: nan, b: one}, 0},
+			{newUnaryExpr(unaryLogicalNot, nan), 0},
+			{&ternaryExpr{nan, one, &constExpr{2}}, 1},
+
+			{&binaryExpr{op: lessThan, a: one, b: inf}, 1},
+			{&binaryExpr{op: greaterThan, a: newUnaryExpr(unaryMinus, inf), b: one}, 0},
+			{&binaryExpr{op: equals, a: inf, b: inf}, 1},
+			{&binaryExpr{op: notEquals, a: inf, b: inf}, 0},
+			{&binaryExpr{op: equals, a: inf, b: newUnaryExpr(unaryMinus, inf)}, 0},
+			{&binaryExpr{op: lessOrEquals, a: inf, b: inf}, 1},
+			{&binaryExpr{op: lessThan, a: nan, b: inf}, 0},
+			{&binaryExpr{op: compare, a: inf, b: one}, 1},
+			{&binaryExpr{op: compare, a: inf, b: inf}, 0},
+			{&binaryExpr{op: compare, a: newUnaryExpr(unaryMinus, inf), b: one}, -1},
+		} {
+			if b, ok := test.e.(*binaryExpr); ok {
+				b.eps = eps
+			}
+			if n := test.e.Eval(); n != test.res {
+				t.Error(eps, i, test.e, n, test.res)
+			}
+		}
+		// Unordered operands can't be compared
+		for _, e := range []Expr{&binaryExpr{op: compare, a: nan, b: one, eps: eps}, &binaryExpr{op: compare, a: one, b: nan, eps: eps}, &binaryExpr{op: compare, a: nan, b: nan, eps: eps}} {
+			if n := e.Eval(); n == n {
+				t.Error(eps, e, n)
+			}
+		}
+	}
+}
+
+func TestTernaryExpr(t *testing.T) {
+	for e, res := range map[Expr]Num{
+		&ternaryExpr{&constExpr{1}, &constExpr{2}, &constExpr{3}}: 2,
+		&ternaryExpr{&constExpr{0}, &constExpr{2}, &constExpr{3}}: 3,
+		&ternaryExpr{NewVar(-1), &constExpr{2}, &constExpr{3}}:    2,
 	} {
 		if n := e.Eval(); n != res {
 			t.Error(e, n, res)
@@ -0,0 +1,205 @@
+package expr
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrBadBase    = errors.New("unsupported number base")
+	ErrNotInteger = errors.New("number is not an integer")
+)
+
+// Format returns the expression in the infix syntax accepted by Parse.
+// Operands that are operator expressions themselves are always put in
+// parentheses, so the original precedence is preserved.
+func Format(e Expr) string {
+	switch e := e.(type) {
+	case *constExpr:
+		return FormatNum(e.value, -1)
+	case namedVar:
+		if name := e.varName(); name != "" {
+			return name
+		}
+	case *unaryExpr:
+		sym := e.symbol()
+		if isWord(sym) {
+			sym = sym + " "
+		}
+		return sym + formatOperand(e.arg)
+	case *binaryExpr:
+		sym := e.symbol()
+		if e.op == comma {
+			sym = sym + " "
+		}
+		return formatOperand(e.a) + sym + formatOperand(e.b)
+	case *ternaryExpr:
+		return formatOperand(e.cond) + " ? " + formatOperand(e.a) + " : " + formatOperand(e.b)
+	case *FuncContext:
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = Format(arg)
+		}
+		return e.name + "(" + strings.Join(args, ", ") + ")"
+	}
+	// Unnamed variables and custom expressions are replaced with their values
+	return FormatNum(e.Eval(), -1)
+}
+
+func formatOperand(e Expr) string {
+	switch e := e.(type) {
+	case *constExpr:
+		if e.value < 0 {
+			return "(" + Format(e) + ")"
+		}
+	case *unaryExpr, *binaryExpr, *ternaryExpr:
+		return "(" + Format(e) + ")"
+	}
+	return Format(e)
+}
+
+// FormatMinimal returns the expression in the infix syntax accepted by Parse
+// like Format does, but only puts operands in parentheses where precedence
+// and associativity of the operators require it, so "(a+b)*c" keeps its
+// parentheses, but "(a+b)+c" becomes "a+b+c" and "a+(b+c)" is left as is.
+func FormatMinimal(e Expr) string {
+	switch e := e.(type) {
+	case *unaryExpr:
+		sym := e.symbol()
+		arg := formatMinimalOperand(e.arg, e.precedence(), true)
+		if isWord(sym) || isUnaryOperand(e.arg) {
+			sym = sym + " "
+		}
+		return sym + arg
+	case *binaryExpr:
+		sym := e.symbol()
+		if e.op == comma {
+			sym = sym + " "
+		}
+		prec, left := e.precedence(), e.isLeftAssoc()
+		a := formatMinimalOperand(e.a, prec, left)
+		b := formatMinimalOperand(e.b, prec, !left)
+		if isUnaryOperand(e.b) {
+			b = " " + FormatMinimal(e.b)
+		}
+		return a + sym + b
+	case *ternaryExpr:
+		prec := precedence(conditional)
+		return formatMinimalOperand(e.cond, prec, false) + " ? " +
+			formatMinimalOperand(e.a, prec, true) + " : " +
+			formatMinimalOperand(e.b, prec, true)
+	case *FuncContext:
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = formatMinimalOperand(arg, precedence(comma), false)
+		}
+		return e.name + "(" + strings.Join(args, ", ") + ")"
+	}
+	return Format(e)
+}
+
+// Formats operand of an operator with the given precedence level, operand of
+// the same level is put in parentheses unless same is true
+func formatMinimalOperand(e Expr, prec int, same bool) string {
+	s := FormatMinimal(e)
+	if p := operandPrecedence(e); p > prec || (p == prec && !same) {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// Returns the precedence level of the operand, 0 for operands that are never
+// put in parentheses
+func operandPrecedence(e Expr) int {
+	switch e := e.(type) {
+	case *constExpr:
+		if e.value < 0 {
+			return precedence(unaryMinus)
+		}
+	case *unaryExpr:
+		return e.precedence()
+	case *binaryExpr:
+		return e.precedence()
+	case *ternaryExpr:
+		return precedence(conditional)
+	}
+	return 0
+}
+
+// Unary operators on the right of a binary operator, like in "2** -x", bind
+// to their operand regardless of the binary operator precedence. They are
+// separated from the binary operator, so that "a- -b" is not read as "a--b".
+func isUnaryOperand(e Expr) bool {
+	switch e := e.(type) {
+	case *constExpr:
+		return e.value < 0
+	case *unaryExpr:
+		return true
+	}
+	return false
+}
+
+// FormatNum returns the number in the syntax accepted by Parse, with at most
+// prec digits after the decimal point and without trailing zeros. Negative
+// prec means the smallest number of digits that represent the number
+// exactly. Integers have no decimal point, numbers with magnitude of 1e21 and
+// above, or below 1e-6 for negative prec, are formatted with an exponent,
+// like "1e+21". Infinities and NaN are the constants "inf", "-inf" and "nan".
+func FormatNum(n Num, prec int) string {
+	abs := math.Abs(float64(n))
+	if math.IsNaN(abs) {
+		return "nan"
+	} else if math.IsInf(float64(n), 1) {
+		return "inf"
+	} else if math.IsInf(float64(n), -1) {
+		return "-inf"
+	} else if abs >= 1e21 || (prec < 0 && abs != 0 && abs < 1e-6) {
+		s := strconv.FormatFloat(float64(n), 'e', prec, 64)
+		i := strings.IndexByte(s, 'e')
+		return trimZeros(s[:i]) + s[i:]
+	}
+	return trimZeros(strconv.FormatFloat(float64(n), 'f', prec, 64))
+}
+
+// FormatResult returns the number in the given base, 2, 8, 10 or 16, with
+// the prefix accepted by Parse, like "0xff" or "-0b101". Base 10 is the same
+// as FormatNum with negative prec, other bases only accept integers that fit
+// in 64 bits and return ErrNotInteger otherwise.
+func FormatResult(n Num, base int) (string, error) {
+	prefix := ""
+	switch base {
+	case 10:
+		return FormatNum(n, -1), nil
+	case 2:
+		prefix = "0b"
+	case 8:
+		prefix = "0o"
+	case 16:
+		prefix = "0x"
+	default:
+		return "", ErrBadBase
+	}
+	if n != Num(math.Trunc(float64(n))) || n >= math.MaxInt64 || n < math.MinInt64 {
+		return "", ErrNotInteger
+	}
+	i, sign := int64(n), ""
+	if i < 0 {
+		sign = "-"
+	}
+	// Magnitude of math.MinInt64 only fits in uint64
+	mag := uint64(i)
+	if i < 0 {
+		mag = -mag
+	}
+	return sign + prefix + strconv.FormatUint(mag, base), nil
+}
+
+// Removes trailing zeros after the decimal point
+func trimZeros(s string) string {
+	if strings.IndexByte(s, '.') < 0 {
+		return s
+	}
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
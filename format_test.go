@@ -0,0 +1,220 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	funcs := map[string]Func{
+		"plusone": func(c *FuncContext) Num {
+			return c.Args[0].Eval() + 1
+		},
+		"nop": func(c *FuncContext) Num {
+			return 0
+		},
+	}
+	for input, s := range map[string]string{
+		"":                     "0",
+		"2.5":                  "2.5",
+		"1e21":                 "1e+21",
+		"x":                    "x",
+		"-2+plusone(x)":        "(-2)+plusone(x)",
+		"2+3*4":                "2+(3*4)",
+		"(2+3)*4":              "(2+3)*4",
+		"(2+3)×4÷x":            "((2+3)*4)/x",
+		"2-3-4":                "(2-3)-4",
+		"2-(3-4)":              "2-(3-4)",
+		"2**3**2":              "2**(3**2)",
+		"-2**2":                "-(2**2)",
+		"!x || x && y":         "(!x)||(x&&y)",
+		"x = y = 2":            "x=(y=2)",
+		"x=1, y=2, x+y":        "(x=1), ((y=2), (x+y))",
+		"x ? 1 : y ? 2 : 3":    "x ? 1 : (y ? 2 : 3)",
+		"plusone(1, 2+3)":      "plusone(1, 2+3)",
+		"nop()":                "nop()",
+		"plusone(-x)%%3 << 1":  "(plusone(-x)%%3)<<1",
+		"1 < 2 == 3 >= 4 != 5": "((1<2)==(3>=4))!=5",
+	} {
+		if e, err := Parse(input, map[string]Var{}, funcs); err != nil {
+			t.Error(input, err)
+		} else if f := Format(e); f != s {
+			t.Error(input, f, s)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	funcs := Builtins()
+	for _, input := range []string{
+		"-2+max(x, 1)",
+		"2+3*4-5/6%7%%8",
+		"-(2+3)*4**-x",
+		"1<<2>>3&4^5|6",
+		"!x&&y||^z",
+		"x=y=z=-1, x+y+z",
+		"a ? b ? 1 : 2 : c ? 3 : 4",
+		"min(x, -y, (1, 2)) + sqrt(x*x)",
+		"1e-7 + 0.1 + 123456789012",
+	} {
+		env := map[string]Var{}
+		e1, err := Parse(input, env, funcs)
+		if err != nil {
+			t.Error(input, err)
+			continue
+		}
+		for _, format := range []func(Expr) string{Format, FormatMinimal} {
+			e2, err := Parse(format(e1), env, funcs)
+			if err != nil {
+				t.Error(input, format(e1), err)
+			} else if s1, s2 := fmt.Sprint(e1), fmt.Sprint(e2); s1 != s2 {
+				t.Error(input, format(e1), s1, s2)
+			}
+		}
+	}
+}
+
+func TestFormatMinimal(t *testing.T) {
+	funcs := Builtins()
+	for input, s := range map[string]string{
+		"(a+b)*c":                "(a+b)*c",
+		"(a+b)+c":                "a+b+c",
+		"a+(b+c)":                "a+(b+c)",
+		"a+b*c":                  "a+b*c",
+		"(a*b)+(c/d)":            "a*b+c/d",
+		"a-(b-c)":                "a-(b-c)",
+		"(2**3)**2":              "(2**3)**2",
+		"2**(3**2)":              "2**3**2",
+		"-(2**2)":                "-2**2",
+		"(-2)**2":                "(-2)**2",
+		"(-x)**2":                "(-x)**2",
+		"2**(-x)":                "2** -x",
+		"a*(-b)":                 "a* -b",
+		"a-(-b)":                 "a- -b",
+		"-(-a)":                  "- -a",
+		"-(a+b)":                 "-(a+b)",
+		"(!x) || (x && y)":       "!x||x&&y",
+		"(x || y) && z":          "(x||y)&&z",
+		"x = (y = 2)":            "x=y=2",
+		"(x=1), ((y=2), (x+y))":  "x=1, y=2, x+y",
+		"((x=1), (y=2)), (x+y)":  "(x=1, y=2), x+y",
+		"x ? 1 : (y ? 2 : 3)":    "x ? 1 : y ? 2 : 3",
+		"(x ? 1 : y) ? 2 : 3":    "(x ? 1 : y) ? 2 : 3",
+		"x ? (y = 1) : 2":        "x ? (y=1) : 2",
+		"(a ? b : c) + 1":        "(a ? b : c)+1",
+		"max(a, (1, 2), b+c)":    "max(a, (1, 2), b+c)",
+		"(1 < 2) == (3 >= 4)":    "1<2==3>=4",
+		"((a << 1) & b) | c ^ d": "a<<1&b|c^d",
+	} {
+		e, err := Parse(input, map[string]Var{}, funcs)
+		if err != nil {
+			t.Error(input, err)
+			continue
+		}
+		if f := FormatMinimal(e); f != s {
+			t.Error(input, f, s)
+		}
+		// Parsing formatted expression results in the same tree
+		if e2, err := Parse(FormatMinimal(e), map[string]Var{}, funcs); err != nil {
+			t.Error(input, err)
+		} else if s1, s2 := fmt.Sprint(e), fmt.Sprint(e2); s1 != s2 {
+			t.Error(input, s1, s2)
+		}
+	}
+}
+
+func TestFormatNum(t *testing.T) {
+	tenth, fifth := Num(0.1), Num(0.2)
+	for _, test := range []struct {
+		n    Num
+		prec int
+		s    string
+	}{
+		{5, -1, "5"},
+		{5, 3, "5"},
+		{-42, 0, "-42"},
+		{1234567, -1, "1234567"},
+		{0.5, -1, "0.5"},
+		{0.5, 3, "0.5"},
+		{1.0 / 3, -1, "0.3333333333333333"},
+		{1.0 / 3, 3, "0.333"},
+		{2.0 / 3, 2, "0.67"},
+		{2.0 / 3, 0, "1"},
+		{-1.25, 1, "-1.2"},
+		{tenth + fifth, -1, "0.30000000000000004"},
+		{tenth + fifth, 10, "0.3"},
+		{1e20, -1, "100000000000000000000"},
+		{1e21, -1, "1e+21"},
+		{1.5e300, 3, "1.5e+300"},
+		{-2.25e22, 1, "-2.2e+22"},
+		{1e-6, -1, "0.000001"},
+		{1.5e-7, -1, "1.5e-07"},
+		{1.5e-7, 3, "0"},
+		{0, -1, "0"},
+		{Num(math.Copysign(0, -1)), -1, "-0"},
+		{Num(math.Inf(1)), 2, "inf"},
+		{Num(math.Inf(-1)), -1, "-inf"},
+		{Num(math.NaN()), -1, "nan"},
+	} {
+		if s := FormatNum(test.n, test.prec); s != test.s {
+			t.Error(test.n, test.prec, s, test.s)
+		}
+	}
+	// Round trip
+	for _, n := range []Num{5, -1.5, 1.0 / 3, 1e21, 1.5e-7, 123.456e-10, math.MaxFloat64,
+		Num(math.Inf(1)), Num(math.Inf(-1))} {
+		if e, err := Parse(FormatNum(n, -1), map[string]Var{}, map[string]Func{}); err != nil {
+			t.Error(n, err)
+		} else if e.Eval() != n {
+			t.Error(n, FormatNum(n, -1), e.Eval())
+		}
+	}
+	vars := map[string]Var{}
+	if e, err := Parse(FormatNum(Num(math.NaN()), -1), vars, map[string]Func{}); err != nil {
+		t.Error(err)
+	} else if n := e.Eval(); !math.IsNaN(float64(n)) || len(vars) != 0 {
+		t.Error(n, vars)
+	}
+}
+
+func TestFormatResult(t *testing.T) {
+	for _, test := range []struct {
+		n    Num
+		base int
+		s    string
+	}{
+		{255, 16, "0xff"},
+		{255, 2, "0b11111111"},
+		{8, 8, "0o10"},
+		{0, 16, "0x0"},
+		{-5, 2, "-0b101"},
+		{1.5, 10, "1.5"},
+		{-4096, 10, "-4096"},
+		{math.MinInt64, 16, "-0x8000000000000000"},
+		{1 << 62, 16, "0x4000000000000000"},
+	} {
+		if s, err := FormatResult(test.n, test.base); err != nil || s != test.s {
+			t.Error(test.n, test.base, s, err)
+		} else if e, err := Parse(s, map[string]Var{}, map[string]Func{}); err != nil || e.Eval() != test.n {
+			t.Error(s, err)
+		}
+	}
+	for _, test := range []struct {
+		n    Num
+		base int
+		err  error
+	}{
+		{0.5, 2, ErrNotInteger},
+		{-2.25, 16, ErrNotInteger},
+		{Num(math.NaN()), 8, ErrNotInteger},
+		{Num(math.Inf(1)), 16, ErrNotInteger},
+		{1e19, 16, ErrNotInteger},
+		{10, 3, ErrBadBase},
+		{10, 0, ErrBadBase},
+	} {
+		if s, err := FormatResult(test.n, test.base); err != test.err {
+			t.Error(test.n, test.base, s, err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+//go:build go1.18
+// +build go1.18
+
+package expr
+
+import (
+	"errors"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	for _, s := range []string{
+		"", "2+3*4", "x=2+3*(x/(42+plusone(x))),x", "-2**-2", "!x && (y || 0x1F)",
+		"a ? b : c ? d : e", "x += y -= 2, x //= 3", "max(1, plusone(2), 3) % 2 %% 3",
+		"1 << 70 >> -3 & ~5 ^ 6 | 7", "pi * e / tau - inf + nan", "max() + min(1)",
+		"if(x, 1, 2) + clamp(x, 0, 1)", `"str"`, "1 /* c */ + 2 # c", "1_000.5e-3 + 0b101",
+		"(", ")", "1 +", "x(2)", "2=3", "1 ? 2", "f()()", "2 @ 3", "1__0", "/* x",
+		"((((1))))", "x, y, z = 1", "-(-(-1))", "--x", "π+-",
+	} {
+		f.Add(s)
+	}
+	funcs := Builtins()
+	// Nested loops may take too long to complete
+	delete(funcs, "while")
+	funcs["plusone"] = func(c *FuncContext) Num { return c.Arg(0) + 1 }
+	f.Fuzz(func(t *testing.T, input string) {
+		e, err := Parse(input, map[string]Var{}, funcs)
+		if err != nil {
+			var pe *ParseError
+			if !errors.As(err, &pe) && !errors.Is(err, ErrBadArity) {
+				t.Errorf("%q: %v", input, err)
+			}
+			return
+		}
+		e.Eval()
+		EvalErr(e)
+		Compile(e)()
+		Format(e)
+	})
+}
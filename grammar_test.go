@@ -1,17 +1,27 @@
 package expr
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestTokenize(t *testing.T) {
 	// Let's preter there is no "&" operator, but there is "&&"
-	defer func() {
-		ops["&"] = bitwiseAnd
-	}()
-	delete(ops, "&")
+	without := map[string]arithOp{}
+	for sym, op := range ops {
+		if sym != "&" {
+			without[sym] = op
+		}
+	}
+	table := newOpTable(without)
 
 	for s, parts := range map[string][]string{
 		"2":         {"2"},
@@ -27,11 +37,36 @@ func TestTokenize(t *testing.T) {
 		"1>>-2":     {"1", ">>", "-u", "2"},
 		"1>>!2":     {"1", ">>", "!u", "2"},
 		"1>>^!2":    {"1", ">>", "^u", "!u", "2"},
+		"0xFF+0b1":  {"0xFF", "+", "0b1"},
+		"1e3-e2":    {"1e3", "-", "e2"},
+		"1e-3":      {"1e-3"},
+		"0x1e-3":    {"0x1e", "-", "3"},
+		"9%%4":      {"9", "%%", "4"},
+		"9%-4":      {"9", "%", "-u", "4"},
+		"x+=-1":     {"x", "+=", "-u", "1"},
+		"x/=2":      {"x", "/=", "2"},
 		"1&&2":      {"1", "&&", "2"},
+		"1^^2":      {"1", "^^", "2"},
+		"7//2":      {"7", "//", "2"},
+		"7//-2":     {"7", "//", "-u", "2"},
+		"7///*c*/2": {"7", "//", "2"},
+		"1^^^2":     {"1", "^^", "^u", "2"},
+		"1^ ^2":     {"1", "^", "^u", "2"},
+		"^^2":       {"^u", "^u", "2"},
+		"1<2":       {"1", "<", "2"},
+		"1<=2":      {"1", "<=", "2"},
+		"1<=>2":     {"1", "<=>", "2"},
+		"1<=>-2":    {"1", "<=>", "-u", "2"},
+		"1<?2>?3":   {"1", "<?", "2", ">?", "3"},
+		"6÷θ×-2":    {"6", "÷", "θ", "×", "-u", "2"},
+		"1<-2>=3":   {"1", "<", "-u", "2", ">=", "3"},
+		"x>?-y":     {"x", ">?", "-u", "y"},
+		"1<=-2":     {"1", "<=", "-u", "2"},
+		"1<<=2":     nil,
 		"1&&":       {"1", "&&"},
 		"1&&&":      nil, // This should return an error: 'no such operator &'
 	} {
-		if tokens, err := tokenize([]rune(s)); err != nil {
+		if tokens, err := tokenize([]rune(s), table); err != nil {
 			if parts != nil {
 				t.Error(err, s)
 			}
@@ -39,7 +74,7 @@ func TestTokenize(t *testing.T) {
 			t.Error(tokens, parts)
 		} else {
 			for i, tok := range tokens {
-				if tok != parts[i] {
+				if tok.text != parts[i] {
 					t.Error(tokens, parts)
 					break
 				}
@@ -86,6 +121,89 @@ func TestParse(t *testing.T) {
 
 		"4*(2+8)+4/2": 42,
 
+		"9%%4":    1,
+		"-9%%4":   -1,
+		"9%%-4":   1,
+		"7%%4*2":  6,
+		"1+7%%4":  4,
+		"9%%0":    0,
+		"9%%x-10": -6,
+
+		"2**3**2":    512,
+		"(2**3)**2":  64,
+		"2**3*2":     16,
+		"2*3**2":     18,
+		"-2**2":      -4,
+		"(-2)**2":    4,
+		"2**-1":      0.5,
+		"2**-1**2":   0.5,
+		"-2**-2":     -0.25,
+		"--2**2":     4,
+		"!0**2":      1,
+		"^1**2":      -2,
+		"-x**2":      -25,
+		"2**-x*2":    0.0625,
+		"-2**2+1":    -3,
+		"4**2**-1":   2,
+		"16**0.5**2": 2,
+		"-(2)**2":    -4,
+		"-3*-2**2":   12,
+		"x**2-x**2":  0,
+		"2**3==8":    1,
+		"-2**2==-4":  1,
+		"y=-2**2, y": -4,
+
+		"2 + 3 # ignored":                 5,
+		"# nothing":                       0,
+		"2 #+ 3\n+ 4":                     6,
+		"y = 2, # first\n y * 3 # second": 6,
+		"2 /* three */ + 3":               5,
+		"2 + /* three */ 3":               5,
+		"2 /**/ * 3":                      6,
+		"2 /* multi\n line */ * 3":        6,
+		"2 /* ** */ ** 3 /* # */ + 1":     9,
+		"2/3 /* / */":                     2 / 3.0,
+		"/* π */ 1 # π":                   1,
+		"2 */* 3 */ 3":                    6,
+
+		"y=5, y+=3":           8,
+		"y=5, y+=3, y":        8,
+		"y=5, y-=3, y":        2,
+		"y=5, y*=3, y":        15,
+		"y=5, y/=2, y":        2.5,
+		"y=5, y/=0, y":        0,
+		"y=5, y+=-3":          2,
+		"y=5, y*=1+2":         15,
+		"y=z=2, y+=z+=3, y*z": 35,
+		"y=2, (y+=1)*2":       6,
+		"y=1, y+=y+=1":        3,
+
+		"pi*2":          2 * math.Pi,
+		"e":             math.E,
+		"pi":            math.Pi,
+		"pie=1, pie+pi": 1 + math.Pi,
+		"-pi**2":        -math.Pi * math.Pi,
+		"tau/pi":        2,
+		"1 <=> 2 == -1": 1,
+		"3 <=> 2 + 2":   -1,
+		"2*2 <=> 3":     1,
+		"3 <? 5 == 3":   1,
+		"6 ÷ 2 == 3":    1,
+		"3 × 4 == 12":   1,
+		"1 + 3 × 4 ÷ 2": 7,
+		"θ = pi/2, 2×θ": 3.141592653589793,
+		"θ=1, φ=2, θ÷φ": 0.5,
+		"3 >? 5 == 5":   1,
+		"3 >? 5 <? 4":   4,
+		"-1 <? 2*-3":    -6,
+		"1 < 2 >? 0":    1,
+		"-inf < -1e308": 1,
+		"nan != nan":    1,
+
+		"nop()*2+1":             1,
+		"nop(nop())":            0,
+		"add3(nop(), nop(), x)": 5,
+
 		"2, 3, 5":  5,
 		"2+3, 5*3": 15,
 
@@ -98,8 +216,65 @@ func TestParse(t *testing.T) {
 		"nop()":    0,
 		"nop(1)":   0,
 		"nop((1))": 0,
+		"2+nop()":  2,
 
 		"w=(w!=0)": 0,
+
+		"0xFF":            255,
+		"0XfF":            255,
+		"0o17":            15,
+		"0b1010":          10,
+		"0xFF == 255":     1,
+		"0b1010 | 0b0101": 15,
+		"0x10+0x10":       32,
+		"-0x10":           -16,
+		"010":             10,
+		"0":               0,
+		"0.5":             0.5,
+
+		"1e3":          1000,
+		"1e3 == 1000":  1,
+		"2.5e-1":       0.25,
+		"2.5E+1":       25,
+		"1e0":          1,
+		"6.022e23":     6.022e23,
+		"1e3-1":        999,
+		"1e-3*1e3":     1,
+		"e2=3, e2*1e1": 30,
+
+		"1_000_000":    1000000,
+		"1_0.2_5":      10.25,
+		"1_0e1_0":      1e11,
+		"0xFF_FF":      0xffff,
+		"0b1010_0101":  0xa5,
+		"0x_1":         1,
+		"0x1_e":        0x1e,
+		"2_000 + 0x_1": 2001,
+
+		"x>0 ? x : -x":          5,
+		"x<0 ? x : -x":          -5,
+		"1 ? 2 : 3 ? 4 : 5":     2,
+		"0 ? 2 : 3 ? 4 : 5":     4,
+		"0 ? 2 : 0 ? 4 : 5":     5,
+		"1 ? 0 ? 2 : 3 : 4":     3,
+		"0 ? 0 ? 2 : 3 : 4":     4,
+		"v = x ? 2 : 3, v":      2,
+		"(x ? 2 : 3) + 1":       3,
+		"2 + (x ? 1 : 0) * 3":   5,
+		"add3(1, 0 ? 2 : 3, 4)": 8,
+		"x==5 && 1 ? x+1 : x-1": 6,
+		"x==5 || 1 ? x+1 : x-1": 6,
+
+		"0 ^^ 0":            0,
+		"0 ^^ 2":            1,
+		"2 ^^ 0":            1,
+		"2 ^^ 3":            0,
+		"1 ^^ 1 ^^ 1":       1,
+		"1 ^^ 0 && 0":       1,
+		"1 || 1 ^^ 1":       1,
+		"6 ^^ ^6":           0,
+		"(y=1) ^^ (y=2), y": 2,
+		"0 ^^ 2 ? 7 : 8":    7,
 	} {
 		if e, err := Parse(input, env, funcs); err != nil {
 			t.Error(input, e, input, err)
@@ -109,6 +284,58 @@ func TestParse(t *testing.T) {
 	}
 }
 
+// Operators of the same precedence level, like "+" and "-", are applied left
+// to right. Before "%%" was added each operator had its own level, so "2-3+4"
+// was -5 and "2/4*4" was 0.125.
+func TestSameLevelOperators(t *testing.T) {
+	for input, res := range map[string]Num{
+		"2-3+4":       3,
+		"2+3-4":       1,
+		"8-2-1":       5,
+		"2/4*4":       2,
+		"8/2/2":       2,
+		"8*2/4":       4,
+		"7%4*2":       -2,
+		"7%%4*2":      6,
+		"1<2==1":      1,
+		"2 == 2 != 0": 1,
+		"1 << 2 >> 1": 2,
+	} {
+		if e, err := Parse(input, map[string]Var{}, map[string]Func{}); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != res {
+			t.Error(input, n, res)
+		}
+	}
+}
+
+func TestParseTernary(t *testing.T) {
+	calls := map[string]int{}
+	funcs := map[string]Func{
+		"a": func(c *FuncContext) Num {
+			calls["a"]++
+			return 1
+		},
+		"b": func(c *FuncContext) Num {
+			calls["b"]++
+			return 2
+		},
+	}
+	for input, result := range map[string]Num{
+		"1 ? a() : b()": 1,
+		"0 ? a() : b()": 2,
+	} {
+		calls = map[string]int{}
+		if e, err := Parse(input, map[string]Var{}, funcs); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != result {
+			t.Error(input, e, n, result)
+		} else if len(calls) != 1 {
+			t.Error(input, calls)
+		}
+	}
+}
+
 func TestParseFuzz(t *testing.T) {
 	if testing.Short() {
 		t.Skip("fuzzing test skipped")
@@ -136,6 +363,35 @@ func TestParseFuzz(t *testing.T) {
 	}
 }
 
+func TestNoPanic(t *testing.T) {
+	// Function names that are in funcs but have no function are not calls
+	funcs := map[string]Func{"f": nil, "g": func(c *FuncContext) Num { return 1 }}
+	for _, input := range []string{"f(1)", "f", "g(f(2))", "x = f()"} {
+		if _, err := Parse(input, map[string]Var{}, funcs); !errors.Is(err, ErrBadCall) {
+			t.Error(input, err)
+		}
+	}
+	if _, err := ParseWithSpecs("f(1)", map[string]Var{}, map[string]FuncSpec{"f": {MaxArgs: -1}}); !errors.Is(err, ErrBadCall) {
+		t.Error(err)
+	}
+	if _, err := Unmarshal([]byte(`{"type":"call","name":"f"}`), map[string]Var{}, funcs); err != ErrBadCall {
+		t.Error(err)
+	}
+
+	// Malformed trees evaluate to something instead of panicking
+	for _, e := range []Expr{
+		&binaryExpr{op: assign, a: &constExpr{1}, b: &constExpr{2}},
+		&binaryExpr{op: conditional, a: &constExpr{1}, b: &constExpr{2}},
+		&binaryExpr{op: arithOp(1000), a: &constExpr{1}, b: &constExpr{2}},
+		&unaryExpr{op: arithOp(1000), arg: &constExpr{1}},
+		&unaryExpr{op: power, arg: &constExpr{1}},
+	} {
+		e.Eval()
+		EvalErr(e)
+		Compile(e)()
+	}
+}
+
 func TestParseError(t *testing.T) {
 	env := map[string]Var{}
 	funcs := map[string]Func{
@@ -179,8 +435,60 @@ func TestParseError(t *testing.T) {
 
 		"+,":        ErrOperandMissing,
 		"xfx((f1))": ErrBadCall,
+
+		"0x":     ErrBadNumber,
+		"0xFG":   ErrBadNumber,
+		"0o8":    ErrBadNumber,
+		"0b102":  ErrBadNumber,
+		"1.2.3":  ErrBadNumber,
+		"0x1 x":  ErrUnexpectedIdentifier,
+		"0b1 0b": ErrUnexpectedNumber,
+		"1e3x":   ErrUnexpectedIdentifier,
+		"2e":     ErrUnexpectedIdentifier,
+		"2e-":    ErrUnexpectedIdentifier,
+		"_1":     ErrOperandMissing,
+		"1_":     ErrBadNumber,
+		"1__2":   ErrBadNumber,
+		"1_.2":   ErrBadNumber,
+		"1._2":   ErrBadNumber,
+		"1e_2":   ErrUnexpectedIdentifier,
+		"1E_2":   ErrUnexpectedIdentifier,
+		"1_e2":   ErrBadNumber,
+		"1_E2":   ErrBadNumber,
+		"1.5_e2": ErrBadNumber,
+		"0xF_":   ErrBadNumber,
+
+		"2 + 3 /* ignored": ErrComment,
+		"2 /* */ + 3 /*/":  ErrComment,
+		"2 + # 3":          ErrOperandMissing,
+
+		"2+=3":    ErrBadVar,
+		"(1)-=1":  ErrBadVar,
+		"x+1*=2":  ErrBadVar,
+		"+=1":     ErrOperandMissing,
+		"x*=":     ErrOperandMissing,
+		"x **= 2": ErrOperandMissing,
+
+		"pi=3":     ErrBadVar,
+		"e+=1":     ErrBadVar,
+		"x=pi=3":   ErrBadVar,
+		"tau=1":    ErrBadVar,
+		"inf-=1":   ErrBadVar,
+		"f()()":    ErrParen,
+		"f+f()":    ErrBadCall,
+		"(f)()":    ErrParen,
+		"f(x) /=2": ErrBadVar,
+		"1_ + 2":   ErrBadNumber,
+		"0x1e-":    ErrOperandMissing,
+
+		"1?2":     ErrTernary,
+		"1:2":     ErrTernary,
+		"(1?2):3": ErrTernary,
+		"1?2,3:4": ErrTernary,
+		"1?:2":    ErrOperandMissing,
+		"?1:2":    ErrOperandMissing,
 	} {
-		if expr, err := Parse(input, env, funcs); err != e {
+		if expr, err := Parse(input, env, funcs); !errors.Is(err, e) {
 			t.Error(e, err, expr, input)
 		}
 	}
@@ -197,7 +505,1444 @@ func TestExprString(t *testing.T) {
 	}
 	if e, err := Parse("-2+plusone(x)", env, funcs); err != nil {
 		t.Error(err)
-	} else if s := fmt.Sprintf("%v", e); s != "<8>(<1>(#2), fn[{5}])" {
+	} else if s := fmt.Sprintf("%v", e); s != "<10>(<1>(#2), fn[{x=5}])" {
 		t.Error(e, s)
 	}
 }
+
+func TestEvalErr(t *testing.T) {
+	env := map[string]Var{"x": NewVar(0)}
+	funcs := Builtins()
+	for input, e := range map[string]error{
+		"1/2":            nil,
+		"1/0":            ErrDivisionByZero,
+		"1%0":            ErrDivisionByZero,
+		"1%%0":           ErrDivisionByZero,
+		"1//0":           ErrDivisionByZero,
+		"1/x":            ErrDivisionByZero,
+		"2+3*(4/x)":      ErrDivisionByZero,
+		"x ? 1/x : 1":    nil,
+		"!x ? 1/x : 1":   ErrDivisionByZero,
+		"x && 1/x":       nil,
+		"sqrt(1/x)":      ErrDivisionByZero,
+		"max(1, 2, 3/x)": ErrDivisionByZero,
+		"1/x, 2":         ErrDivisionByZero,
+	} {
+		if expr, err := Parse(input, env, funcs); err != nil {
+			t.Error(input, err)
+		} else if n, err := EvalErr(expr); err != e {
+			t.Error(input, err, e)
+		} else if n != expr.Eval() {
+			t.Error(input, n, expr.Eval())
+		}
+	}
+}
+
+func TestOddRoots(t *testing.T) {
+	nan := Num(math.NaN())
+	for _, test := range []struct {
+		mode  bool
+		input string
+		n     Num
+	}{
+		{false, "(-8)**(1/3)", nan},
+		{false, "(-8)**0.5", nan},
+		{false, "(-8)**2", 64},
+		{false, "(-8)**-1", -0.125},
+		{false, "8**(1/3)", 2},
+		{false, "pow(-8, 1/3)", nan},
+		{true, "(-8)**(1/3)", -2},
+		{true, "(-32)**(1/5)", -2},
+		{true, "(-8)**(-1/3)", -0.5},
+		{true, "(-8)**0.5", nan},
+		{true, "(-16)**0.25", nan},
+		{true, "(-8)**(2/3)", nan},
+		{true, "8**(1/3)", 2},
+		{true, "(-8)**2", 64},
+		{true, "pow(-8, 1/3)", nan},
+		{true, "cbrt(-8)", -2},
+	} {
+		p := &Parser{OddRoots: test.mode}
+		e, err := p.Parse(test.input, map[string]Var{}, Builtins())
+		if err != nil {
+			t.Error(test.input, err)
+			continue
+		}
+		for _, n := range []Num{e.Eval(), Compile(e)()} {
+			if math.Abs(float64(n-test.n)) > 1e-12 || math.IsNaN(float64(n)) != math.IsNaN(float64(test.n)) {
+				t.Error(test.mode, test.input, n, test.n)
+			}
+		}
+	}
+}
+
+func TestDivByZero(t *testing.T) {
+	nan := Num(math.NaN())
+	for _, test := range []struct {
+		mode  DivMode
+		input string
+		n     Num
+		err   error
+	}{
+		{DivZero, "1/0", 0, ErrDivisionByZero},
+		{DivZero, "-1/0", 0, ErrDivisionByZero},
+		{DivZero, "1%0", 0, ErrDivisionByZero},
+		{DivZero, "1%%0", 0, ErrDivisionByZero},
+		{DivZero, "1//0", 0, ErrDivisionByZero},
+		{DivNaN, "-1//0", Num(math.Inf(-1)), nil},
+		{DivNaN, "0//0", nan, nil},
+		{DivError, "1//0", nan, ErrDivisionByZero},
+		{DivNaN, "1/0", Num(math.Inf(1)), nil},
+		{DivNaN, "-1/0", Num(math.Inf(-1)), nil},
+		{DivNaN, "1/-0", Num(math.Inf(-1)), nil},
+		{DivNaN, "0/0", nan, nil},
+		{DivNaN, "1%0", nan, nil},
+		{DivNaN, "1%%0", nan, nil},
+		{DivNaN, "6/2", 3, nil},
+		{DivNaN, "0/0 == 0/0", 0, nil},
+		{DivNaN, "0/0 != 0/0", 1, nil},
+		{DivNaN, "0/0 < 1 || 0/0 >= 1", 0, nil},
+		{DivNaN, "1/0 > 1e308", 1, nil},
+		{DivError, "1/0", nan, ErrDivisionByZero},
+		{DivError, "-1/0", nan, ErrDivisionByZero},
+		{DivError, "1%0", nan, ErrDivisionByZero},
+		{DivError, "1%%0", nan, ErrDivisionByZero},
+		{DivError, "6/2", 3, nil},
+	} {
+		p := &Parser{DivByZero: test.mode}
+		e, err := p.Parse(test.input, map[string]Var{}, map[string]Func{})
+		if err != nil {
+			t.Error(test.input, err)
+			continue
+		}
+		same := func(n Num) bool {
+			return n == test.n || (math.IsNaN(float64(n)) && math.IsNaN(float64(test.n)))
+		}
+		if n, err := EvalErr(e); !same(n) || err != test.err {
+			t.Error(test.mode, test.input, n, err)
+		}
+		if n := e.Eval(); !same(n) {
+			t.Error(test.mode, test.input, n)
+		}
+		if n := Compile(e)(); !same(n) {
+			t.Error(test.mode, test.input, n)
+		}
+	}
+}
+
+func TestParseErrorInput(t *testing.T) {
+	_, err := Parse("1 + (2", map[string]Var{}, map[string]Func{})
+	if !errors.Is(err, ErrParen) {
+		t.Error(err)
+	}
+	if s := err.Error(); s != `expr "1 + (2": parenthesis mismatch at 6` {
+		t.Error(s)
+	}
+	_, err = ParseTyped(`"a" + 1`, map[string]Var{}, map[string]StrVar{}, map[string]Func{})
+	if !errors.Is(err, ErrTypeMismatch) || !strings.Contains(err.Error(), `"\"a\" + 1"`) {
+		t.Error(err)
+	}
+}
+
+func TestParseErrorPos(t *testing.T) {
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			return 0
+		},
+	}
+	for input, e := range map[string]ParseError{
+		"2@3":       {ErrBadOp, 1, "@", 2, 1, 1, 2},
+		"1 + (2":    {ErrParen, 6, "", 6, 4, 1, 7},
+		"(1+2))":    {ErrParen, 5, ")", 6, 5, 1, 6},
+		"1 x":       {ErrUnexpectedIdentifier, 2, "x", 3, 1, 1, 3},
+		"12 34":     {ErrUnexpectedNumber, 3, "3", 4, 1, 1, 4},
+		"1*(+2)":    {ErrOperandMissing, 3, "+", 4, 3, 1, 4},
+		"1 + f + 2": {ErrBadCall, 6, "+", 7, 3, 1, 7},
+		"x, 2=3":    {ErrBadVar, 6, "", 6, 5, 1, 7},
+		"2=3, x":    {ErrBadVar, 3, ",", 4, 3, 1, 4},
+		"-(1?2)":    {ErrTernary, 5, ")", 6, 5, 1, 6},
+		"π+-":       {ErrOperandMissing, 3, "", 3, 3, 1, 4},
+		"1 + 2_":    {ErrBadNumber, 4, "2_", 6, 2, 1, 5},
+		"1 $$ 2":    {ErrBadOp, 2, "$$", 4, 1, 1, 3},
+	} {
+		var pe *ParseError
+		if _, err := Parse(input, map[string]Var{}, funcs); !errors.As(err, &pe) {
+			t.Error(input, err)
+		} else if *pe != e {
+			t.Error(input, *pe, e)
+		}
+	}
+}
+
+func TestParseErrorLine(t *testing.T) {
+	for input, e := range map[string][2]int{
+		"1 $ 2":                     {1, 3},
+		"x = 1,\ny = 2,\nz = $":     {3, 5},
+		"a,\n\n  b +\n\t(c":         {4, 4},
+		"# comment\n/* a\nb */ 1 2": {3, 8},
+		"f(1,\n   2,\n   ω ω)":      {3, 6},
+		"x +\n":                     {2, 1},
+	} {
+		var pe *ParseError
+		if _, err := Parse(input, map[string]Var{}, map[string]Func{"f": nil}); !errors.As(err, &pe) {
+			t.Error(input, err)
+		} else if pe.Line != e[0] || pe.Col != e[1] {
+			t.Error(input, pe.Line, pe.Col, e)
+		}
+	}
+	var pe *ParseError
+	if _, err := Tokenize("1 +\n  2 3"); !errors.As(err, &pe) || pe.Line != 2 || pe.Col != 5 {
+		t.Error(err)
+	} else if s := pe.Error(); s != `unexpected number at 2:5 near "3"` {
+		t.Error(s)
+	}
+}
+
+func TestEvalTrace(t *testing.T) {
+	funcs := map[string]Func{"f": func(c *FuncContext) Num { return c.Arg(0) * 2 }}
+	for input, trace := range map[string]string{
+		"2+3*4":          "2=2 3=3 4=4 3*4=12 2+(3*4)=14",
+		"x=f(1) ? 5 : 6": "1=1 f(1)=2 5=5 f(1) ? 5 : 6=5 x=(f(1) ? 5 : 6)=5",
+		"0 && 1/0":       "0=0 0&&(1/0)=0",
+		"-(1, 2)":        "1=1 2=2 1, 2=2 -(1, 2)=-2",
+	} {
+		e, err := Parse(input, map[string]Var{}, funcs)
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		steps := []string{}
+		n := EvalTrace(e, func(node Expr, result Num) {
+			steps = append(steps, Format(node)+"="+FormatNum(result, -1))
+		})
+		if s := strings.Join(steps, " "); s != trace {
+			t.Error(input, s)
+		}
+		if n != e.Eval() {
+			t.Error(input, n)
+		}
+	}
+}
+
+func TestEvalWith(t *testing.T) {
+	vars := map[string]Var{"x": NewVar(1), "y": NewVar(2)}
+	e, err := Parse("x*10 + y + z", vars, map[string]Func{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		overrides map[string]Num
+		n         Num
+	}{
+		{map[string]Num{"x": 3, "y": 4}, 34},
+		{map[string]Num{"x": -1, "y": 0.5}, -9.5},
+		{map[string]Num{"y": 5, "w": 100}, 15},
+		{map[string]Num{"x": 0, "y": 0, "z": 7}, 7},
+		{nil, 12},
+	} {
+		if n := EvalWith(e, test.overrides); n != test.n {
+			t.Error(test.overrides, n, test.n)
+		}
+		if x, y, z := vars["x"].Get(), vars["y"].Get(), vars["z"].Get(); x != 1 || y != 2 || z != 0 {
+			t.Error(x, y, z)
+		}
+	}
+	// Assignments are undone as well
+	e, _ = Parse("x = x + y, x", vars, map[string]Func{})
+	if n := EvalWith(e, map[string]Num{"x": 5, "y": 5}); n != 10 || vars["x"].Get() != 1 {
+		t.Error(n, vars["x"])
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	env := map[string]Var{}
+	funcs := map[string]Func{
+		"loop": func(c *FuncContext) Num {
+			for c.Err() == nil {
+				c.Args[0].Eval()
+			}
+			return 0
+		},
+	}
+	e, err := Parse("x=1, loop(x=x+1), x=-1", env, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if n, err := EvalContext(ctx, e); err != context.DeadlineExceeded || n != 0 {
+		t.Error(n, err)
+	}
+	// Evaluation must stop before the last assignment
+	if x := env["x"].Get(); x < 2 {
+		t.Error(x)
+	}
+
+	if e, err := Parse("1/0, 2+3", env, funcs); err != nil {
+		t.Error(err)
+	} else if n, err := EvalContext(context.Background(), e); err != ErrDivisionByZero || n != 5 {
+		t.Error(n, err)
+	}
+	if n, err := EvalContext(ctx, e); err != context.DeadlineExceeded || n != 0 {
+		t.Error(n, err)
+	}
+}
+
+func TestEvalTimeout(t *testing.T) {
+	defer func(n int) { MaxIterations = n }(MaxIterations)
+	MaxIterations = math.MaxInt32
+	env := map[string]Var{}
+	e, err := Parse("x = 0, while(1, x = x + 1), x = -1", env, Builtins())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if n, err := EvalTimeout(e, 10*time.Millisecond); err != ErrTimeout || n != 0 {
+		t.Error(n, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error(d)
+	}
+
+	for input, test := range map[string]struct {
+		n   Num
+		err error
+	}{
+		"2 + 3":      {5, nil},
+		"1/0, 2 + 3": {5, ErrDivisionByZero},
+		"while(1)":   {0, ErrBadArity},
+	} {
+		e, err := Parse(input, env, Builtins())
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		if n, err := EvalTimeout(e, time.Second); err != test.err || n != test.n {
+			t.Error(input, n, err)
+		}
+	}
+}
+
+func TestParseWithSpecs(t *testing.T) {
+	add := func(c *FuncContext) Num {
+		sum := Num(0)
+		for _, arg := range c.Args {
+			sum = sum + arg.Eval()
+		}
+		return sum
+	}
+	specs := map[string]FuncSpec{
+		"add3": {Fn: add, MinArgs: 3, MaxArgs: 3},
+		"sum":  {Fn: add, MinArgs: 1, MaxArgs: -1},
+		"nop":  {Fn: add, MinArgs: 0, MaxArgs: 0},
+	}
+	for input, e := range map[string]error{
+		"add3(1, 2, 3)":         nil,
+		"add3(1, 2)":            ErrBadArity,
+		"add3(1, 2, 3, 4)":      ErrBadArity,
+		"add3()":                ErrBadArity,
+		"sum(1)":                nil,
+		"sum(1, 2, 3, 4, 5)":    nil,
+		"sum()":                 ErrBadArity,
+		"nop()":                 nil,
+		"nop(1)":                ErrBadArity,
+		"sum(add3(1, 2), 3)":    ErrBadArity,
+		"add3(sum(1, 2), 3, 4)": nil,
+		"nop":                   ErrBadCall,
+	} {
+		if _, err := ParseWithSpecs(input, map[string]Var{}, specs); !errors.Is(err, e) {
+			t.Error(input, err, e)
+		}
+	}
+	var pe *ParseError
+	if _, err := ParseWithSpecs("1 + add3(1, 2) * 2", map[string]Var{}, specs); !errors.As(err, &pe) {
+		t.Error(err)
+	} else if pe.Pos != 13 || pe.Token != ")" {
+		t.Error(pe)
+	}
+	if e, err := ParseWithSpecs("add3(1, 2, 3) + sum(4, 5)", map[string]Var{}, specs); err != nil {
+		t.Error(err)
+	} else if n := e.Eval(); n != 15 {
+		t.Error(n)
+	}
+}
+
+func TestEmptyArgs(t *testing.T) {
+	// Function that doesn't check the number of its arguments
+	first := func(c *FuncContext) Num { return c.Args[0].Eval() }
+	specs := map[string]FuncSpec{"first": {Fn: first, MinArgs: 1, MaxArgs: 1}}
+	for _, input := range []string{"first()", "first( )", "first(/* x */)", "1 + first()"} {
+		if _, err := ParseWithSpecs(input, map[string]Var{}, specs); !errors.Is(err, ErrBadArity) {
+			t.Error(input, err)
+		}
+	}
+
+	// Builtins report the wrong number of arguments when evaluated
+	funcs := Builtins()
+	funcs["arg"] = func(c *FuncContext) Num { return c.Arg(0) + Num(c.NArgs()) }
+	for input, res := range map[string]Num{
+		"sqrt()":     0,
+		"pow(2)":     0,
+		"clamp()":    0,
+		"arg()":      0,
+		"arg(2)":     3,
+		"1 + sqrt()": 1,
+	} {
+		e, err := Parse(input, map[string]Var{}, funcs)
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		want := ErrBadArity
+		if strings.HasPrefix(input, "arg") {
+			want = nil
+		}
+		if n, err := EvalErr(e); n != res || err != want {
+			t.Error(input, n, err)
+		}
+		if n := Compile(e)(); n != res {
+			t.Error(input, n)
+		}
+	}
+}
+
+func TestParsePure(t *testing.T) {
+	calls := 0
+	specs := map[string]FuncSpec{
+		"sq":  {Fn: func(c *FuncContext) Num { x := c.Arg(0); return x * x }, MinArgs: 1, MaxArgs: 1, Pure: true},
+		"inc": {Fn: func(c *FuncContext) Num { calls++; return Num(calls) }, MaxArgs: -1},
+	}
+	for input, e := range map[string]error{
+		"2+3":              nil,
+		"x == 5":           nil,
+		"sq(x) + sq(2)":    nil,
+		"a ? sq(b) : c, _": nil,
+		"x=5":              ErrSideEffect,
+		"x += 1":           ErrSideEffect,
+		"sq(y = 2)":        ErrSideEffect,
+		"inc()":            ErrSideEffect,
+		"sq(inc(1))":       ErrSideEffect,
+		"sq(1, 2)":         ErrBadArity,
+	} {
+		if _, err := ParsePure(input, map[string]Var{}, specs); !errors.Is(err, e) {
+			t.Error(input, err, e)
+		}
+	}
+	x := NewVar(3)
+	if e, err := ParsePure("sq(x) + 1", map[string]Var{"x": x}, specs); err != nil {
+		t.Error(err)
+	} else if a, b := e.Eval(), e.Eval(); a != 10 || b != 10 || x.Get() != 3 {
+		t.Error(a, b, x)
+	}
+	// Impure functions are still allowed outside of pure mode
+	if _, err := ParseWithSpecs("inc() + (x = 1)", map[string]Var{}, specs); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	vars := map[string]Var{}
+	stmts, err := ParseAll("a=1, b=2", vars, map[string]Func{})
+	if err != nil || len(stmts) != 2 {
+		t.Fatal(stmts, err)
+	}
+	if a, b := stmts[0].Eval(), stmts[1].Eval(); a != 1 || b != 2 || vars["a"].Get() != 1 || vars["b"].Get() != 2 {
+		t.Error(a, b, vars)
+	}
+	stmts, err = ParseAll("x = 3, min(x, 1), (x, 2), _ * 2", vars, Builtins())
+	if err != nil || len(stmts) != 4 {
+		t.Fatal(stmts, err)
+	}
+	for i, res := range []Num{3, 1, 2, 4} {
+		if stmts[i].Eval() != res {
+			t.Error(i, stmts[i], res)
+		}
+	}
+
+	for input, index := range map[string]int{
+		"1 +":                   0,
+		"a=1, b=":               1,
+		"a=1, f(1, 2), (b, c)(": 2,
+		`1, 2, "x`:              2,
+		"1, 2, /* 3":            2,
+		"1, 2, 3 $ 4":           2,
+	} {
+		var se *StatementError
+		var pe *ParseError
+		if _, err := ParseAll(input, map[string]Var{}, map[string]Func{"f": Builtins()["min"]}); !errors.As(err, &se) || !errors.As(err, &pe) {
+			t.Error(input, err)
+		} else if se.Index != index {
+			t.Error(input, se.Index, index)
+		}
+	}
+	if _, err := ParseAll("a=1, b=", map[string]Var{}, map[string]Func{}); err == nil || err.Error() != `statement 1: expr "a=1, b=": variable expected in assignment at 7` {
+		t.Error(err)
+	}
+}
+
+func TestParseIsolated(t *testing.T) {
+	x := NewVar(5)
+	vars := map[string]Var{"x": x}
+	e1, scope1, err := ParseIsolated("a+b", vars, map[string]Func{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != 1 || vars["x"] != x {
+		t.Error(vars)
+	}
+	if len(scope1) != 2 || scope1["a"] == nil || scope1["b"] == nil {
+		t.Error(scope1)
+	}
+	e2, scope2, err := ParseIsolated("a=x*2, a+a", vars, map[string]Func{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scope2) != 1 || scope2["a"] == scope1["a"] || scope2["x"] != nil {
+		t.Error(scope2)
+	}
+	scope1["a"].Set(1)
+	scope1["b"].Set(2)
+	if n := e1.Eval(); n != 3 {
+		t.Error(n)
+	}
+	if n := e2.Eval(); n != 20 || scope1["a"].Get() != 1 {
+		t.Error(n, scope1["a"].Get())
+	}
+	if len(vars) != 1 {
+		t.Error(vars)
+	}
+	if _, _, err := ParseIsolated("a+", vars, map[string]Func{}); err == nil {
+		t.Error(err)
+	}
+}
+
+func TestParseStrict(t *testing.T) {
+	vars := map[string]Var{}
+	_, err := ParseStrict("foo+1", vars, map[string]Func{})
+	var pe *ParseError
+	if !errors.Is(err, ErrUnknownVar) || !errors.As(err, &pe) || pe.Token != "foo" || pe.Pos != 0 {
+		t.Error(err)
+	}
+	if len(vars) != 0 {
+		t.Error(vars)
+	}
+	if _, err := ParseStrict("x = 1", vars, map[string]Func{}); !errors.Is(err, ErrUnknownVar) {
+		t.Error(err)
+	}
+
+	vars["foo"] = NewVar(2)
+	if e, err := ParseStrict("foo+1", vars, map[string]Func{}); err != nil {
+		t.Error(err)
+	} else if n := e.Eval(); n != 3 {
+		t.Error(n)
+	}
+	if e, err := ParseStrict("sqrt(foo*8) * pi", vars, Builtins()); err != nil {
+		t.Error(err)
+	} else if n := e.Eval(); n != 4*math.Pi {
+		t.Error(n)
+	}
+	if _, err := ParseStrict("sqrt", vars, Builtins()); errors.Is(err, ErrUnknownVar) {
+		t.Error(err)
+	}
+}
+
+func TestAssignBeforeUse(t *testing.T) {
+	p := &Parser{AssignBeforeUse: true}
+	funcs := map[string]Func{"f": func(c *FuncContext) Num { return c.Arg(0) }}
+	for _, input := range []string{
+		"y=1, z=y+1",
+		"x*2",
+		"y = x + 1, y*y",
+		"y = 1, y += 2",
+		"a = b = 3, a + b",
+		"c ? (y = 1) : (y = 2), y",
+		"f(y = 2) + y",
+		"y = 1 < 2 < 3, y",
+		"y = 1, 0 && (y = 2), y",
+	} {
+		vars := map[string]Var{"x": NewVar(1), "c": NewVar(0)}
+		if _, err := p.Parse(input, vars, funcs); err != nil {
+			t.Error(input, err)
+		}
+	}
+	for input, name := range map[string]string{
+		"z=y+1, y=1":              "y",
+		"y = x + y":               "y",
+		"y += 1":                  "y",
+		"c ? (y = 1) : 2, y":      "y",
+		"c && (y = 1), y":         "y",
+		"(y = 1) || (z = 2), y+z": "z",
+		"f(y) + (y = 1)":          "y",
+		"-q":                      "q",
+	} {
+		vars := map[string]Var{"x": NewVar(1), "c": NewVar(0)}
+		var pe *ParseError
+		if _, err := p.Parse(input, vars, funcs); !errors.Is(err, ErrUnassigned) || !errors.As(err, &pe) {
+			t.Error(input, err)
+		} else if pe.Token != name || []rune(input)[pe.Pos] != []rune(name)[0] {
+			t.Error(input, pe)
+		} else if len(vars) != 2 {
+			t.Error(input, vars)
+		}
+	}
+	// Variables that are passed in are always assigned
+	if _, err := p.Parse("y = y + 1", map[string]Var{"y": NewVar(0)}, funcs); err != nil {
+		t.Error(err)
+	}
+	if _, err := Parse("z=y+1, y=1", map[string]Var{}, funcs); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeclaredAssign(t *testing.T) {
+	p := &Parser{DeclaredAssign: true}
+	funcs := map[string]Func{"f": func(c *FuncContext) Num { return c.Arg(0) }}
+	for input, n := range map[string]Num{
+		"z=10":           10,
+		"z += x, z":      4,
+		"z = y = 2, z+y": 4,
+		"x + q":          1,
+		"f(z = 5) + z":   10,
+		"2, _*3":         6,
+	} {
+		vars := map[string]Var{"x": NewVar(1), "y": NewVar(0), "z": NewVar(3)}
+		if e, err := p.Parse(input, vars, funcs); err != nil {
+			t.Error(input, err)
+		} else if res := e.Eval(); res != n {
+			t.Error(input, res, n)
+		}
+	}
+	for input, name := range map[string]string{
+		"w=10":              "w",
+		"w += 1":            "w",
+		"z = w = 2":         "w",
+		"x + q, q = 1":      "q",
+		"f(w = 1) + z":      "w",
+		"x > 0 ? (w=1) : 0": "w",
+	} {
+		vars := map[string]Var{"x": NewVar(1), "y": NewVar(0), "z": NewVar(3)}
+		var pe *ParseError
+		if _, err := p.Parse(input, vars, funcs); !errors.Is(err, ErrUnknownVar) || !errors.As(err, &pe) {
+			t.Error(input, err)
+		} else if pe.Token != name || []rune(input)[pe.Pos] != []rune(name)[0] {
+			t.Error(input, pe)
+		} else if len(vars) != 3 {
+			t.Error(input, vars)
+		}
+	}
+	// Assignment creates the variable by default
+	vars := map[string]Var{}
+	if _, err := Parse("w=10", vars, funcs); err != nil || vars["w"] == nil {
+		t.Error(err, vars)
+	}
+}
+
+func TestEqualEpsilon(t *testing.T) {
+	for _, test := range []struct {
+		eps   Num
+		input string
+		n     Num
+	}{
+		{0, "0.1+0.2 == 0.3", 0},
+		{0, "0.1+0.2 != 0.3", 1},
+		{1e-9, "0.1+0.2 == 0.3", 1},
+		{1e-9, "0.1+0.2 != 0.3", 0},
+		{1e-9, "1 == 1.001", 0},
+		{0.01, "1 == 1.001", 1},
+		{0.01, "1 == 1.02", 0},
+		{1e-9, "2**1024 == 2**1024", 1},
+		{1e-9, "2**1024 == -2**1024", 0},
+		{1e-9, "0.1+0.2 < 0.3", 0},
+		{1e-9, "0.1+0.2 <=> 0.3", 0},
+	} {
+		p := &Parser{EqualEpsilon: test.eps}
+		if e, err := p.Parse(test.input, map[string]Var{}, map[string]Func{}); err != nil {
+			t.Error(test.input, err)
+		} else if n := e.Eval(); n != test.n {
+			t.Error(test.eps, test.input, n)
+		}
+	}
+}
+
+func TestChainComparisons(t *testing.T) {
+	calls := 0
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			calls++
+			return c.Args[0].Eval()
+		},
+	}
+	chained := &Parser{ChainComparisons: true}
+	for input, result := range map[string]Num{
+		"1 < x < 10":          1,
+		"1 < x < 5":           0,
+		"5 < x < 10":          0,
+		"1 < x <= 5":          1,
+		"10 > x >= 5 > 1":     1,
+		"10 > x >= 5 > 6":     0,
+		"1 < x+1 < 7":         1,
+		"1 < f(x) < 10":       1,
+		"1 < f(x) < f(7) < 8": 1,
+		"1 < f(x) < f(7) < 6": 0,
+		"(3 < x) < 1":         0,
+		"3 < (x < 1)":         0,
+		"x < 7 == 1 < 2":      1,
+		"0 < x < 7 ? 2 : 3":   2,
+		"0 < (y = x) < 7, y":  5,
+	} {
+		vars := map[string]Var{"x": NewVar(5)}
+		calls = 0
+		if e, err := chained.Parse(input, vars, funcs); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != result {
+			t.Error(input, n, result)
+		} else if strings.Contains(input, "f(x)") && calls > strings.Count(input, "f(") {
+			t.Error(input, calls)
+		}
+	}
+
+	// Middle operand is evaluated exactly once
+	e, err := chained.Parse("1 < f(3) < 10", map[string]Var{}, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls = 0
+	if n := e.Eval(); n != 1 || calls != 1 {
+		t.Error(n, calls)
+	}
+
+	// Without the option comparisons are not chained
+	if e, err := Parse("3 < x < 2", map[string]Var{"x": NewVar(5)}, funcs); err != nil {
+		t.Error(err)
+	} else if n := e.Eval(); n != 1 {
+		t.Error(n)
+	}
+}
+
+func TestParseWithEnv(t *testing.T) {
+	type counter struct{ n int }
+	funcs := map[string]Func{
+		"count": func(c *FuncContext) Num {
+			env := c.Env.(*counter)
+			env.n++
+			return Num(env.n)
+		},
+		"local": func(c *FuncContext) Num {
+			// Replacing Env only affects this call
+			c.Env = &counter{n: c.Env.(*counter).n + 10}
+			return Num(c.Env.(*counter).n)
+		},
+	}
+	env := &counter{}
+	e, err := ParseWithEnv("count() + count()*10", map[string]Var{}, funcs, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := e.Eval(); n != 21 || env.n != 2 {
+		t.Error(n, env.n)
+	}
+	if n := e.Eval(); n != 43 || env.n != 4 {
+		t.Error(n, env.n)
+	}
+	e, err = ParseWithEnv("local() + count()", map[string]Var{}, funcs, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := e.Eval(); n != 19 || env.n != 5 {
+		t.Error(n, env.n)
+	}
+	if n := e.Eval(); n != 30 || env.n != 6 {
+		t.Error(n, env.n)
+	}
+}
+
+func TestEvalOrder(t *testing.T) {
+	calls := ""
+	f := func(c *FuncContext) Num {
+		calls = calls + c.name
+		sum := Num(0)
+		for i := 0; i < c.NArgs(); i++ {
+			sum = sum + c.Arg(i)
+		}
+		return sum
+	}
+	funcs := map[string]Func{"f": f, "g": f, "h": f}
+	for _, op := range []string{
+		"**", "*", "/", "%", "%%", "//", "+", "-", "<<", ">>", "<", "<=", ">", ">=",
+		"==", "!=", "&", "^", "|", "^^", "&&", ",",
+	} {
+		input := "f(3) " + op + " g(2)"
+		e, err := Parse(input, map[string]Var{}, funcs)
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		for _, eval := range []func() Num{e.Eval, Compile(e), func() Num {
+			n, _ := EvalErr(e)
+			return n
+		}} {
+			calls = ""
+			eval()
+			if calls != "fg" {
+				t.Error(input, calls)
+			}
+		}
+	}
+	for input, order := range map[string]string{
+		"f(1) / g(0)":           "fg",
+		"f(1) + g(2) * h(3)":    "fgh",
+		"f(1) ** g(2) ** h(3)":  "fgh",
+		"f(0) ? g(1) : h(2)":    "fh",
+		"f(0) && g(1)":          "f",
+		"f(1) || g(1)":          "f",
+		"x = f(1) + g(2), h(x)": "fgh",
+		"x += f(g(h(1)))":       "fgh",
+		"f(-g(1)) - h(!f(0))":   "fghf",
+		"f(1) < g(2) < h(3)":    "fgh",
+		"f(g(1), h(2))":         "fgh",
+	} {
+		e, err := Parse(input, map[string]Var{}, funcs)
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		calls = ""
+		e.Eval()
+		if calls != order {
+			t.Error(input, calls, order)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	nested := func(n int) string {
+		return strings.Repeat("(", n) + "1" + strings.Repeat(")", n)
+	}
+	var pe *ParseError
+	_, err := Parse(nested(10000), map[string]Var{}, map[string]Func{})
+	if !errors.Is(err, ErrTooDeep) || !errors.As(err, &pe) || pe.Pos != DefaultMaxDepth {
+		t.Error(err)
+	}
+	if e, err := Parse(nested(DefaultMaxDepth), map[string]Var{}, map[string]Func{}); err != nil {
+		t.Error(err)
+	} else if n := e.Eval(); n != 1 {
+		t.Error(n)
+	}
+
+	p := &Parser{MaxDepth: 2}
+	funcs := map[string]Func{"f": func(c *FuncContext) Num { return c.Arg(0) }}
+	for input, ok := range map[string]bool{
+		"(1)":             true,
+		"((1))":           true,
+		"(((1)))":         false,
+		"(1) + (2) * (3)": true,
+		"f((1))":          true,
+		"f(f(1))":         true,
+		"f(f(f(1)))":      false,
+		"((1) + (2))":     true,
+		"((1) + ((2)))":   false,
+	} {
+		if _, err := p.Parse(input, map[string]Var{}, funcs); ok != (err == nil) {
+			t.Error(input, err)
+		} else if err != nil && !errors.Is(err, ErrTooDeep) {
+			t.Error(input, err)
+		}
+	}
+}
+
+func TestBadInteger(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		n     Num
+		err   error
+	}{
+		{"6 & 3", 2, nil},
+		{"2**53-1 & 1", 1, nil},
+		{"-(2**53-1) | 0", -(1<<53 - 1), nil},
+		{"1 << 62", 1 << 62, nil},
+		{"2**53 & 1", 0, ErrBadInteger},
+		{"2**53+1 & 1", 0, ErrBadInteger},
+		{"1e30 & 1", 1, ErrBadInteger},
+		{"1e30 ^ 0", math.MaxInt64, ErrBadInteger},
+		{"-1e30 | 0", math.MinInt64, ErrBadInteger},
+		{"2.5 | 0", 2, ErrBadInteger},
+		{"-2.5 | 0", -2, ErrBadInteger},
+		{"1 << 1.5", 2, ErrBadInteger},
+		{"1e30 >> 70", 0, ErrBadInteger},
+		{"4 >> 1e30", 0, ErrBadInteger},
+		{"4 << -1e30", 0, ErrBadInteger},
+	} {
+		e, err := Parse(test.input, map[string]Var{}, map[string]Func{})
+		if err != nil {
+			t.Error(test.input, err)
+			continue
+		}
+		if n, err := EvalErr(e); n != test.n || err != test.err {
+			t.Error(test.input, n, err)
+		}
+		if n := e.Eval(); n != test.n {
+			t.Error(test.input, n)
+		}
+	}
+}
+
+func TestParseReader(t *testing.T) {
+	vars := map[string]Var{"x": NewVar(2)}
+	input := "y = x * 3, # comment\n y + 1"
+	for _, r := range []io.Reader{strings.NewReader(input), iotest.OneByteReader(strings.NewReader(input))} {
+		if e, err := ParseReader(r, vars, map[string]Func{}); err != nil {
+			t.Error(err)
+		} else if n := e.Eval(); n != 7 {
+			t.Error(n)
+		}
+	}
+	if _, err := ParseReader(strings.NewReader("1 +"), vars, map[string]Func{}); !errors.Is(err, ErrOperandMissing) {
+		t.Error(err)
+	}
+	errRead := errors.New("read failed")
+	r := io.MultiReader(strings.NewReader("1 + 2"), iotest.ErrReader(errRead))
+	if e, err := ParseReader(r, vars, map[string]Func{}); err != errRead || e != nil {
+		t.Error(e, err)
+	}
+}
+
+func TestNoAssign(t *testing.T) {
+	p := &Parser{NoAssign: true}
+	x := NewVar(5)
+	vars := map[string]Var{"x": x}
+	for _, input := range []string{"x = 5", "x == 5 && (x = 1)", "x += 1", "x/=2"} {
+		var pe *ParseError
+		if _, err := p.Parse(input, vars, map[string]Func{}); !errors.Is(err, ErrAssign) || !errors.As(err, &pe) {
+			t.Error(input, err)
+		} else if !strings.Contains(err.Error(), `"=="`) || !strings.HasSuffix(pe.Token, "=") {
+			t.Error(input, err)
+		}
+	}
+	for input, result := range map[string]Num{"x == 5": 1, "x != 5": 0, "x <= 5, x >= 5": 1} {
+		if e, err := p.Parse(input, vars, map[string]Func{}); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != result {
+			t.Error(input, n)
+		}
+	}
+	if e, err := Parse("x = 1", vars, map[string]Func{}); err != nil {
+		t.Error(err)
+	} else if e.Eval(); x.Get() != 1 {
+		t.Error(x.Get())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	funcs := map[string]Func{"f": func(c *FuncContext) Num { return 0 }}
+	for _, input := range []string{"", "1", "x = y*2 + f(3)", "f()", "a ? b : c", "2 # comment"} {
+		if err := Validate(input, funcs); err != nil {
+			t.Error(input, err)
+		}
+	}
+	for input, e := range map[string]error{
+		"(1":      ErrParen,
+		"1)":      ErrParen,
+		"x 2":     ErrUnexpectedNumber,
+		"2 x":     ErrUnexpectedIdentifier,
+		"x \"s\"": ErrUnexpectedString,
+		`"s"`:     ErrUnexpectedString,
+		"f + 2":   ErrBadCall,
+		"x(2)":    ErrBadCall,
+		"1 @ 2":   ErrBadOp,
+		"1 +":     ErrOperandMissing,
+		"*2":      ErrOperandMissing,
+		"1__0":    ErrBadNumber,
+		`"s`:      ErrBadString,
+		"1 ? 2":   ErrTernary,
+		"1 : 2":   ErrTernary,
+		"1 /* 2":  ErrComment,
+	} {
+		if err := Validate(input, funcs); !errors.Is(err, e) {
+			t.Error(input, err, e)
+		}
+	}
+	if len(funcs) != 1 {
+		t.Error(funcs)
+	}
+}
+
+func TestConsts(t *testing.T) {
+	consts := Constants()
+	consts["g"] = 9.81
+	delete(consts, "e")
+	p := &Parser{Consts: consts}
+	for input, res := range map[string]Num{"g*2": 19.62, "pi": math.Pi, "e": 0, "e=2, e*g": 19.62} {
+		if e, err := p.Parse(input, map[string]Var{}, map[string]Func{}); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != res {
+			t.Error(input, n, res)
+		}
+	}
+	if _, err := p.Parse("g=1", map[string]Var{}, map[string]Func{}); !errors.Is(err, ErrBadVar) {
+		t.Error(err)
+	}
+	// Constants are folded, variables shadow them
+	if e, err := Parse("2*pi", map[string]Var{}, map[string]Func{}); err != nil || !isConst(Optimize(e)) {
+		t.Error(e, err)
+	}
+	if e, err := Parse("pi", map[string]Var{"pi": NewVar(3)}, map[string]Func{}); err != nil || e.Eval() != 3 {
+		t.Error(e, err)
+	}
+	if _, ok := Constants()["g"]; ok {
+		t.Error(Constants())
+	}
+}
+
+func TestPrevResult(t *testing.T) {
+	funcs := map[string]Func{"f": func(c *FuncContext) Num { return c.Arg(c.NArgs() - 1) }}
+	for input, res := range map[string]Num{
+		"5, _+1":            6,
+		"2+3, _*2":          10,
+		"1, 2, _":           2,
+		"1, _+1, _*10":      20,
+		"(1, _+1), _*10":    20,
+		"x = 3, _ * x":      9,
+		"(2, 3) + 1, _":     4,
+		"10, (1, _), _ + _": 2,
+		"7, f(4, _ + 1)":    8,
+		"_":                 0,
+		"_ + 1, _":          1,
+	} {
+		vars := map[string]Var{}
+		if e, err := Parse(input, vars, funcs); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != res {
+			t.Error(input, n, res)
+		} else if _, ok := vars["_"]; !ok {
+			t.Error(input, vars)
+		}
+	}
+	// Previous result is kept between evaluations and can be passed in
+	prev := NewVar(7)
+	if e, err := ParseStrict("_ * 2", map[string]Var{"_": prev}, funcs); err != nil || e.Eval() != 14 {
+		t.Error(e, err)
+	}
+	for _, input := range []string{"_1", "1 _", "__"} {
+		if _, err := Parse(input, map[string]Var{}, funcs); err == nil {
+			t.Error(input)
+		}
+	}
+}
+
+func TestMustParse(t *testing.T) {
+	if e := MustParse("2+3", map[string]Var{}, map[string]Func{}); e.Eval() != 5 {
+		t.Error(e)
+	}
+	defer func() {
+		if r, ok := recover().(string); !ok || !strings.Contains(r, `"2@3"`) || !strings.Contains(r, ErrBadOp.Error()) {
+			t.Error(r)
+		}
+	}()
+	MustParse("2@3", map[string]Var{}, map[string]Func{})
+	t.Error("no panic")
+}
+
+func TestRawArg(t *testing.T) {
+	raw := []string{}
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			for i := 0; i < c.NArgs(); i++ {
+				raw = append(raw, c.RawArg(i))
+			}
+			raw = append(raw, c.RawArg(c.NArgs()), c.RawArg(-1))
+			return 0
+		},
+	}
+	for input, args := range map[string]string{
+		"f(x+1)":                        "x+1||",
+		"f()":                           "|",
+		"f(  x  ,  y*2 )":               "x|y*2||",
+		"f(g(1, 2), (3, 4), 5)":         "g(1, 2)|(3, 4)|5||",
+		"f(a ? b : c, /* c */ d # e\n)": "a ? b : c|d||",
+		"f(π, \"s\" == \"t\")":          `π|"s" == "t"||`,
+		"f(1, f(2))":                    "1|f(2)||",
+	} {
+		raw = raw[:0]
+		vars, strs := map[string]Var{}, map[string]StrVar{}
+		fs := map[string]Func{"f": funcs["f"], "g": Builtins()["max"]}
+		if e, err := ParseTyped(input, vars, strs, fs); err != nil {
+			t.Error(input, err)
+		} else if e.EvalTyped(); strings.Join(raw, "|") != args {
+			t.Error(input, strings.Join(raw, "|"), args)
+		}
+	}
+
+	// Trees that are not parsed are formatted
+	c := &FuncContext{f: funcs["f"], Args: []Expr{&binaryExpr{op: plus, a: &constExpr{1}, b: &constExpr{2}}}}
+	if s := c.RawArg(0); s != "1+2" {
+		t.Error(s)
+	}
+	e, _ := Parse("f(x  +  1)", map[string]Var{}, funcs)
+	if s := Optimize(Clone(e, map[string]Var{})).(*FuncContext).RawArg(0); s != "x  +  1" {
+		t.Error(s)
+	}
+}
+
+func TestMaxVars(t *testing.T) {
+	vars := map[string]Var{"x": NewVar(1)}
+	p := &Parser{MaxVars: 3}
+	for input, e := range map[string]error{
+		"a+b+c":               nil,
+		"a+b+c+x+pi+a+b+c":    nil,
+		"a+b+c+d":             ErrTooManyVars,
+		"a=1, b=a, c=b, d=c":  ErrTooManyVars,
+		"f(a, b, c, d)":       ErrTooManyVars,
+		"a+b+c+d+e+f+g+h+i+j": ErrTooManyVars,
+	} {
+		vars := map[string]Var{"x": vars["x"]}
+		_, err := p.Parse(input, vars, map[string]Func{"f": Builtins()["max"]})
+		if !errors.Is(err, e) {
+			t.Error(input, err, e)
+		}
+		if len(vars) > 1+p.MaxVars {
+			t.Error(input, vars)
+		}
+	}
+
+	p = &Parser{MaxVars: 1}
+	if _, err := p.Parse("a+b", map[string]Var{}, map[string]Func{}); !errors.Is(err, ErrTooManyVars) {
+		t.Error(err)
+	}
+	var pe *ParseError
+	if _, err := p.Parse("a, x, b", vars, map[string]Func{}); !errors.As(err, &pe) || pe.Token != "b" {
+		t.Error(err)
+	}
+}
+
+func TestIntMode(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		float, n Num
+		intErr   error
+	}{
+		{"7/2", 3.5, 3, nil},
+		{"-7/2", -3.5, -3, nil},
+		{"7/2 == 3", 0, 1, nil},
+		{"1/3*3", 1, 0, nil},
+		{"2**10", 1024, 1024, nil},
+		{"2**-1", 0.5, 0, nil},
+		{"(-1)**-3", -1, -1, nil},
+		{"3**33 - 1", 5559060566555522, 5559060566555522, nil},
+		{"2**60 + 1", 1 << 60, 1 << 60, ErrBadInteger},
+		{"x = 7, x /= 2, x", 3.5, 3, nil},
+		{"7 % 4 + 7 // 2", 2, 6, nil},
+		{"7 % 4", -1, 3, nil},
+		{"-7 % 4", 1, -3, nil},
+		{"7 % -4", -1, 3, nil},
+		{"-7 % -4", 1, -3, nil},
+		{"7 %% 4", 3, 3, nil},
+		{"-7 %% 4", -3, -3, nil},
+		{"7 %% -4", 3, 3, nil},
+		{"-7 %% -4", -3, -3, nil},
+		{"7 // 2", 3, 3, nil},
+		{"-7 // 2", -4, -4, nil},
+		{"7 // -2", -4, -4, nil},
+		{"-7 // -2", 3, 3, nil},
+		{"-8 // 2", -4, -4, nil},
+		{"3**33 % 10", 3, 3, nil},
+		{"7.5 % 2", -0.5, 1, ErrBadInteger},
+		{"1 % 0", 0, 0, ErrDivisionByZero},
+		{"1 %% 0", 0, 0, ErrDivisionByZero},
+		{"1 // 0", 0, 0, ErrDivisionByZero},
+		{"7.5 / 2", 3.75, 3, ErrBadInteger},
+		{"1/0", 0, 0, ErrDivisionByZero},
+	} {
+		// Other options don't change the integer operators
+		for _, p := range []*Parser{{}, {IntMode: true}, {IntMode: true, NormalizeZero: true, OddRoots: true}} {
+			res := test.float
+			if p.IntMode {
+				res = test.n
+			}
+			e, err := p.Parse(test.input, map[string]Var{}, map[string]Func{})
+			if err != nil {
+				t.Fatal(test.input, err)
+			}
+			if n, err := EvalErr(e); n != res || (p.IntMode && err != test.intErr) {
+				t.Error(test.input, p.IntMode, n, res, err)
+			}
+			if n := Compile(e)(); n != res {
+				t.Error(test.input, p.IntMode, n, res)
+			}
+			if s := Format(e); p.IntMode && strings.Contains(test.input, "/") && !strings.Contains(s, "/") {
+				t.Error(test.input, s)
+			}
+		}
+	}
+}
+
+func TestBitWidth(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		width int
+		res   Num
+	}{
+		{"^2", 0, -3},
+		{"^0", 0, -1},
+		{"^-1", 0, 0},
+		{"^2", 32, 4294967293},
+		{"^2 == 4294967293", 32, 1},
+		{"^^2", 32, 2},
+		{"^-1", 32, 0},
+		{"^0", 8, 255},
+		{"^0x0f", 8, 0xf0},
+		{"^0x1ff", 8, 0},
+		{"^1 & 0xff", 16, 0xfe},
+		{"-^0", 1, -1},
+		{"^0", 64, 1 << 64},
+		{"^0", 100, 1 << 64},
+	} {
+		p := &Parser{BitWidth: test.width}
+		e, err := p.Parse(test.input, map[string]Var{}, map[string]Func{})
+		if err != nil {
+			t.Fatal(test.input, err)
+		}
+		if n := e.Eval(); n != test.res {
+			t.Error(test.input, test.width, n, test.res)
+		}
+		if n := Compile(e)(); n != test.res {
+			t.Error(test.input, test.width, n, test.res)
+		}
+		if s := Format(e); !strings.Contains(s, "^") {
+			t.Error(test.input, s)
+		}
+	}
+}
+
+func TestTrailingComma(t *testing.T) {
+	funcs := map[string]Func{"f": func(c *FuncContext) Num { return Num(c.NArgs())*10 + c.Arg(c.NArgs()-1) }}
+	p := &Parser{TrailingComma: true}
+	for input, res := range map[string]Num{
+		"f(2,)":          12,
+		"f(1, 2, 3,)":    33,
+		"f(f(1,), 2,)":   22,
+		"f(1, (2, 3),)":  33,
+		"f(x = 4,) + x":  18,
+		"f(1 ? 2 : 3, )": 12,
+	} {
+		if e, err := p.Parse(input, map[string]Var{}, funcs); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != res {
+			t.Error(input, n, res)
+		}
+		if _, err := Parse(input, map[string]Var{}, funcs); !errors.Is(err, ErrParen) {
+			t.Error(input, err)
+		}
+	}
+	for input, e := range map[string]error{
+		"f(,2)":    ErrOperandMissing,
+		"f(1,,2)":  ErrOperandMissing,
+		"f(1,,)":   ErrOperandMissing,
+		"f(,)":     ErrOperandMissing,
+		"(1,)":     ErrParen,
+		"f((1,))":  ErrParen,
+		"1, 2,":    ErrOperandMissing,
+		"f(1), 2,": ErrOperandMissing,
+	} {
+		if _, err := p.Parse(input, map[string]Var{}, funcs); !errors.Is(err, e) {
+			t.Error(input, err, e)
+		}
+	}
+}
+
+func TestBoolLogic(t *testing.T) {
+	for _, test := range []struct {
+		input     string
+		res, bool Num
+	}{
+		{"3 && 4", 4, 1},
+		{"3 && 0", 0, 0},
+		{"0 || -2", -2, 1},
+		{"0 || 0", 0, 0},
+		{"2 || x", 2, 1},
+		{"(3 && 4) + (5 || 6)", 9, 2},
+		{"1 < 2 < 3 && 7", 7, 1},
+		{"x = 2 && 3, x", 3, 1},
+		{"!(2 && 3)", 0, 0},
+	} {
+		for _, p := range []*Parser{{ChainComparisons: true}, {ChainComparisons: true, BoolLogic: true}} {
+			res := test.res
+			if p.BoolLogic {
+				res = test.bool
+			}
+			if e, err := p.Parse(test.input, map[string]Var{}, map[string]Func{}); err != nil {
+				t.Error(test.input, err)
+			} else if n := e.Eval(); n != res {
+				t.Error(test.input, p.BoolLogic, n, res)
+			} else if n := Compile(e)(); n != res {
+				t.Error(test.input, p.BoolLogic, n, res)
+			}
+		}
+	}
+}
+
+func TestNegativeZero(t *testing.T) {
+	for _, normalize := range []bool{false, true} {
+		p := &Parser{NormalizeZero: normalize, DivByZero: DivNaN}
+		for _, input := range []string{"0 * -1", "-0", "-x", "x / -1", "-x % 1", "-(x+0)", "-1 * x"} {
+			e, err := p.Parse(input, map[string]Var{"x": NewVar(0)}, map[string]Func{})
+			if err != nil {
+				t.Fatal(input, err)
+			}
+			for _, n := range []Num{e.Eval(), Compile(e)(), Optimize(e).Eval()} {
+				if n != 0 || math.Signbit(float64(n)) == normalize {
+					t.Error(normalize, input, n)
+				}
+			}
+			if s := fmt.Sprint(Optimize(e).Eval()); (s == "-0") == normalize {
+				t.Error(normalize, input, s)
+			}
+		}
+	}
+
+	// Negative zero equals zero, but is printed with a sign
+	for input, result := range map[string]Num{
+		"-0 == 0":    1,
+		"-0 != 0":    0,
+		"-0 < 0":     0,
+		"!-0":        1,
+		"1 / -0":     Num(math.Inf(-1)),
+		"-0 ? 1 : 2": 2,
+	} {
+		p := &Parser{DivByZero: DivNaN}
+		if e, err := p.Parse(input, map[string]Var{}, map[string]Func{}); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != result {
+			t.Error(input, n, result)
+		}
+	}
+	negZero := &constExpr{value: Num(math.Copysign(0, -1))}
+	if s := Format(negZero); s != "-0" {
+		t.Error(s)
+	}
+	if s := fmt.Sprint(negZero); s != "#-0" {
+		t.Error(s)
+	}
+	p := &Parser{NormalizeZero: true}
+	if e, err := p.Parse("-0 * 2", map[string]Var{}, map[string]Func{}); err != nil {
+		t.Error(err)
+	} else if s := Format(Optimize(e)); s != "0" {
+		t.Error(s)
+	}
+
+	// User-defined operators are normalized too
+	p.Ops, _ = DefaultOps().With("><", 5, LeftAssoc, func(a, b Num) Num { return a * b })
+	if e, err := p.Parse("0 >< -1", map[string]Var{}, map[string]Func{}); err != nil {
+		t.Error(err)
+	} else if n := e.Eval(); math.Signbit(float64(n)) {
+		t.Error(n)
+	}
+}
+
+func TestRemainderMode(t *testing.T) {
+	for _, test := range []struct {
+		input     string
+		ieee, mod Num
+	}{
+		{"-9 % 8", -1, -1},
+		{"9 % -8", 1, 1},
+		{"7 % 4", -1, 3},
+		{"-7 % 4", 1, -3},
+		{"7 % -4", -1, 3},
+		{"6 % 4", -2, 2},
+		{"5 % 4", 1, 1},
+		{"5.5 % 2", -0.5, 1.5},
+		{"8 % 4", 0, 0},
+		{"1 % 0", 0, 0},
+	} {
+		ieee, err := Parse(test.input, map[string]Var{}, map[string]Func{})
+		if err != nil {
+			t.Fatal(test.input, err)
+		}
+		p := &Parser{RemainderMode: RemTruncated}
+		mod, err := p.Parse(test.input, map[string]Var{}, map[string]Func{})
+		if err != nil {
+			t.Fatal(test.input, err)
+		}
+		if n := ieee.Eval(); n != test.ieee {
+			t.Error(test.input, n, test.ieee)
+		}
+		if n := mod.Eval(); n != test.mod {
+			t.Error(test.input, n, test.mod)
+		}
+		if n := Compile(mod)(); n != test.mod {
+			t.Error(test.input, n, test.mod)
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	inputs := []string{
+		"x=2+3*(x/(42+plusone(x))),x",
+		"a + b*c - d/e, f = g ? h : i",
+		"z && y || x ^^ w, -v ** u ** t",
+		"max(p, q, r) + min(s, 1, -2) < clamp(o, n, m)",
+		"c = b = a, a += 1, b //= 2",
+		"foo + bar + baz",
+	}
+	parse := func(input string) (string, string, string, error) {
+		vars := map[string]Var{}
+		funcs := Builtins()
+		funcs["plusone"] = func(c *FuncContext) Num { return c.Arg(0) + 1 }
+		e, err := Parse(input, vars, funcs)
+		if err != nil {
+			return "", "", "", err
+		}
+		return fmt.Sprint(e), Format(e), strings.Join(Vars(e), " "), nil
+	}
+	for _, input := range inputs {
+		s1, f1, v1, err1 := parse(input)
+		for i := 0; i < 10; i++ {
+			s2, f2, v2, err2 := parse(input)
+			if s1 != s2 || f1 != f2 || v1 != v2 || fmt.Sprint(err1) != fmt.Sprint(err2) {
+				t.Error(input, s1, s2, f1, f2, v1, v2, err1, err2)
+				break
+			}
+		}
+	}
+
+	// The first unknown identifier is always reported
+	for i := 0; i < 10; i++ {
+		_, err := ParseStrict("foo + bar + baz", map[string]Var{}, map[string]Func{})
+		var pe *ParseError
+		if !errors.As(err, &pe) || pe.Token != "foo" {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPower(t *testing.T) {
+	for input, result := range map[string]Num{
+		"10**3":       1000,
+		"10**15":      1e15,
+		"10**22":      1e22,
+		"2**10":       1024,
+		"2**53":       1 << 53,
+		"2**64":       1 << 64,
+		"2**0":        1,
+		"0**0":        1,
+		"0**3":        0,
+		"(-2)**3":     -8,
+		"(-2)**4":     16,
+		"1.5**2":      2.25,
+		"0.5**3":      0.125,
+		"2**-1":       0.5,
+		"4**0.5":      2,
+		"2**65":       1 << 65,
+		"(-8)**(1/3)": Num(math.NaN()),
+		"x**2":        25,
+	} {
+		if e, err := Parse(input, map[string]Var{"x": NewVar(5)}, map[string]Func{}); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != result && !(math.IsNaN(float64(n)) && math.IsNaN(float64(result))) {
+			t.Error(input, n, result)
+		}
+	}
+	// Integer exponents give the same results as math.Pow
+	for i := 0; i <= maxIntPow; i++ {
+		for _, a := range []Num{2, 3, -7, 10, 0.5} {
+			if n, m := pow(a, Num(i), false), Num(math.Pow(float64(a), float64(i))); n != m {
+				t.Error(a, i, n, m)
+			}
+		}
+	}
+}
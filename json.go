@@ -0,0 +1,251 @@
+package expr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrBadJSON = errors.New("malformed expression JSON")
+
+// JSON representation of an expression node
+type jsonNode struct {
+	Type    string      `json:"type"`
+	Value   *Num        `json:"value,omitempty"`
+	Name    string      `json:"name,omitempty"`
+	ID      int         `json:"id,omitempty"`
+	Op      string      `json:"op,omitempty"`
+	Flags   []string    `json:"flags,omitempty"`
+	Width   int         `json:"width,omitempty"`
+	Epsilon Num         `json:"epsilon,omitempty"`
+	Args    []*jsonNode `json:"args,omitempty"`
+}
+
+// Marshal returns JSON representation of the expression tree. Variables and
+// functions are stored by name, unnamed variables are stored as constants,
+// unless they are assigned in the expression, like temporary variables of
+// ChainComparisons or CSE, which are stored by a numeric id. Operators keep
+// the Parser options they were parsed with, like IntMode, as "flags".
+func Marshal(e Expr) ([]byte, error) {
+	m := &marshaler{temps: map[Var]int{}}
+	Walk(e, func(e Expr) bool {
+		if b, ok := e.(*binaryExpr); ok && isAssign(b.op) {
+			if v, ok := b.a.(namedVar); ok && v.varName() == "" && m.temps[v] == 0 {
+				m.temps[v] = len(m.temps) + 1
+			}
+		}
+		return true
+	})
+	node, err := m.marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(node)
+}
+
+// Names of operator flags set by parser options, the bit width of "^" is
+// stored separately
+var jsonFlags = []struct {
+	name string
+	flag arithOp
+}{
+	{"int", intOp}, {"oddRoots", oddRootOp}, {"normalizeZero", zeroOp},
+	{"divNaN", divNaNOp}, {"divError", divErrorOp}, {"truncated", truncOp},
+}
+
+// Sets the flags and the width of the operator node
+func (node *jsonNode) setFlags(op arithOp) {
+	for _, f := range jsonFlags {
+		if op&f.flag != 0 {
+			node.Flags = append(node.Flags, f.name)
+		}
+	}
+	node.Width = int(op&widthMask) >> widthShift
+}
+
+// Returns the operator flags of the node
+func (node *jsonNode) flags() (arithOp, error) {
+	var op arithOp
+	for _, name := range node.Flags {
+		i := 0
+		for i < len(jsonFlags) && jsonFlags[i].name != name {
+			i++
+		}
+		if i == len(jsonFlags) {
+			return 0, fmt.Errorf("%w: unknown flag %q", ErrBadJSON, name)
+		}
+		op |= jsonFlags[i].flag
+	}
+	if node.Width < 0 || node.Width > 64 {
+		return 0, fmt.Errorf("%w: bit width %d", ErrBadJSON, node.Width)
+	}
+	return op | arithOp(node.Width)<<widthShift, nil
+}
+
+type marshaler struct {
+	// Ids of unnamed variables assigned in the expression, starting from 1
+	temps map[Var]int
+}
+
+func (m *marshaler) marshal(e Expr) (*jsonNode, error) {
+	args := func(exprs ...Expr) ([]*jsonNode, error) {
+		nodes := make([]*jsonNode, len(exprs))
+		for i, e := range exprs {
+			node, err := m.marshal(e)
+			if err != nil {
+				return nil, err
+			}
+			nodes[i] = node
+		}
+		return nodes, nil
+	}
+	var err error
+	node := &jsonNode{}
+	switch e := e.(type) {
+	case *constExpr:
+		value := e.value
+		node.Type, node.Value = "const", &value
+	case namedVar:
+		node.Type, node.Name, node.ID = "var", e.varName(), m.temps[e]
+		if node.Name == "" && node.ID == 0 {
+			value := e.Get()
+			node.Type, node.Name, node.Value = "const", "", &value
+		}
+	case *unaryExpr:
+		node.Type, node.Op = "unary", e.symbol()
+		node.setFlags(e.op)
+		node.Args, err = args(e.arg)
+	case *binaryExpr:
+		node.Type, node.Op = "binary", e.symbol()
+		node.setFlags(e.op)
+		node.Epsilon = e.eps
+		node.Args, err = args(e.a, e.b)
+	case *ternaryExpr:
+		node.Type = "cond"
+		node.Args, err = args(e.cond, e.a, e.b)
+	case *FuncContext:
+		node.Type, node.Name = "call", e.name
+		node.Args, err = args(e.Args...)
+	default:
+		return nil, fmt.Errorf("expr: can not marshal %T", e)
+	}
+	return node, err
+}
+
+// Unmarshal restores the expression tree from its JSON representation.
+// Variables and functions are looked up by name in vars and funcs, unknown
+// variables are created like Parse does.
+func Unmarshal(data []byte, vars map[string]Var, funcs map[string]Func) (Expr, error) {
+	return (&Parser{}).Unmarshal(data, vars, funcs)
+}
+
+// Unmarshal restores the expression tree like Unmarshal does, operators are
+// looked up in the parser Ops, so that user-defined operators are restored
+// too
+func (p *Parser) Unmarshal(data []byte, vars map[string]Var, funcs map[string]Func) (Expr, error) {
+	node := &jsonNode{}
+	if err := json.Unmarshal(data, node); err != nil {
+		return nil, err
+	}
+	u := &unmarshaler{ops: p.Ops, vars: vars, funcs: funcs, temps: map[int]Var{}}
+	if u.ops == nil {
+		u.ops = DefaultOps()
+	}
+	return u.unmarshal(node)
+}
+
+type unmarshaler struct {
+	ops   *OpTable
+	vars  map[string]Var
+	funcs map[string]Func
+	// Unnamed variables by their ids
+	temps map[int]Var
+}
+
+func (u *unmarshaler) unmarshal(node *jsonNode) (Expr, error) {
+	if node == nil {
+		return nil, ErrBadJSON
+	}
+	args := make([]Expr, len(node.Args))
+	for i, arg := range node.Args {
+		e, err := u.unmarshal(arg)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = e
+	}
+	vars, funcs := u.vars, u.funcs
+	stack := exprStack(args)
+	flags, err := node.flags()
+	if err != nil {
+		return nil, err
+	}
+	switch node.Type {
+	case "const":
+		if node.Value == nil {
+			return nil, ErrBadJSON
+		}
+		return &constExpr{value: *node.Value}, nil
+	case "var":
+		if node.Name == "" && node.ID > 0 {
+			if _, ok := u.temps[node.ID]; !ok {
+				u.temps[node.ID] = &varExpr{}
+			}
+			return u.temps[node.ID], nil
+		} else if node.Name == "" {
+			return nil, ErrBadJSON
+		}
+		if v, ok := vars[node.Name]; ok {
+			nameVar(v, node.Name)
+			return v, nil
+		}
+		v := &varExpr{name: node.Name}
+		vars[node.Name] = v
+		return v, nil
+	case "unary":
+		if op, ok := u.ops.ops[node.Op+"u"]; !ok || !u.ops.isUnary(op) {
+			return nil, ErrBadOp
+		} else if len(args) != 1 {
+			return nil, ErrBadJSON
+		} else {
+			return u.bind(op|flags, &stack)
+		}
+	case "binary":
+		if op, ok := u.ops.ops[node.Op]; !ok || u.ops.isUnary(op) || op == conditional || op == conditionalElse {
+			return nil, ErrBadOp
+		} else if len(args) != 2 || node.Epsilon < 0 {
+			return nil, ErrBadJSON
+		} else {
+			e, err := u.bind(op|flags, &stack)
+			if b, ok := e.(*binaryExpr); ok {
+				b.eps = node.Epsilon
+			}
+			return e, err
+		}
+	case "cond":
+		if len(args) != 3 {
+			return nil, ErrBadJSON
+		}
+		return &ternaryExpr{cond: args[0], a: args[1], b: args[2]}, nil
+	case "call":
+		f, ok := funcs[node.Name]
+		if !ok || f == nil {
+			return nil, ErrBadCall
+		}
+		return &FuncContext{f: f, name: node.Name, Vars: vars, Args: args}, nil
+	}
+	return nil, ErrBadJSON
+}
+
+// Returns the operator expression like OpTable.bind, with the operator flags
+// kept
+func (u *unmarshaler) bind(op arithOp, stack *exprStack) (Expr, error) {
+	e, err := u.ops.bind(op&^opFlags, stack)
+	switch e := e.(type) {
+	case *unaryExpr:
+		e.op |= op & opFlags
+	case *binaryExpr:
+		e.op |= op & opFlags
+	}
+	return e, err
+}
@@ -0,0 +1,235 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			return 0
+		},
+	}
+	e, err := Parse("-x+f(2, y=1)", map[string]Var{"x": NewVar(3)}, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := Marshal(e); err != nil {
+		t.Error(err)
+	} else if s := string(b); s != `{"type":"binary","op":"+","args":[`+
+		`{"type":"unary","op":"-","args":[{"type":"var","name":"x"}]},`+
+		`{"type":"call","name":"f","args":[{"type":"const","value":2},`+
+		`{"type":"binary","op":"=","args":[{"type":"var","name":"y"},{"type":"const","value":1}]}]}]}` {
+		t.Error(s)
+	}
+	if b, err := Marshal(NewVar(4)); err != nil || string(b) != `{"type":"const","value":4}` {
+		t.Error(string(b), err)
+	}
+	if _, err := Marshal(&strExpr{}); err == nil {
+		t.Error()
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	funcs := Builtins()
+	for _, input := range []string{
+		"",
+		"0",
+		"-2.5",
+		"x",
+		"-2+max(x, 1)",
+		"2+3*4-5/6%7%%8",
+		"!x&&y||^z",
+		"x=y=z=-1, x+y+z",
+		"x+=2",
+		"a ? b ? 1 : 2 : c ? 3 : 4",
+		"min() + sqrt(x*x)",
+	} {
+		env1, env2 := map[string]Var{}, map[string]Var{}
+		e1, err := Parse(input, env1, funcs)
+		if err != nil {
+			t.Error(input, err)
+			continue
+		}
+		b, err := Marshal(e1)
+		if err != nil {
+			t.Error(input, err)
+			continue
+		}
+		e2, err := Unmarshal(b, env2, funcs)
+		if err != nil {
+			t.Error(input, string(b), err)
+		} else if s1, s2 := fmt.Sprint(e1), fmt.Sprint(e2); s1 != s2 {
+			t.Error(input, string(b), s1, s2)
+		} else if len(env1) != len(env2) {
+			t.Error(input, env1, env2)
+		}
+	}
+
+	// Variables are rebound to the given map
+	x := NewVar(5)
+	e, err := Unmarshal([]byte(`{"type":"binary","op":"*","args":[{"type":"var","name":"x"},{"type":"const","value":2}]}`),
+		map[string]Var{"x": x}, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := e.Eval(); n != 10 {
+		t.Error(n)
+	}
+	x.Set(6)
+	if n := e.Eval(); n != 12 {
+		t.Error(n)
+	}
+}
+
+func TestMarshalTemps(t *testing.T) {
+	p := &Parser{ChainComparisons: true}
+	x := NewVar(4)
+	e1, err := p.Parse("1 < sqrt(x) < 3", map[string]Var{"x": x}, Builtins())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Marshal(e1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `{"type":"var","id":1}`) {
+		t.Error(string(b))
+	}
+	x2 := NewVar(4)
+	e2, err := Unmarshal(b, map[string]Var{"x": x2}, Builtins())
+	if err != nil {
+		t.Fatal(string(b), err)
+	}
+	for _, n := range []Num{4, 16, 0.5} {
+		x.Set(n)
+		x2.Set(n)
+		if n1, n2 := e1.Eval(), e2.Eval(); n1 != n2 {
+			t.Error(n, n1, n2)
+		}
+	}
+}
+
+func TestMarshalCSE(t *testing.T) {
+	x := NewVar(3)
+	e, err := Parse("sqrt(x+1) * sqrt(x+1) + (x > 0 ? sqrt(x+1) : 0)", map[string]Var{"x": x}, Builtins())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e1 := CSE(e, "sqrt")
+	b, err := Marshal(e1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x2 := NewVar(3)
+	e2, err := Unmarshal(b, map[string]Var{"x": x2}, Builtins())
+	if err != nil {
+		t.Fatal(string(b), err)
+	}
+	for _, n := range []Num{3, 8, -1} {
+		x.Set(n)
+		x2.Set(n)
+		if n1, n2 := e1.Eval(), e2.Eval(); n1 != n2 || n1 != e.Eval() {
+			t.Error(n, n1, n2)
+		}
+	}
+}
+
+func TestMarshalOptions(t *testing.T) {
+	for _, test := range []struct {
+		p     *Parser
+		input string
+		n     Num
+	}{
+		{&Parser{IntMode: true}, "7/2 + 2**-1", 3},
+		{&Parser{BitWidth: 8}, "^0", 255},
+		{&Parser{OddRoots: true}, "(-8)**(1/3)", -2},
+		{&Parser{NormalizeZero: true}, "(-x)**-1", Num(math.Inf(1))},
+		{&Parser{DivByZero: DivNaN}, "-1/x", Num(math.Inf(-1))},
+		{&Parser{RemainderMode: RemTruncated}, "7 % 4", 3},
+		{&Parser{EqualEpsilon: 0.01}, "1 == 1.001", 1},
+	} {
+		e1, err := test.p.Parse(test.input, map[string]Var{"x": NewVar(0)}, Builtins())
+		if err != nil {
+			t.Fatal(test.input, err)
+		}
+		b, err := Marshal(e1)
+		if err != nil {
+			t.Fatal(test.input, err)
+		}
+		e2, err := Unmarshal(b, map[string]Var{"x": NewVar(0)}, Builtins())
+		if err != nil {
+			t.Error(test.input, string(b), err)
+		} else if n1, n2 := e1.Eval(), e2.Eval(); (n1 != test.n && math.Abs(float64(n1-test.n)) > 1e-12) || n1 != n2 {
+			t.Error(test.input, string(b), n1, n2)
+		}
+	}
+}
+
+func TestMarshalCustomOps(t *testing.T) {
+	defer resetOps()
+	approx := func(a, b Num) Num { return boolNum(math.Abs(float64(a-b)) < 0.1) }
+	if err := RegisterOp("~=", 7, LeftAssoc, approx); err != nil {
+		t.Fatal(err)
+	}
+	table, err := DefaultOps().WithUnary("√", func(a Num) Num { return Num(math.Sqrt(float64(a))) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Parser{Ops: table}
+	for _, input := range []string{"1 ~= 1.05", "√16 ~= 4", "-√x"} {
+		e1, err := p.Parse(input, map[string]Var{"x": NewVar(9)}, Builtins())
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		b, err := Marshal(e1)
+		if err != nil {
+			t.Fatal(input, err)
+		}
+		e2, err := p.Unmarshal(b, map[string]Var{"x": NewVar(9)}, Builtins())
+		if err != nil {
+			t.Error(input, string(b), err)
+		} else if n1, n2 := e1.Eval(), e2.Eval(); n1 != n2 {
+			t.Error(input, string(b), n1, n2)
+		}
+	}
+
+	// Registered operators are known to Unmarshal, others are not
+	b, _ := Marshal(MustParse("1 ~= 1.05", map[string]Var{}, Builtins()))
+	if e, err := Unmarshal(b, map[string]Var{}, Builtins()); err != nil || e.Eval() != 1 {
+		t.Error(e, err)
+	}
+	e, _ := p.Parse("√4", map[string]Var{}, Builtins())
+	b, _ = Marshal(e)
+	if _, err := Unmarshal(b, map[string]Var{}, Builtins()); !errors.Is(err, ErrBadOp) {
+		t.Error(err)
+	}
+}
+
+func TestUnmarshalError(t *testing.T) {
+	for data, e := range map[string]error{
+		`{"type":"const"}`:                                               ErrBadJSON,
+		`{"type":"var"}`:                                                 ErrBadJSON,
+		`{"type":"foo"}`:                                                 ErrBadJSON,
+		`{"type":"unary","op":"+","args":[]}`:                            ErrBadOp,
+		`{"type":"unary","op":"-","args":[]}`:                            ErrBadJSON,
+		`{"type":"binary","op":"?","args":[]}`:                           ErrBadOp,
+		`{"type":"binary","op":"+","args":[{"type":"const","value":1}]}`: ErrBadJSON,
+		`{"type":"binary","op":"=","args":[{"type":"const","value":1},{"type":"const","value":1}]}`: ErrBadVar,
+		`{"type":"cond","args":[null, null, null]}`:                                                 ErrBadJSON,
+		`{"type":"call","name":"foo"}`:                                                              ErrBadCall,
+		`{"type":"unary","op":"-","flags":["foo"],"args":[{"type":"const","value":1}]}`:             ErrBadJSON,
+		`{"type":"unary","op":"^","width":65,"args":[{"type":"const","value":1}]}`:                  ErrBadJSON,
+	} {
+		if _, err := Unmarshal([]byte(data), map[string]Var{}, Builtins()); !errors.Is(err, e) {
+			t.Error(data, err, e)
+		}
+	}
+	if _, err := Unmarshal([]byte(`{`), map[string]Var{}, Builtins()); err == nil {
+		t.Error()
+	}
+}
@@ -0,0 +1,365 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+)
+
+var (
+	ErrOpExists = errors.New("operator already exists")
+	ErrBadOpDef = errors.New("invalid operator definition")
+	ErrOpSplit  = errors.New("operator symbol is not read as a single token")
+	ErrOpShadow = errors.New("operator symbol changes the meaning of existing input")
+)
+
+// Assoc is the associativity of a binary operator
+type Assoc int
+
+const (
+	LeftAssoc Assoc = iota
+	RightAssoc
+)
+
+// User-defined binary or unary operator
+type customOp struct {
+	symbol     string
+	precedence int
+	assoc      Assoc
+	fn         func(a, b Num) Num
+	unary      func(a Num) Num
+}
+
+// Applies the operator to the evaluated operands, unary operators only use a
+func (c *customOp) apply(a, b Num) Num {
+	if c.unary != nil {
+		return c.unary(a)
+	}
+	return c.fn(a, b)
+}
+
+// OpTable is an immutable set of operators recognized by the parser. The zero
+// value is not valid, use DefaultOps to get one.
+type OpTable struct {
+	ops map[string]arithOp
+	// All non-empty prefixes of binary operator symbols, so that the
+	// tokenizer can find the longest match without scanning the table
+	prefixes map[string]bool
+	// Unary operator symbols mapped to their keys in ops, which have "u"
+	// suffix, and all prefixes of non-word unary symbols
+	unary         map[string]string
+	unaryPrefixes map[string]bool
+	// Definitions of user-defined operators, indexed by their arithOp values
+	// starting after comma. The slice is shared by tables, never modified.
+	defs []*customOp
+}
+
+func newOpTable(ops map[string]arithOp) *OpTable {
+	t := &OpTable{ops: ops, prefixes: map[string]bool{},
+		unary: map[string]string{}, unaryPrefixes: map[string]bool{}}
+	for op := range ops {
+		prefixes := t.prefixes
+		if sym := strings.TrimSuffix(op, "u"); sym != op {
+			t.unary[sym] = op
+			if isWord(sym) {
+				continue
+			}
+			op, prefixes = sym, t.unaryPrefixes
+		}
+		for i := 1; i <= len(op); i++ {
+			prefixes[op[:i]] = true
+		}
+	}
+	return t
+}
+
+// Returns true if s is a valid identifier
+func isWord(s string) bool {
+	for i, c := range s {
+		if !(unicode.IsLetter(c) || (i > 0 && (unicode.IsNumber(c) || c == '_'))) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Returns true if s consists of characters allowed in operator symbols
+func isOpSymbol(s string) bool {
+	if s == "" || strings.Contains(s, "/*") {
+		return false
+	}
+	for _, c := range s {
+		if !(unicode.IsPunct(c) || unicode.IsSymbol(c)) || strings.ContainsRune(`()[]"#_,`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	builtinOps   = newOpTable(ops)
+	defaultOps   atomic.Value
+	defaultOpsMu sync.Mutex
+)
+
+// DefaultOps returns the table of built-in operators and the ones added with
+// RegisterOp
+func DefaultOps() *OpTable {
+	if t, ok := defaultOps.Load().(*OpTable); ok {
+		return t
+	}
+	return builtinOps
+}
+
+// With returns a copy of the table with a new binary operator added. Symbol
+// must consist of punctuation or symbol characters, other than parentheses,
+// quotes, "#", "_" and ",". Precedence uses the same levels as the built-in
+// operators, lower level binds tighter: 1 is "**", 3 is "*", 4 is "+", 6 is
+// "<", 7 is "==", 11 is "&&", 16 is ",". Level 2 is reserved for unary
+// operators. Adding an existing operator returns ErrOpExists. Symbols that
+// the tokenizer would not read as a whole, like ".+" that continues the
+// number in "1.+2", return an error wrapping ErrOpSplit. Symbols that are an
+// existing operator followed by unary operators, like "<-" that would change
+// the meaning of "x<-1", return an error wrapping ErrOpShadow.
+func (t *OpTable) With(symbol string, prec int, assoc Assoc, fn func(a, b Num) Num) (*OpTable, error) {
+	if _, ok := t.ops[symbol]; ok {
+		return nil, ErrOpExists
+	}
+	if !isOpSymbol(symbol) || fn == nil || prec < 1 || prec == 2 || prec > precedence(comma) {
+		return nil, ErrBadOpDef
+	}
+	if err := t.checkToken(symbol, "1"+symbol+"1", 1); err != nil {
+		return nil, err
+	} else if err := t.checkShadow(symbol, true); err != nil {
+		return nil, err
+	}
+	return t.with(symbol, &customOp{symbol: symbol, precedence: prec, assoc: assoc, fn: fn}), nil
+}
+
+// WithUnary returns a copy of the table with a new prefix unary operator
+// added. Symbol is either a word, like "not", or consists of the same
+// characters as binary operator symbols. Unary operators bind like the
+// built-in "-", tighter than any binary operator except "**". A word symbol
+// can no longer be used as a variable or function name. Like in With,
+// symbols must be read as a whole and must not be a sequence of existing
+// unary operators, like "!-" in "!-x".
+func (t *OpTable) WithUnary(symbol string, fn func(a Num) Num) (*OpTable, error) {
+	if _, ok := t.unary[symbol]; ok {
+		return nil, ErrOpExists
+	}
+	if !(isWord(symbol) || isOpSymbol(symbol)) || fn == nil {
+		return nil, ErrBadOpDef
+	}
+	if !isWord(symbol) {
+		if err := t.checkToken(symbol+"u", symbol+"1", 0); err != nil {
+			return nil, err
+		} else if err := t.checkShadow(symbol, false); err != nil {
+			return nil, err
+		}
+	}
+	return t.with(symbol+"u", &customOp{symbol: symbol, precedence: 2, assoc: RightAssoc, unary: fn}), nil
+}
+
+// Returns a copy of the table where key refers to the new operator
+// definition
+func (t *OpTable) with(key string, def *customOp) *OpTable {
+	defs := append(t.defs[:len(t.defs):len(t.defs)], def)
+	res := make(map[string]arithOp, len(t.ops)+1)
+	for s, op := range t.ops {
+		res[s] = op
+	}
+	res[key] = comma + arithOp(len(defs))
+	table := newOpTable(res)
+	table.defs = defs
+	return table
+}
+
+// Returns the definition of user-defined operator, or nil if the operator is
+// built-in
+func (t *OpTable) custom(op arithOp) *customOp {
+	if i := int(op&^opFlags - comma - 1); i >= 0 && i < len(t.defs) {
+		return t.defs[i]
+	}
+	return nil
+}
+
+func (t *OpTable) isUnary(op arithOp) bool {
+	if c := t.custom(op); c != nil {
+		return c.unary != nil
+	}
+	return isUnary(op)
+}
+func (t *OpTable) precedence(op arithOp) int {
+	if c := t.custom(op); c != nil {
+		return c.precedence
+	}
+	return precedence(op)
+}
+func (t *OpTable) isLeftAssoc(op arithOp) bool {
+	if c := t.custom(op); c != nil {
+		return c.assoc == LeftAssoc
+	}
+	return isLeftAssoc(op)
+}
+
+// Returns the operator expression, operands are popped from the stack
+func (t *OpTable) bind(op arithOp, stack *exprStack) (Expr, error) {
+	def := t.custom(op)
+	if t.isUnary(op) {
+		if stack.Peek() == nil {
+			return nil, ErrOperandMissing
+		}
+		return &unaryExpr{op: op, arg: stack.Pop(), def: def}, nil
+	}
+	b := stack.Pop()
+	a := stack.Pop()
+	if a == nil || b == nil {
+		return nil, ErrOperandMissing
+	} else if def != nil {
+		return &binaryExpr{op: op, a: a, b: b, def: def}, nil
+	}
+	return newBinaryExpr(op, a, b)
+}
+
+// Checks that the input is tokenized with the operator key added to the
+// table, and that the token at index i is the operator itself
+func (t *OpTable) checkToken(key, input string, i int) error {
+	ops := make(map[string]arithOp, len(t.ops)+1)
+	for s, op := range t.ops {
+		ops[s] = op
+	}
+	ops[key] = comma
+	tokens, err := tokenize([]rune(input), newOpTable(ops))
+	if err != nil {
+		return fmt.Errorf("%w: %q: %v", ErrOpSplit, input, err)
+	} else if len(tokens) > i && tokens[i].text == key {
+		return nil
+	}
+	texts := make([]string, len(tokens))
+	for j, tok := range tokens {
+		if _, ok := ops[tok.text]; ok {
+			// Unary operator keys have "u" suffix
+			tok.text = strings.TrimSuffix(tok.text, "u")
+		}
+		texts[j] = tok.text
+	}
+	return fmt.Errorf("%w: %q is read as %q", ErrOpSplit, input, texts)
+}
+
+// Checks that the symbol is not an existing binary operator, or a unary one
+// if binary is false, followed by one or more unary operators, since the new
+// symbol would replace them in the input that uses them together
+func (t *OpTable) checkShadow(symbol string, binary bool) error {
+	for i := range symbol {
+		ok := false
+		if binary {
+			_, ok = t.ops[symbol[:i]]
+		} else {
+			_, ok = t.unary[symbol[:i]]
+		}
+		if i == 0 || !ok {
+			continue
+		}
+		if unary := t.unarySplit(symbol[i:]); unary != nil {
+			return fmt.Errorf("%w: %q is %q followed by unary %q", ErrOpShadow, symbol, symbol[:i], unary)
+		}
+	}
+	return nil
+}
+
+// Splits the symbol into a sequence of unary operators, returns nil if that
+// is not possible
+func (t *OpTable) unarySplit(symbol string) []string {
+	for i := range symbol {
+		if i == 0 {
+			continue
+		}
+		if _, ok := t.unary[symbol[:i]]; ok {
+			if rest := t.unarySplit(symbol[i:]); rest != nil {
+				return append([]string{symbol[:i]}, rest...)
+			}
+		}
+	}
+	if _, ok := t.unary[symbol]; ok {
+		return []string{symbol}
+	}
+	return nil
+}
+
+// Returns true if s is the beginning of some binary operator
+func (t *OpTable) isPrefix(s string) bool {
+	return t.prefixes[s]
+}
+
+// Precedence returns the precedence level of the operator, lower level binds
+// tighter, see With. Binary operators are looked up first, so "-" is the
+// binary minus, but symbols that are only unary operators, like "!", are
+// reported at level 2.
+func (t *OpTable) Precedence(symbol string) (int, bool) {
+	op, ok := t.ops[symbol]
+	if !ok {
+		if op, ok = t.ops[t.unary[symbol]]; !ok {
+			return 0, false
+		}
+	}
+	return t.precedence(op), true
+}
+
+// Associativity returns the associativity of the operator, unknown operators
+// are left-associative. Unary and assignment operators, "**", "?:" and ","
+// are right-associative.
+func (t *OpTable) Associativity(symbol string) Assoc {
+	op, ok := t.ops[symbol]
+	if !ok {
+		if op, ok = t.ops[t.unary[symbol]]; !ok {
+			return LeftAssoc
+		}
+	}
+	if t.isLeftAssoc(op) {
+		return LeftAssoc
+	}
+	return RightAssoc
+}
+
+// Precedence returns the precedence level of the operator in the default
+// operator table, see OpTable.Precedence
+func Precedence(symbol string) (int, bool) {
+	return DefaultOps().Precedence(symbol)
+}
+
+// Associativity returns the associativity of the operator in the default
+// operator table, see OpTable.Associativity
+func Associativity(symbol string) Assoc {
+	return DefaultOps().Associativity(symbol)
+}
+
+// RegisterUnaryOp adds a prefix unary operator to the default operator
+// table, see OpTable.WithUnary and RegisterOp.
+func RegisterUnaryOp(symbol string, fn func(a Num) Num) error {
+	defaultOpsMu.Lock()
+	defer defaultOpsMu.Unlock()
+	t, err := DefaultOps().WithUnary(symbol, fn)
+	if err != nil {
+		return err
+	}
+	defaultOps.Store(t)
+	return nil
+}
+
+// RegisterOp adds a binary operator to the default operator table used by
+// all parsers that don't have their own one, see OpTable.With. It is safe to
+// call RegisterOp concurrently with parsing, but expressions that are being
+// parsed at the same time may not recognize the new operator.
+func RegisterOp(symbol string, prec int, assoc Assoc, fn func(a, b Num) Num) error {
+	defaultOpsMu.Lock()
+	defer defaultOpsMu.Unlock()
+	t, err := DefaultOps().With(symbol, prec, assoc, fn)
+	if err != nil {
+		return err
+	}
+	defaultOps.Store(t)
+	return nil
+}
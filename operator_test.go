@@ -0,0 +1,331 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func maxNum(a, b Num) Num {
+	return Num(math.Max(float64(a), float64(b)))
+}
+
+// Removes all operators added with RegisterOp
+func resetOps() {
+	defaultOps.Store(builtinOps)
+}
+
+func TestRegisterOp(t *testing.T) {
+	defer resetOps()
+	approx := func(a, b Num) Num {
+		return boolNum(math.Abs(float64(a-b)) < 1e-6)
+	}
+	if err := RegisterOp("~=", 7, LeftAssoc, approx); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterOp("<~", 4, RightAssoc, func(a, b Num) Num { return a - b }); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterOp("=~~", 3, LeftAssoc, func(a, b Num) Num { return a*10 + b }); err != nil {
+		t.Fatal(err)
+	}
+	for input, result := range map[string]Num{
+		"0.1+0.2 ~= 0.3":   1,
+		"0.1+0.2 == 0.3":   0,
+		"1 ~= 1.1":         0,
+		"x=1 ~= 1.0000001": 1,
+		"x ~= 0 && 2":      2,
+		"10 <~ 3 <~ 2":     9,
+		"10 - 3 - 2":       5,
+		"1 =~~ 2 =~~ 3":    123,
+		"1 + 2 =~~ 3":      24,
+		"x<-1":             0,
+	} {
+		if e, err := Parse(input, map[string]Var{}, map[string]Func{}); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != result {
+			t.Error(input, n, result)
+		} else if f, err := Parse(Format(e), map[string]Var{}, map[string]Func{}); err != nil {
+			t.Error(input, Format(e), err)
+		} else if n := f.Eval(); n != result {
+			t.Error(input, Format(e), n)
+		}
+	}
+
+	for _, op := range []string{"+", "~=", "==", "-u", "&&"} {
+		if err := RegisterOp(op, 4, LeftAssoc, approx); err != ErrOpExists {
+			t.Error(op, err)
+		}
+	}
+	for _, op := range []string{"", "~a", "#~", "~(", "~_", `~"`, "/*", "~,", "~ ~", "~1"} {
+		if err := RegisterOp(op, 4, LeftAssoc, approx); err != ErrBadOpDef {
+			t.Error(op, err)
+		}
+	}
+	for _, prec := range []int{-1, 0, 2, 17} {
+		if err := RegisterOp("@", prec, LeftAssoc, approx); err != ErrBadOpDef {
+			t.Error(prec, err)
+		}
+	}
+	if err := RegisterOp("@", 4, LeftAssoc, nil); err != ErrBadOpDef {
+		t.Error(err)
+	}
+}
+
+func TestOpSplit(t *testing.T) {
+	defer resetOps()
+	for _, op := range []string{".", ".+", "..", "..."} {
+		if err := RegisterOp(op, 4, LeftAssoc, maxNum); !errors.Is(err, ErrOpSplit) {
+			t.Error(op, err)
+		}
+	}
+	err := RegisterOp(".+", 4, LeftAssoc, maxNum)
+	if s := fmt.Sprint(err); s != `operator symbol is not read as a single token: "1.+1" is read as ["1." "+" "1"]` {
+		t.Error(s)
+	}
+	if _, ok := DefaultOps().ops[".+"]; ok {
+		t.Error(DefaultOps())
+	}
+
+	// Operators must not change the meaning of existing input, like "<-"
+	// would in "x<-1"
+	for _, op := range []string{"<-", "*-", "**-", "+!^", "==-!", "<=>-", "-=-"} {
+		if err := RegisterOp(op, 4, LeftAssoc, maxNum); !errors.Is(err, ErrOpShadow) {
+			t.Error(op, err)
+		}
+	}
+	for _, op := range []string{"!!", "-!", "^--"} {
+		if err := RegisterUnaryOp(op, func(a Num) Num { return a }); !errors.Is(err, ErrOpShadow) {
+			t.Error(op, err)
+		}
+	}
+	err = RegisterOp("<-!", 4, LeftAssoc, maxNum)
+	if s := fmt.Sprint(err); s != `operator symbol changes the meaning of existing input: "<-!" is "<" followed by unary ["-" "!"]` {
+		t.Error(s)
+	}
+
+	for _, op := range []string{"+.", "&&&", "*~", "$"} {
+		if err := RegisterOp(op, 4, LeftAssoc, maxNum); err != nil {
+			t.Error(op, err)
+		}
+	}
+	for _, op := range []string{"-.", "$", "~"} {
+		if err := RegisterUnaryOp(op, func(a Num) Num { return a }); err != nil {
+			t.Error(op, err)
+		}
+	}
+	for input, result := range map[string]Num{
+		"1&&&2":  2,
+		"1&&2":   2,
+		"1&2":    0,
+		"1+.2":   2,
+		"1+ 0.2": 1.2,
+		"2*-1":   -2,
+		"x<-1":   0,
+		"!!3":    1,
+		"$2 $ 1": 2,
+		"2*~1":   2,
+		"2* ~3":  6,
+	} {
+		if e, err := Parse(input, map[string]Var{}, map[string]Func{}); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != result {
+			t.Error(input, n, result)
+		}
+	}
+}
+
+func TestOpTable(t *testing.T) {
+	defer resetOps()
+	table, err := DefaultOps().With("~=", 7, LeftAssoc, func(a, b Num) Num {
+		return boolNum(math.Abs(float64(a-b)) < 0.5)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Parser{Ops: table}
+	if e, err := p.Parse("1 ~= 1.2", map[string]Var{}, map[string]Func{}); err != nil {
+		t.Error(err)
+	} else if n := e.Eval(); n != 1 {
+		t.Error(n)
+	}
+	if _, err := Parse("1 ~= 1.2", map[string]Var{}, map[string]Func{}); !errors.Is(err, ErrBadOp) {
+		t.Error(err)
+	}
+	if _, ok := DefaultOps().ops["~="]; ok {
+		t.Error(DefaultOps())
+	}
+
+	// Default table may have a different operator with the same symbol
+	if err := RegisterOp("~=", 7, LeftAssoc, func(a, b Num) Num { return a - b }); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		p *Parser
+		n Num
+	}{{p, 0}, {&Parser{}, 0.5}} {
+		if e, err := test.p.Parse("1.5 ~= 1", map[string]Var{}, map[string]Func{}); err != nil {
+			t.Error(err)
+		} else if n := e.Eval(); n != test.n {
+			t.Error(n, test.n)
+		}
+	}
+	if _, err := table.With("~=", 7, LeftAssoc, maxNum); err != ErrOpExists {
+		t.Error(err)
+	}
+
+	// Definitions are kept in the tables, not shared between them
+	if n := len(DefaultOps().defs); n != 1 {
+		t.Error(n)
+	}
+	if table.custom(table.ops["~="]) == DefaultOps().custom(DefaultOps().ops["~="]) {
+		t.Error(table.defs)
+	}
+}
+
+func TestUnaryOp(t *testing.T) {
+	defer resetOps()
+	if err := RegisterUnaryOp("not", func(a Num) Num { return boolNum(a == 0) }); err != nil {
+		t.Fatal(err)
+	}
+	table, err := DefaultOps().WithUnary("abs", func(a Num) Num { return Num(math.Abs(float64(a))) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table, err = table.WithUnary("√", func(a Num) Num { return Num(math.Sqrt(float64(a))) }); err != nil {
+		t.Fatal(err)
+	}
+	p := &Parser{Ops: table}
+	for input, res := range map[string]Num{
+		"not 0 == 1":      1,
+		"not 1":           0,
+		"not not 5":       1,
+		"not(2 > 3)":      1,
+		"!not 0":          0,
+		"abs -5":          5,
+		"abs(-5)":         5,
+		"abs -2**2":       4,
+		"2 * abs -3 + 1":  7,
+		"-abs 3":          -3,
+		"√16 + √9":        7,
+		"x = -4, abs x":   4,
+		"not abs (1 - 1)": 1,
+	} {
+		if e, err := p.Parse(input, map[string]Var{}, map[string]Func{}); err != nil {
+			t.Error(input, err)
+		} else if n := e.Eval(); n != res {
+			t.Error(input, n, res)
+		} else if s := Format(e); !strings.Contains(input, "=") {
+			// Formatted expression parses back to the same value
+			if e2, err := p.Parse(s, map[string]Var{}, map[string]Func{}); err != nil || e2.Eval() != res {
+				t.Error(input, s, err)
+			}
+		}
+	}
+
+	// Word operators can not be used as names, but other tables don't have them
+	for _, input := range []string{"abs = 1", "x abs", "abs", "2 abs 3"} {
+		if _, err := p.Parse(input, map[string]Var{}, map[string]Func{}); err == nil {
+			t.Error(input)
+		}
+	}
+	if e, err := Parse("abs", map[string]Var{}, map[string]Func{}); err != nil || e.Eval() != 0 {
+		t.Error(err)
+	}
+	not := table.ops["notu"]
+	if s := Format(&unaryExpr{op: not, arg: NewVar(2), def: table.custom(not)}); s != "not 2" {
+		t.Error(s)
+	}
+
+	for _, symbol := range []string{"", "1x", "a+", "(", "_"} {
+		if _, err := table.WithUnary(symbol, func(a Num) Num { return a }); err != ErrBadOpDef {
+			t.Error(symbol, err)
+		}
+	}
+	for _, symbol := range []string{"-", "not", "abs"} {
+		if _, err := table.WithUnary(symbol, func(a Num) Num { return a }); err != ErrOpExists {
+			t.Error(symbol, err)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	defer resetOps()
+	mul, _ := Precedence("*")
+	add, _ := Precedence("+")
+	if mul >= add {
+		t.Error(mul, add)
+	}
+	for symbol, prec := range map[string]int{
+		"**": 1, "!": 2, "~": 0, "%": 3, "//": 3, "×": 3, "÷": 3, "-": 4, "<<": 5, "<=": 6, "!=": 7,
+		"&&": 11, "^^": 12, "?": 14, ":": 14, "+=": 15, ",": 16, "~=": 0, "(": 0,
+	} {
+		if n, ok := Precedence(symbol); n != prec || ok != (prec != 0) {
+			t.Error(symbol, n, ok, prec)
+		}
+	}
+	for symbol, assoc := range map[string]Assoc{
+		"**": RightAssoc, "=": RightAssoc, "!": RightAssoc, ",": RightAssoc,
+		"+": LeftAssoc, "/": LeftAssoc, "==": LeftAssoc, "~=": LeftAssoc,
+	} {
+		if a := Associativity(symbol); a != assoc {
+			t.Error(symbol, a, assoc)
+		}
+	}
+
+	if err := RegisterOp("~=", 7, RightAssoc, maxNum); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := Precedence("~="); n != 7 || !ok || Associativity("~=") != RightAssoc {
+		t.Error(n, ok)
+	}
+	table, _ := DefaultOps().WithUnary("not", func(a Num) Num { return boolNum(a == 0) })
+	if n, ok := table.Precedence("not"); n != 2 || !ok || table.Associativity("not") != RightAssoc {
+		t.Error(n, ok)
+	}
+}
+
+// Should pass with -race
+func TestParseConcurrent(t *testing.T) {
+	defer resetOps()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 20; i++ {
+			if err := RegisterOp(strings.Repeat("~", i), 4, LeftAssoc, maxNum); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				x := NewVar(Num(j))
+				e, err := Parse("x*2 + (x > 50 ? 1 : 0) - sqrt(4)", map[string]Var{"x": x}, Builtins())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if n, want := e.Eval(), Num(j*2-2)+boolNum(j > 50); n != want {
+					t.Error(n, want)
+				}
+				if _, err := Tokenize("1 << 2 ~ 3"); err != nil && !errors.Is(err, ErrBadOp) {
+					t.Error(err)
+				}
+				Format(e)
+			}
+		}()
+	}
+	wg.Wait()
+	if e, err := Parse("1 ~~~ 3", map[string]Var{}, map[string]Func{}); err != nil {
+		t.Error(err)
+	} else if n := e.Eval(); n != 3 {
+		t.Error(n)
+	}
+}
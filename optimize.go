@@ -0,0 +1,325 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Optimize returns an equivalent expression with constant subexpressions
+// evaluated in advance. Variables, assignments and function calls are never
+// folded. Subexpressions that fail to evaluate, like division by zero, are
+// kept as is, so that EvalErr still reports the error.
+func Optimize(e Expr) Expr {
+	return optimize(e, false)
+}
+
+// Simplify returns an equivalent expression with constants folded like
+// Optimize does, and with algebraic identities applied bottom-up:
+// x*1, 1*x, x/1, x**1, x+0, 0+x and x-0 become x, x*0 and 0*x become 0.
+// Multiplication by zero is only simplified if the other operand has no side
+// effects, i.e. contains no assignments or function calls. Note that unlike
+// the original expression, the simplified one gives 0 for Inf*0 and NaN*0.
+func Simplify(e Expr) Expr {
+	return optimize(e, true)
+}
+
+func optimize(e Expr, simplify bool) Expr {
+	switch e := e.(type) {
+	case *unaryExpr:
+		u := *e
+		if u.arg = optimize(e.arg, simplify); isConst(u.arg) {
+			return fold(&u)
+		} else {
+			return &u
+		}
+	case *binaryExpr:
+		a, b := e.a, optimize(e.b, simplify)
+		if e.op != assign {
+			a = optimize(a, simplify)
+		}
+		if e.op != assign && isConst(a) && isConst(b) {
+			return fold(&binaryExpr{op: e.op, a: a, b: b, def: e.def, eps: e.eps})
+		}
+		if simplify && e.def == nil {
+			if res := identity(e.op, a, b); res != nil {
+				return res
+			}
+		}
+		return &binaryExpr{op: e.op, a: a, b: b, def: e.def, eps: e.eps}
+	case *ternaryExpr:
+		cond := optimize(e.cond, simplify)
+		if isConst(cond) {
+			if cond.Eval() != 0 {
+				return optimize(e.a, simplify)
+			}
+			return optimize(e.b, simplify)
+		}
+		return &ternaryExpr{cond: cond, a: optimize(e.a, simplify), b: optimize(e.b, simplify)}
+	case *FuncContext:
+		f := *e
+		f.Args = make([]Expr, len(e.Args))
+		for i, arg := range e.Args {
+			f.Args[i] = optimize(arg, simplify)
+		}
+		return &f
+	}
+	return e
+}
+
+func isConst(e Expr) bool {
+	_, ok := e.(*constExpr)
+	return ok
+}
+
+// Replaces expression with a constant, unless it fails to evaluate
+func fold(e Expr) Expr {
+	if n, err := EvalErr(e); err == nil {
+		return &constExpr{value: n}
+	}
+	return e
+}
+
+func isConstValue(e Expr, n Num) bool {
+	c, ok := e.(*constExpr)
+	return ok && c.value == n
+}
+
+// Applies algebraic identity to the binary operator, returns nil if there is
+// none
+func identity(op arithOp, a, b Expr) Expr {
+	// Identities don't hold for integer operators, or if negative zero is
+	// normalized, e.g. "x+0" is not x for x = -0
+	if op&(intOp|zeroOp) != 0 {
+		return nil
+	}
+	switch op &^ opFlags {
+	case multiply:
+		if isConstValue(b, 1) {
+			return a
+		} else if isConstValue(a, 1) {
+			return b
+		} else if (isConstValue(b, 0) && isPure(a)) || (isConstValue(a, 0) && isPure(b)) {
+			return &constExpr{value: 0}
+		}
+	case divide, power:
+		if isConstValue(b, 1) {
+			return a
+		}
+	case plus:
+		if isConstValue(b, 0) {
+			return a
+		} else if isConstValue(a, 0) {
+			return b
+		}
+	case minus:
+		if isConstValue(b, 0) {
+			return a
+		}
+	}
+	return nil
+}
+
+// Returns true if evaluating the expression has no side effects
+func isPure(e Expr) bool {
+	switch e := e.(type) {
+	case *constExpr, namedVar:
+		return true
+	case *unaryExpr:
+		return isPure(e.arg)
+	case *binaryExpr:
+		return !isAssign(e.op) && isPure(e.a) && isPure(e.b)
+	case *ternaryExpr:
+		return isPure(e.cond) && isPure(e.a) && isPure(e.b)
+	}
+	// Function calls and custom expressions may have side effects
+	return false
+}
+
+// Operators which operands can be swapped
+var commutative = map[arithOp]bool{
+	plus: true, multiply: true, bitwiseAnd: true, bitwiseOr: true, bitwiseXor: true,
+	equals: true, notEquals: true,
+}
+
+// Canonicalize returns an equivalent expression where operands of
+// commutative operators, "+", "*", "&", "|", "^", "==" and "!=", are sorted
+// in a stable order, so that "a+b" and "b+a" become the same expression, see
+// Equal. Operands are only swapped if neither of them has side effects, i.e.
+// contains assignments or function calls. Operators are not regrouped, so
+// "a+b+c" and "c+b+a" remain different.
+func Canonicalize(e Expr) Expr {
+	switch e := e.(type) {
+	case *unaryExpr:
+		return &unaryExpr{op: e.op, arg: Canonicalize(e.arg), def: e.def}
+	case *binaryExpr:
+		a, b := Canonicalize(e.a), Canonicalize(e.b)
+		if e.def == nil && commutative[e.op&^opFlags] && isPure(a) && isPure(b) && Format(b) < Format(a) {
+			a, b = b, a
+		}
+		return &binaryExpr{op: e.op, a: a, b: b, def: e.def, eps: e.eps}
+	case *ternaryExpr:
+		return &ternaryExpr{cond: Canonicalize(e.cond), a: Canonicalize(e.a), b: Canonicalize(e.b)}
+	case *FuncContext:
+		f := *e
+		f.Args = make([]Expr, len(e.Args))
+		for i, arg := range e.Args {
+			f.Args[i] = Canonicalize(arg)
+		}
+		return &f
+	}
+	return e
+}
+
+// CSE returns an equivalent expression where repeated subexpressions are
+// evaluated only once per evaluation, e.g. "sqrt(x) + sqrt(x)*2" becomes
+// "(t = sqrt(x)) + t*2", where t is an unnamed variable. Only functions named
+// in pure are considered to have no side effects. Expressions that contain
+// assignments or calls to other functions are returned as is, since those
+// could change variables between the repeated subexpressions. Temporary
+// variables are shared by all evaluations, so the result must not be
+// evaluated concurrently.
+func CSE(e Expr, pure ...string) Expr {
+	c := &cse{pure: map[string]bool{}, ids: map[Var]int{}, keys: map[Expr]string{},
+		counts: map[string]int{}, temps: map[string]Var{}}
+	for _, name := range pure {
+		c.pure[name] = true
+	}
+	if _, ok := c.key(e); !ok {
+		return e
+	}
+	return c.rewrite(e, map[string]bool{})
+}
+
+// Common subexpression elimination state
+type cse struct {
+	pure map[string]bool
+	ids  map[Var]int
+	// Keys of all operator and function call subexpressions, and the number
+	// of times each key occurs in the expression
+	keys   map[Expr]string
+	counts map[string]int
+	// Temporary variables holding the values of repeated subexpressions
+	temps map[string]Var
+}
+
+// Returns a key that is the same for structurally identical subexpressions,
+// or false if the expression may have side effects
+func (c *cse) key(e Expr) (string, bool) {
+	var k string
+	switch e := e.(type) {
+	case *constExpr:
+		return fmt.Sprint(e.value), true
+	case Var:
+		id, ok := c.ids[e]
+		if !ok {
+			id = len(c.ids)
+			c.ids[e] = id
+		}
+		return fmt.Sprint("$", id), true
+	case *unaryExpr:
+		a, ok := c.key(e.arg)
+		if !ok {
+			return "", false
+		}
+		k = fmt.Sprintf("%d(%s)", e.op, a)
+	case *binaryExpr:
+		if isAssign(e.op) {
+			return "", false
+		}
+		a, ok := c.key(e.a)
+		b, ok2 := c.key(e.b)
+		if !ok || !ok2 {
+			return "", false
+		}
+		k = fmt.Sprintf("%d(%s,%s)", e.op, a, b)
+	case *ternaryExpr:
+		cond, ok := c.key(e.cond)
+		a, ok2 := c.key(e.a)
+		b, ok3 := c.key(e.b)
+		if !ok || !ok2 || !ok3 {
+			return "", false
+		}
+		k = fmt.Sprintf("?(%s,%s,%s)", cond, a, b)
+	case *FuncContext:
+		if !c.pure[e.name] || e.f == nil {
+			return "", false
+		}
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			a, ok := c.key(arg)
+			if !ok {
+				return "", false
+			}
+			args[i] = a
+		}
+		k = e.name + "(" + strings.Join(args, ",") + ")"
+	default:
+		return "", false
+	}
+	c.keys[e] = k
+	c.counts[k]++
+	return k, true
+}
+
+// Replaces repeated subexpressions with temporary variables. The first
+// occurrence assigns the variable, unless it has already been assigned on
+// every path that leads to it, as tracked by the defined set.
+func (c *cse) rewrite(e Expr, defined map[string]bool) Expr {
+	k, ok := c.keys[e]
+	if !ok || c.counts[k] < 2 {
+		return c.rewriteChildren(e, defined)
+	}
+	t := c.temps[k]
+	if t == nil {
+		t = &varExpr{}
+		c.temps[k] = t
+	}
+	if defined[k] {
+		return t
+	}
+	res := c.rewriteChildren(e, defined)
+	defined[k] = true
+	return &binaryExpr{op: assign, a: t, b: res}
+}
+
+func (c *cse) rewriteChildren(e Expr, defined map[string]bool) Expr {
+	// Branches that may not be evaluated get their own copy of the set
+	branch := func(e Expr) (Expr, map[string]bool) {
+		copied := make(map[string]bool, len(defined))
+		for k := range defined {
+			copied[k] = true
+		}
+		return c.rewrite(e, copied), copied
+	}
+	switch e := e.(type) {
+	case *unaryExpr:
+		return &unaryExpr{op: e.op, arg: c.rewrite(e.arg, defined), def: e.def}
+	case *binaryExpr:
+		a := c.rewrite(e.a, defined)
+		if e.op == logicalAnd || e.op == logicalOr {
+			b, _ := branch(e.b)
+			return &binaryExpr{op: e.op, a: a, b: b}
+		}
+		return &binaryExpr{op: e.op, a: a, b: c.rewrite(e.b, defined), def: e.def, eps: e.eps}
+	case *ternaryExpr:
+		cond := c.rewrite(e.cond, defined)
+		a, da := branch(e.a)
+		b, db := branch(e.b)
+		for k := range da {
+			if db[k] {
+				defined[k] = true
+			}
+		}
+		return &ternaryExpr{cond: cond, a: a, b: b}
+	case *FuncContext:
+		// Functions may not evaluate all of their arguments
+		args := make([]Expr, len(e.Args))
+		for i, arg := range e.Args {
+			args[i], _ = branch(arg)
+		}
+		f := *e
+		f.Args = args
+		return &f
+	}
+	return e
+}
@@ -0,0 +1,205 @@
+package expr
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			return c.Args[0].Eval() + 1
+		},
+	}
+	for input, s := range map[string]string{
+		"2+3*4":            "#14",
+		"-(2+3)":           "#-5",
+		"x+2*3":            "<10>({x=5}, #6)",
+		"2*3+x":            "<10>(#6, {x=5})",
+		"f(1+2)":           "fn[#3]",
+		"f(1)+2":           "<10>(fn[#1], #2)",
+		"x=2*3":            "<31>({x=5}, #6)",
+		"1 ? x : 2+3":      "{x=5}",
+		"0 ? x : 2+3":      "#5",
+		"x ? 1+1 : 2+3":    "<29>({x=5}, #2, #5)",
+		"1/0":              "<6>(#1, #0)",
+		"(1/0)+2":          "<10>(<6>(#1, #0), #2)",
+		"1, 2":             "#2",
+		"x=1+1, x*(3-1)":   "<37>(<31>({x=5}, #2), <5>({x=5}, #2))",
+		"!(1>2) && (3!=3)": "#0",
+	} {
+		if e, err := Parse(input, map[string]Var{"x": NewVar(5)}, funcs); err != nil {
+			t.Error(input, err)
+		} else if o := Optimize(e); fmt.Sprint(o) != s {
+			t.Error(input, o, s)
+		} else if e.Eval() != o.Eval() {
+			t.Error(input, e.Eval(), o.Eval())
+		}
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	calls := 0
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			calls++
+			return 3
+		},
+	}
+	for input, s := range map[string]string{
+		"x*0":           "0",
+		"0*x":           "0",
+		"x*1":           "x",
+		"1*x":           "x",
+		"x+0":           "x",
+		"0+x":           "x",
+		"x-0":           "x",
+		"0-x":           "0-x",
+		"x**1":          "x",
+		"1**x":          "1**x",
+		"x/1":           "x",
+		"1/x":           "1/x",
+		"x*(2-1)":       "x",
+		"(x+y*0)*(y-0)": "x*y",
+		"x*0+y":         "y",
+		"-(x*1)":        "-x",
+		"(x*0) ? x : y": "y",
+		"(x+0)*(y*1)":   "x*y",
+		"f()*0":         "f()*0",
+		"0*f()":         "0*f()",
+		"f()*1":         "f()",
+		"f(x*1)":        "f(x)",
+		"(y=2)*0":       "(y=2)*0",
+		"(y=x*1)+0":     "y=x",
+	} {
+		vars := map[string]Var{"x": NewVar(5), "y": NewVar(7)}
+		if e, err := Parse(input, vars, funcs); err != nil {
+			t.Error(input, err)
+		} else if o := Simplify(e); Format(o) != s {
+			t.Error(input, Format(o), s)
+		} else if n := e.Eval(); n != o.Eval() {
+			t.Error(input, n, o.Eval())
+		}
+	}
+	if e, err := Parse("f()*0", map[string]Var{}, funcs); err != nil {
+		t.Error(err)
+	} else if calls = 0; Simplify(e).Eval() != 0 || calls != 1 {
+		t.Error(calls)
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	funcs := map[string]Func{"f": func(c *FuncContext) Num { return c.Arg(0) }}
+	for _, test := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"b+a", "a+b", true},
+		{"b*a", "a*b", true},
+		{"(y|x) & (b^a)", "(a^b) & (x|y)", true},
+		{"x == 2", "2 == x", true},
+		{"a != -b", "-b != a", true},
+		{"2*(y+x)", "(x+y)*2", true},
+		{"f(b+a)", "f(a+b)", true},
+		{"c ? b*a : 1", "c ? a*b : 1", true},
+		{"b-a", "a-b", false},
+		{"b/a", "a/b", false},
+		{"b<a", "a<b", false},
+		{"b && a", "a && b", false},
+		{"a+b+c", "c+b+a", false},
+		// Operands with side effects keep their order
+		{"f(b)+a", "a+f(b)", false},
+		{"(b=1)*b", "b*(b=1)", false},
+	} {
+		vars := map[string]Var{}
+		a, err := Parse(test.a, vars, funcs)
+		if err != nil {
+			t.Fatal(test.a, err)
+		}
+		b, err := Parse(test.b, vars, funcs)
+		if err != nil {
+			t.Fatal(test.b, err)
+		}
+		ca, cb := Canonicalize(a), Canonicalize(b)
+		if Equal(ca, cb) != test.equal {
+			t.Error(test.a, test.b, Format(ca), Format(cb))
+		}
+		if Format(Canonicalize(ca)) != Format(ca) {
+			t.Error(test.a, Format(ca))
+		}
+		for name, v := range vars {
+			v.Set(Num(len(name)) + 0.5)
+		}
+		if x, y := a.Eval(), ca.Eval(); x != y {
+			t.Error(test.a, x, y)
+		}
+	}
+}
+
+func TestCSE(t *testing.T) {
+	calls := 0
+	funcs := Builtins()
+	funcs["sq"] = func(c *FuncContext) Num {
+		calls++
+		x := c.Arg(0)
+		return x * x
+	}
+	for _, test := range []struct {
+		input string
+		// Number of calls for each value of x
+		calls [3]int
+	}{
+		{"sq(x)+sq(x)*2", [3]int{1, 1, 1}},
+		{"sq(x+1) - sq(x + 1) + sq(x)", [3]int{2, 2, 2}},
+		// Arguments are evaluated separately from the rest of the expression
+		{"sq(sq(x)) + sq(sq(x)) + sq(x)", [3]int{3, 3, 3}},
+		{"sq(x) + sq(sq(x)) + sq(sq(x))", [3]int{2, 2, 2}},
+		{"sq(x) > 1 && sq(x) < 5", [3]int{1, 1, 1}},
+		{"x > 0 && sq(x) > 0, sq(x)", [3]int{1, 1, 2}},
+		{"x > 0 ? sq(x) : sq(x) + 1", [3]int{1, 1, 1}},
+		{"(x > 0 ? sq(x) : -sq(x)) + sq(x)", [3]int{1, 1, 1}},
+		{"(x > 0 ? sq(x) : 0) + sq(x)", [3]int{1, 1, 2}},
+		{"max(sq(x), 1) + max(sq(x), 1)", [3]int{1, 1, 1}},
+		{"if(x, sq(x), 0) + sq(x)", [3]int{2, 1, 2}},
+		{"sq(x) + sq(y)", [3]int{2, 2, 2}},
+		// Assignments and impure functions are left as is
+		{"y = sq(x) + sq(x)", [3]int{2, 2, 2}},
+		{"sq(x) + sq(x) + rand(1)", [3]int{2, 2, 2}},
+	} {
+		x := NewVar(0)
+		vars := map[string]Var{"x": x, "y": NewVar(3)}
+		funcs["rand"] = func(c *FuncContext) Num { return 0 }
+		e, err := Parse(test.input, vars, funcs)
+		if err != nil {
+			t.Fatal(test.input, err)
+		}
+		o := CSE(e, "sq", "max", "if")
+		for i, n := range []Num{-1, 0, 2} {
+			x.Set(n)
+			calls = 0
+			res := o.Eval()
+			if calls != test.calls[i] {
+				t.Error(test.input, n, calls, test.calls[i])
+			}
+			if expected := e.Eval(); res != expected {
+				t.Error(test.input, n, res, expected)
+			}
+		}
+	}
+
+	// Functions that are not known to be pure are called every time
+	e, _ := Parse("sq(x)+sq(x)*2", map[string]Var{"x": NewVar(3)}, funcs)
+	if calls = 0; CSE(e).Eval() != 27 || calls != 2 {
+		t.Error(calls)
+	}
+	if calls = 0; Compile(CSE(e, "sq"))() != 27 || calls != 1 {
+		t.Error(calls)
+	}
+
+	// Rewritten calls keep the source text of their arguments
+	funcs["width"] = func(c *FuncContext) Num { return Num(len(c.RawArg(0))) }
+	e, _ = Parse("width(x + 1) + width(x + 1)", map[string]Var{"x": NewVar(3)}, funcs)
+	if n := CSE(e, "width").Eval(); n != 10 {
+		t.Error(n)
+	}
+}
@@ -0,0 +1,72 @@
+package expr
+
+// TokenKind tells what kind of lexical element the token is
+type TokenKind int
+
+const (
+	TokenNumber TokenKind = iota + 1
+	TokenWord
+	TokenOp
+	TokenOpen
+	TokenClose
+	TokenString
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenNumber:
+		return "number"
+	case TokenWord:
+		return "word"
+	case TokenOp:
+		return "op"
+	case TokenOpen:
+		return "open"
+	case TokenClose:
+		return "close"
+	case TokenString:
+		return "string"
+	}
+	return "unknown"
+}
+
+// Token is a lexical element of the input. Words are identifiers of
+// variables, functions or constants. Text is the token as it appears in the
+// input, Pos and End are the offsets in runes of its first character and
+// right after its last one.
+type Token struct {
+	Kind TokenKind
+	Text string
+	Pos  int
+	End  int
+}
+
+// Tokenize splits the input into tokens, skipping whitespace and comments.
+// Returned error is a *ParseError. Parse errors have the same token offsets
+// and report the index of the offending token in the returned slice, or the
+// number of tokens if the error is at the end of the input.
+func Tokenize(input string) ([]Token, error) {
+	tokens, err := tokenize([]rune(input), DefaultOps())
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Token, len(tokens))
+	for i, t := range tokens {
+		res[i] = Token{Text: t.source(), Pos: t.pos, End: t.end}
+		switch t.kind {
+		case tokNumber:
+			res[i].Kind = TokenNumber
+		case tokWord:
+			res[i].Kind = TokenWord
+		case tokOp:
+			res[i].Kind = TokenOp
+		case tokOpen:
+			res[i].Kind = TokenOpen
+		case tokClose:
+			res[i].Kind = TokenClose
+		case tokString:
+			res[i].Kind = TokenString
+		}
+	}
+	return res, nil
+}
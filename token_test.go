@@ -0,0 +1,76 @@
+package expr
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPublicTokenize(t *testing.T) {
+	tokens, err := Tokenize(`x=-0xFF + f(2.5e3, "a b") # comment`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Token{
+		{TokenWord, "x", 0, 1},
+		{TokenOp, "=", 1, 2},
+		{TokenOp, "-", 2, 3},
+		{TokenNumber, "0xFF", 3, 7},
+		{TokenOp, "+", 8, 9},
+		{TokenWord, "f", 10, 11},
+		{TokenOpen, "(", 11, 12},
+		{TokenNumber, "2.5e3", 12, 17},
+		{TokenOp, ",", 17, 18},
+		{TokenString, `"a b"`, 19, 24},
+		{TokenClose, ")", 24, 25},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatal(tokens)
+	}
+	for i, tok := range tokens {
+		if tok != expected[i] {
+			t.Error(i, tok, expected[i])
+		}
+	}
+
+	if tokens, err := Tokenize(""); err != nil || len(tokens) != 0 {
+		t.Error(tokens, err)
+	}
+	if tokens, err := Tokenize("[1][0]"); err != nil || len(tokens) != 6 || tokens[2].Kind != TokenClose || tokens[3].Kind != TokenOpen {
+		t.Error(tokens, err)
+	}
+	var pe *ParseError
+	if _, err := Tokenize(`1 + "abc`); !errors.As(err, &pe) || pe.Err != ErrBadString || pe.Pos != 4 {
+		t.Error(err)
+	}
+	if s := TokenString.String(); s != "string" {
+		t.Error(s)
+	}
+}
+
+func TestTokenOffsets(t *testing.T) {
+	input := "12 + foo"
+	tokens, err := Tokenize(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runes := []rune(input)
+	for i, s := range []string{"12", "+", "foo"} {
+		if tok := tokens[i]; tok.Text != s || string(runes[tok.Pos:tok.End]) != s {
+			t.Error(i, tok, s)
+		}
+	}
+	if tokens[0].Pos != 0 || tokens[1].Pos != 3 || tokens[2].Pos != 5 || tokens[2].End != 8 {
+		t.Error(tokens)
+	}
+
+	// Parse errors refer to the tokens
+	var pe *ParseError
+	if _, err := Parse("12 + foo)", map[string]Var{}, map[string]Func{}); !errors.As(err, &pe) {
+		t.Error(err)
+	} else if tokens, _ := Tokenize("12 + foo)"); pe.Index != 3 || tokens[pe.Index].Pos != pe.Pos || tokens[pe.Index].End != pe.End {
+		t.Error(pe, tokens)
+	}
+	if tokens, err := Tokenize("ωω + 1"); err != nil || tokens[0].End != 2 || tokens[1].Pos != 3 {
+		t.Error(tokens, err)
+	}
+}
@@ -0,0 +1,194 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrTypeMismatch = errors.New("type mismatch")
+
+// StrVar is a mutable string variable that can be used in typed expressions
+type StrVar interface {
+	SetStr(value string)
+	Str() string
+}
+type strVar struct {
+	value string
+}
+
+func NewStrVar(value string) StrVar {
+	return &strVar{value: value}
+}
+func (v *strVar) SetStr(value string) {
+	v.value = value
+}
+func (v *strVar) Str() string {
+	return v.value
+}
+
+// Value is the result of a typed expression, either a number or a string
+type Value struct {
+	Num   Num
+	Str   string
+	IsStr bool
+}
+
+func (v Value) String() string {
+	if v.IsStr {
+		return fmt.Sprintf("%q", v.Str)
+	}
+	return fmt.Sprintf("%v", v.Num)
+}
+
+// TypedExpr is an expression that may evaluate to either a number or a string
+type TypedExpr interface {
+	EvalTyped() Value
+}
+
+type typedExpr struct {
+	e   Expr
+	str bool
+}
+
+func (e *typedExpr) EvalTyped() Value {
+	if e.str {
+		return Value{Str: strValue(e.e), IsStr: true}
+	}
+	return Value{Num: e.e.Eval()}
+}
+func (e *typedExpr) String() string {
+	return fmt.Sprintf("%v", e.e)
+}
+
+// String constant expression, as well as string variable expression, can only
+// be evaluated with strValue, numeric value is always zero
+type strExpr struct {
+	value string
+}
+
+func (e *strExpr) Eval() Num {
+	return 0
+}
+func (e *strExpr) String() string {
+	return fmt.Sprintf("%q", e.value)
+}
+
+type strVarExpr struct {
+	v    StrVar
+	name string
+}
+
+func (e *strVarExpr) Eval() Num {
+	return 0
+}
+func (e *strVarExpr) String() string {
+	return fmt.Sprintf("{%s=%q}", e.name, e.v.Str())
+}
+
+// String comparison expression returns 1 or 0, like numeric comparisons do
+type strCompareExpr struct {
+	op arithOp
+	a  Expr
+	b  Expr
+}
+
+func (e *strCompareExpr) Eval() Num {
+	return boolNum((strValue(e.a) == strValue(e.b)) == (e.op == equals))
+}
+func (e *strCompareExpr) String() string {
+	return fmt.Sprintf("<%v>(%v, %v)", e.op, e.a, e.b)
+}
+
+// Evaluates expression that has been type checked to be a string
+func strValue(e Expr) string {
+	switch e := e.(type) {
+	case *strExpr:
+		return e.value
+	case *strVarExpr:
+		return e.v.Str()
+	case *ternaryExpr:
+		if e.cond.Eval() != 0 {
+			return strValue(e.a)
+		}
+		return strValue(e.b)
+	case *binaryExpr:
+		// Only comma operator may result in a string
+		e.a.Eval()
+		return strValue(e.b)
+	}
+	return ""
+}
+
+// ParseTyped parses expression that may contain string literals in double
+// quotes and string variables from strs, in addition to numbers and numeric
+// variables. Strings can only be compared with "==" and "!=", or be the
+// result of the whole expression. Other uses of strings, such as adding them
+// or passing them to functions, return ErrTypeMismatch.
+func ParseTyped(input string, vars map[string]Var, strs map[string]StrVar,
+	funcs map[string]Func) (TypedExpr, error) {
+	p := &parser{vars: vars, funcs: funcs, typed: true, strs: strs}
+	e, err := p.parse(input)
+	if err != nil {
+		return nil, err
+	}
+	e, str, err := typecheck(e)
+	if err != nil {
+		return nil, inputError(input, err)
+	}
+	return &typedExpr{e: e, str: str}, nil
+}
+
+// Checks that strings are only used where allowed and replaces string
+// comparisons with strCompareExpr. Returns whether the expression is a string.
+func typecheck(e Expr) (Expr, bool, error) {
+	num := func(e Expr) (Expr, error) {
+		e, str, err := typecheck(e)
+		if err == nil && str {
+			err = ErrTypeMismatch
+		}
+		return e, err
+	}
+	var err error
+	switch e := e.(type) {
+	case *strExpr, *strVarExpr:
+		return e, true, nil
+	case *unaryExpr:
+		e.arg, err = num(e.arg)
+		return e, false, err
+	case *ternaryExpr:
+		var a, b bool
+		if e.cond, err = num(e.cond); err != nil {
+			return nil, false, err
+		} else if e.a, a, err = typecheck(e.a); err != nil {
+			return nil, false, err
+		} else if e.b, b, err = typecheck(e.b); err != nil {
+			return nil, false, err
+		} else if a != b {
+			return nil, false, ErrTypeMismatch
+		}
+		return e, a, nil
+	case *binaryExpr:
+		var a, b bool
+		if e.a, a, err = typecheck(e.a); err != nil {
+			return nil, false, err
+		} else if e.b, b, err = typecheck(e.b); err != nil {
+			return nil, false, err
+		}
+		switch {
+		case e.op == comma:
+			return e, b, nil
+		case (e.op == equals || e.op == notEquals) && a && b:
+			return &strCompareExpr{op: e.op, a: e.a, b: e.b}, false, nil
+		case a || b:
+			return nil, false, ErrTypeMismatch
+		}
+		return e, false, nil
+	case *FuncContext:
+		for i, arg := range e.Args {
+			if e.Args[i], err = num(arg); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	return e, false, nil
+}
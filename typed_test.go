@@ -0,0 +1,92 @@
+package expr
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseTyped(t *testing.T) {
+	vars := map[string]Var{"x": NewVar(5)}
+	strs := map[string]StrVar{"status": NewStrVar("active")}
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			return 1
+		},
+	}
+	for input, v := range map[string]Value{
+		`2+3`:                           {Num: 5},
+		`"foo"`:                         {Str: "foo", IsStr: true},
+		`"a\"b\\c\n"`:                   {Str: "a\"b\\c\n", IsStr: true},
+		`"Ünïcode"`:                     {Str: "Ünïcode", IsStr: true},
+		`status`:                        {Str: "active", IsStr: true},
+		`status == "active"`:            {Num: 1},
+		`status != "active"`:            {Num: 0},
+		`"active" == status && x > 1`:   {Num: 1},
+		`status == "inactive" ? 1 : 2`:  {Num: 2},
+		`x > 1 ? "big" : "small"`:       {Str: "big", IsStr: true},
+		`z = 2, "foo"`:                  {Str: "foo", IsStr: true},
+		`"a" == "b" || f(x)`:            {Num: 1},
+		`("a" == "a") + ("a" != "b")`:   {Num: 2},
+		`(status == "active") * x`:      {Num: 5},
+		`!(status == "")`:               {Num: 1},
+		`"" == ""`:                      {Num: 1},
+		`status == "active" ? x : 0`:    {Num: 5},
+		`"x" == ("y", "x")`:             {Num: 1},
+		`y = status == "active", y * 3`: {Num: 3},
+	} {
+		if e, err := ParseTyped(input, vars, strs, funcs); err != nil {
+			t.Error(input, err)
+		} else if res := e.EvalTyped(); res != v {
+			t.Error(input, res, v)
+		}
+	}
+
+	// String variables are evaluated every time
+	e, err := ParseTyped(`status == "active"`, vars, strs, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs["status"].SetStr("disabled")
+	if res := e.EvalTyped(); res.Num != 0 {
+		t.Error(res)
+	}
+}
+
+func TestParseTypedError(t *testing.T) {
+	vars := map[string]Var{"x": NewVar(5)}
+	strs := map[string]StrVar{"s": NewStrVar("")}
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			return 1
+		},
+	}
+	for input, e := range map[string]error{
+		`"a" == 1`:          ErrTypeMismatch,
+		`x != s`:            ErrTypeMismatch,
+		`"a" + "b"`:         ErrTypeMismatch,
+		`s < "b"`:           ErrTypeMismatch,
+		`-s`:                ErrTypeMismatch,
+		`f(s)`:              ErrTypeMismatch,
+		`s ? 1 : 2`:         ErrTypeMismatch,
+		`x ? "a" : 2`:       ErrTypeMismatch,
+		`x = "a"`:           ErrTypeMismatch,
+		`s = "a"`:           ErrBadVar,
+		`"abc`:              ErrBadString,
+		`"\q"`:              ErrBadString,
+		`"a" "b"`:           ErrUnexpectedString,
+		`x"b"`:              ErrUnexpectedString,
+		`"a" == "b" == "c"`: ErrTypeMismatch,
+	} {
+		if expr, err := ParseTyped(input, vars, strs, funcs); !errors.Is(err, e) {
+			t.Error(input, expr, err, e)
+		}
+	}
+
+	// Numeric expressions do not support strings
+	if _, err := Parse(`"foo"`, vars, funcs); !errors.Is(err, ErrUnexpectedString) {
+		t.Error(err)
+	}
+	if _, err := Parse(`s`, map[string]Var{}, funcs); err != nil {
+		t.Error(err)
+	}
+}
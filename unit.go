@@ -0,0 +1,336 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+var ErrDimension = errors.New("dimension mismatch")
+
+// Dim is the dimension of a value, base unit names mapped to their exponents,
+// like {"m": 1, "s": -1} for velocity. Empty or nil Dim is dimensionless.
+type Dim map[string]int
+
+// Returns the dimension of the product, or of the quotient if sign is -1
+func (d Dim) mul(other Dim, sign int) Dim {
+	res := Dim{}
+	for name, n := range d {
+		res[name] = n
+	}
+	for name, n := range other {
+		if res[name] += n * sign; res[name] == 0 {
+			delete(res, name)
+		}
+	}
+	return res
+}
+
+// Equal returns true if both dimensions have the same exponents
+func (d Dim) Equal(other Dim) bool {
+	for name, n := range d {
+		if other[name] != n {
+			return false
+		}
+	}
+	for name, n := range other {
+		if d[name] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the dimension like "kg*m/s**2", or "1" if it's
+// dimensionless
+func (d Dim) String() string {
+	var num, den []string
+	names := make([]string, 0, len(d))
+	for name, n := range d {
+		if n != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n, s := d[name], name
+		if n < 0 {
+			n = -n
+		}
+		if n != 1 {
+			s = fmt.Sprintf("%s**%d", name, n)
+		}
+		if d[name] > 0 {
+			num = append(num, s)
+		} else {
+			den = append(den, s)
+		}
+	}
+	res := strings.Join(num, "*")
+	if res == "" {
+		res = "1"
+	}
+	if len(den) > 1 {
+		res = res + "/(" + strings.Join(den, "*") + ")"
+	} else if len(den) == 1 {
+		res = res + "/" + den[0]
+	}
+	return res
+}
+
+// Unit is a named unit of measurement, Scale times the base units of Dim
+type Unit struct {
+	Scale Num
+	Dim   Dim
+}
+
+// BaseUnit returns the unit that is its own dimension, like "m" for length
+func BaseUnit(name string) Unit {
+	return Unit{Scale: 1, Dim: Dim{name: 1}}
+}
+
+// SIUnits returns a new map of the SI base units "m", "kg", "s", "A", "K",
+// "mol" and "cd", a few multiples, "km", "cm", "mm", "g" and "h", and derived
+// units "N", "J", "W", "Pa" and "Hz". The map can be extended with custom
+// units and passed to ParseUnits.
+func SIUnits() map[string]Unit {
+	units := map[string]Unit{}
+	for _, name := range []string{"m", "kg", "s", "A", "K", "mol", "cd"} {
+		units[name] = BaseUnit(name)
+	}
+	scaled := func(scale Num, name string) Unit {
+		return Unit{Scale: scale, Dim: units[name].Dim}
+	}
+	units["km"] = scaled(1000, "m")
+	units["cm"] = scaled(0.01, "m")
+	units["mm"] = scaled(0.001, "m")
+	units["g"] = scaled(0.001, "kg")
+	units["h"] = scaled(3600, "s")
+	units["N"] = Unit{Scale: 1, Dim: Dim{"kg": 1, "m": 1, "s": -2}}
+	units["J"] = Unit{Scale: 1, Dim: Dim{"kg": 1, "m": 2, "s": -2}}
+	units["W"] = Unit{Scale: 1, Dim: Dim{"kg": 1, "m": 2, "s": -3}}
+	units["Pa"] = Unit{Scale: 1, Dim: Dim{"kg": 1, "m": -1, "s": -2}}
+	units["Hz"] = Unit{Scale: 1, Dim: Dim{"s": -1}}
+	return units
+}
+
+// UnitExpr is an expression which value has a dimension. Eval returns the
+// value in the base units, so "2*km" is 2000 with dimension "m".
+type UnitExpr interface {
+	Expr
+	Dim() Dim
+}
+
+type unitResult struct {
+	Expr
+	dim Dim
+}
+
+func (e *unitResult) Dim() Dim {
+	return e.dim
+}
+func (e *unitResult) String() string {
+	return fmt.Sprintf("%v", e.Expr)
+}
+
+// Unit expression evaluates to the scale of the unit
+type unitExpr struct {
+	unit Unit
+	name string
+}
+
+func (e *unitExpr) Eval() Num {
+	return e.unit.Scale
+}
+func (e *unitExpr) String() string {
+	return fmt.Sprintf("[%s]", e.name)
+}
+
+// Functions which arguments and result have the same dimension, all other
+// functions only accept and return dimensionless values
+var unitFuncs = map[string]bool{
+	"abs": true, "floor": true, "ceil": true, "round": true,
+	"min": true, "max": true, "sum": true, "clamp": true,
+}
+
+// ParseUnits parses expression where identifiers from units are units of
+// measurement, in addition to everything Parse supports. Units are multiplied
+// explicitly, like "9.8*m/s**2", as "2m" is not a valid expression. Units
+// can't be assigned and take precedence over variables and constants.
+// Dimensions are checked when the expression is parsed: "+", "-",
+// comparisons and other operators that combine their operands require the
+// same dimension on both sides, "*" and "/" combine the dimensions, "**"
+// requires a dimensionless base or an integer constant exponent, like "-2".
+// Numbers are dimensionless, and so are variables, unless their first use is
+// an assignment that gives them the dimension of the value. Functions abs,
+// floor, ceil, round, min, max, sum and clamp keep the dimension of their
+// arguments, "sqrt" takes the square root of the dimension, and all other
+// functions only accept dimensionless arguments. Dimension errors wrap
+// ErrDimension, so "2*m + 3*s" fails.
+func ParseUnits(input string, vars map[string]Var, units map[string]Unit,
+	funcs map[string]Func) (UnitExpr, error) {
+	p := &parser{vars: vars, funcs: funcs, units: units}
+	e, err := p.parse(input)
+	if err != nil {
+		return nil, err
+	}
+	c := &unitChecker{vars: map[Var]Dim{}}
+	dim, err := c.check(e)
+	if err != nil {
+		return nil, inputError(input, err)
+	}
+	return &unitResult{Expr: e, dim: dim}, nil
+}
+
+// Computes dimensions of the expressions, variables that are assigned are
+// mapped to the dimension of their values
+type unitChecker struct {
+	vars map[Var]Dim
+}
+
+// Returns the dimension of the expression, or an error if its operands have
+// incompatible dimensions
+func (c *unitChecker) check(e Expr) (Dim, error) {
+	switch e := e.(type) {
+	case *unitExpr:
+		return e.unit.Dim, nil
+	case namedVar:
+		dim, ok := c.vars[e]
+		if !ok {
+			// Variable that is read before it is assigned is dimensionless
+			c.vars[e] = nil
+		}
+		return dim, nil
+	case *unaryExpr:
+		dim, err := c.check(e.arg)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op &^ opFlags {
+		case unaryMinus:
+			return dim, nil
+		case unaryLogicalNot:
+			return nil, nil
+		}
+		return nil, c.same(dim, nil)
+	case *binaryExpr:
+		return c.checkBinary(e)
+	case *ternaryExpr:
+		if _, err := c.check(e.cond); err != nil {
+			return nil, err
+		}
+		a, err := c.check(e.a)
+		if err != nil {
+			return nil, err
+		}
+		b, err := c.check(e.b)
+		if err != nil {
+			return nil, err
+		}
+		return a, c.same(a, b)
+	case *FuncContext:
+		var dim Dim
+		for i, arg := range e.Args {
+			d, err := c.check(arg)
+			if err != nil {
+				return nil, err
+			} else if i == 0 {
+				dim = d
+			} else if err := c.same(dim, d); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case unitFuncs[e.name]:
+			return dim, nil
+		case e.name == "sqrt" && len(e.Args) == 1:
+			res := Dim{}
+			for name, n := range dim {
+				if n%2 != 0 {
+					return nil, fmt.Errorf("%w: sqrt of %v", ErrDimension, dim)
+				}
+				res[name] = n / 2
+			}
+			return res, nil
+		}
+		return nil, c.same(dim, nil)
+	}
+	return nil, nil
+}
+
+func (c *unitChecker) checkBinary(e *binaryExpr) (Dim, error) {
+	if v, ok := e.a.(Var); ok && e.op&^opFlags == assign {
+		b, err := c.check(e.b)
+		if err != nil {
+			return nil, err
+		} else if dim, ok := c.vars[v]; ok && !dim.Equal(b) {
+			return nil, fmt.Errorf("%w: %v assigned to %v", ErrDimension, b, dim)
+		}
+		c.vars[v] = b
+		return b, nil
+	}
+	a, err := c.check(e.a)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.check(e.b)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op &^ opFlags {
+	case comma:
+		return b, nil
+	case multiply:
+		return a.mul(b, 1), nil
+	case divide, floorDivide:
+		return a.mul(b, -1), nil
+	case power:
+		n, ok := constValue(e.b)
+		if len(a) == 0 {
+			return nil, c.same(b, nil)
+		} else if !ok || n != Num(math.Trunc(float64(n))) {
+			return nil, fmt.Errorf("%w: %v raised to a non-integer power", ErrDimension, a)
+		}
+		res := Dim{}
+		for name, exp := range a {
+			if n != 0 {
+				res[name] = exp * int(n)
+			}
+		}
+		return res, nil
+	case plus, minus, remainder, modulo, minimum, maximum, logicalAnd, logicalOr, logicalXor:
+		return a, c.same(a, b)
+	case lessThan, lessOrEquals, greaterThan, greaterOrEquals, compare, equals, notEquals:
+		return nil, c.same(a, b)
+	}
+	// Bitwise and custom operators only accept dimensionless operands
+	if err := c.same(a, nil); err != nil {
+		return nil, err
+	}
+	return nil, c.same(b, nil)
+}
+
+// Returns the value of a constant expression, negative constants like "-1"
+// are parsed as unary minus applied to a number
+func constValue(e Expr) (Num, bool) {
+	switch e := e.(type) {
+	case *constExpr:
+		return e.value, true
+	case *unaryExpr:
+		if e.op&^opFlags == unaryMinus {
+			n, ok := constValue(e.arg)
+			return -n, ok
+		}
+	}
+	return 0, false
+}
+
+// Returns an error if the dimensions are different
+func (c *unitChecker) same(a, b Dim) error {
+	if !a.Equal(b) {
+		return fmt.Errorf("%w: %v and %v", ErrDimension, a, b)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package expr
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseUnits(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		n     Num
+		dim   string
+	}{
+		{"2*m + 3*m", 5, "m"},
+		{"2*km + 300*m", 2300, "m"},
+		{"(10*m)/(2*s)", 5, "m/s"},
+		{"m/s", 1, "m/s"},
+		{"9.8*m/s**2", 9.8, "m/s**2"},
+		{"3*N*2*m == 6*J", 1, "1"},
+		{"(4*m)**2", 16, "m**2"},
+		{"m**0 + 1", 2, "1"},
+		{"2**3", 8, "1"},
+		{"sqrt(16*m**2)", 4, "m"},
+		{"abs(-2*m) < 3*m", 1, "1"},
+		{"max(1*m, 20*cm, 3*mm)", 1, "m"},
+		{"-2*kg", -2, "kg"},
+		{"v = 36*km/h, t = 10*s, v*t", 100, "m"},
+		{"x = 2*m, x += 3*m, x", 5, "m"},
+		{"1*m > 0*m ? 2*s : 3*s", 2, "s"},
+		{"1/s", 1, "1/s"},
+		{"1/(m*s)", 1, "1/(m*s)"},
+		{"W*h/J", 3600, "1"},
+		{"sin(0) + 1", 1, "1"},
+		{"2*s**-1", 2, "1/s"},
+		{"(2*m)**-2", 0.25, "1/m**2"},
+		{"m**-(-2)", 1, "m**2"},
+	} {
+		e, err := ParseUnits(test.input, map[string]Var{}, SIUnits(), Builtins())
+		if err != nil {
+			t.Error(test.input, err)
+			continue
+		}
+		if n := e.Eval(); n != test.n {
+			t.Error(test.input, n, test.n)
+		}
+		if dim := e.Dim().String(); dim != test.dim {
+			t.Error(test.input, dim, test.dim)
+		}
+	}
+}
+
+func TestParseUnitsError(t *testing.T) {
+	for input, e := range map[string]error{
+		"2*m + 3*s":           ErrDimension,
+		"2*m + 3":             ErrDimension,
+		"m < s":               ErrDimension,
+		"m**0.5":              ErrDimension,
+		"m**-0.5":             ErrDimension,
+		"2m + 3s":             ErrUnexpectedIdentifier,
+		"2**m":                ErrDimension,
+		"m ? s : m":           ErrDimension,
+		"sin(m)":              ErrDimension,
+		"sqrt(m)":             ErrDimension,
+		"max(m, s)":           ErrDimension,
+		"m & 1":               ErrDimension,
+		"x = m, x = s":        ErrDimension,
+		"x + 1, x = m":        ErrDimension,
+		"m = 2":               ErrBadVar,
+		"2*m +":               ErrOperandMissing,
+		"1*m > 0*m ? 2*s : 3": ErrDimension,
+	} {
+		if res, err := ParseUnits(input, map[string]Var{}, SIUnits(), Builtins()); !errors.Is(err, e) {
+			t.Error(input, res, err, e)
+		}
+	}
+
+	// Errors describe the dimensions
+	_, err := ParseUnits("10*N + 2*m/s", map[string]Var{}, SIUnits(), Builtins())
+	if s := err.Error(); s != `expr "10*N + 2*m/s": dimension mismatch: kg*m/s**2 and m/s` {
+		t.Error(s)
+	}
+
+	// Units are not known to other parsers
+	e, err := Parse("2*m + 3*s", map[string]Var{}, Builtins())
+	if err != nil || e.Eval() != 0 {
+		t.Error(e, err)
+	}
+}
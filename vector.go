@@ -0,0 +1,191 @@
+package expr
+
+import "fmt"
+
+// VecExpr is an expression that may evaluate to a vector of numbers
+type VecExpr interface {
+	// EvalVec returns the elements of the vector, or a single element if the
+	// expression is a number
+	EvalVec() []Num
+}
+
+type vecResult struct {
+	e   Expr
+	vec bool
+}
+
+func (e *vecResult) EvalVec() []Num {
+	if e.vec {
+		return vecValue(e.e)
+	}
+	return []Num{e.e.Eval()}
+}
+func (e *vecResult) String() string {
+	return fmt.Sprintf("%v", e.e)
+}
+
+// Vector literal expression can only be evaluated with vecValue, numeric
+// value is always zero
+type vecExpr struct {
+	items []Expr
+}
+
+func (e *vecExpr) Eval() Num {
+	return 0
+}
+func (e *vecExpr) String() string {
+	return fmt.Sprintf("%v", e.items)
+}
+
+// Returns the expression of the vector element at the given index. Only the
+// selected element is evaluated, index that is not an integer or is out of
+// range selects 0. "[a, b][i]" becomes "(t = i) == 0 ? a : t == 1 ? b : 0".
+func (e *vecExpr) index(i Expr) Expr {
+	if c, ok := i.(*constExpr); ok {
+		for n, item := range e.items {
+			if c.value == Num(n) {
+				return item
+			}
+		}
+		return &constExpr{}
+	}
+	if len(e.items) == 0 {
+		return &binaryExpr{op: comma, a: i, b: &constExpr{}}
+	}
+	t, first := i, i
+	if _, ok := i.(namedVar); !ok {
+		t = &varExpr{}
+		first = &binaryExpr{op: assign, a: t, b: i}
+	}
+	var res Expr = &constExpr{}
+	for n := len(e.items) - 1; n >= 0; n-- {
+		cond := &binaryExpr{op: equals, a: t, b: &constExpr{value: Num(n)}}
+		if n == 0 {
+			cond.a = first
+		}
+		res = &ternaryExpr{cond: cond, a: e.items[n], b: res}
+	}
+	return res
+}
+
+// Returns a copy of the table with the vector index operator "@", unless the
+// table already has one
+func withIndex(t *OpTable) *OpTable {
+	if _, ok := t.ops["@"]; ok {
+		return t
+	}
+	ops := make(map[string]arithOp, len(t.ops)+1)
+	for s, op := range t.ops {
+		ops[s] = op
+	}
+	ops["@"] = index
+	res := newOpTable(ops)
+	res.defs = t.defs
+	return res
+}
+
+// Replaces vector arguments of a function with their elements, so that
+// "sum([1, 2], 3)" is the same as "sum(1, 2, 3)"
+func spread(args []Expr) []Expr {
+	res := make([]Expr, 0, len(args))
+	for _, arg := range args {
+		if v, ok := arg.(*vecExpr); ok {
+			res = append(res, v.items...)
+		} else {
+			res = append(res, arg)
+		}
+	}
+	return res
+}
+
+// Evaluates expression that has been checked to be a vector
+func vecValue(e Expr) []Num {
+	switch e := e.(type) {
+	case *vecExpr:
+		res := make([]Num, len(e.items))
+		for i, item := range e.items {
+			res[i] = item.Eval()
+		}
+		return res
+	case *ternaryExpr:
+		if e.cond.Eval() != 0 {
+			return vecValue(e.a)
+		}
+		return vecValue(e.b)
+	case *binaryExpr:
+		// Only comma operator may result in a vector
+		e.a.Eval()
+		return vecValue(e.b)
+	}
+	return nil
+}
+
+// ParseVector parses expression that may contain vectors of numbers in
+// square brackets, like "[1, x, 2*x]", in addition to everything Parse
+// supports. Vector elements are selected by index starting from 0, like
+// "[10, 20, 30][1]" or "[10, 20, 30] @ 1", where "@" binds tighter than any
+// other operator, and vectors passed to functions are expanded into
+// separate arguments, so "sum([1, 2, 3])" is 6 and "len([1, 2, 3])" is 3.
+// Vectors can also be the result of the whole expression, other uses of
+// vectors, such as adding them or nesting them, return ErrTypeMismatch.
+// Operator "@" is not recognized by other parsers and can be registered with
+// RegisterOp, in which case it keeps the registered meaning here too.
+func ParseVector(input string, vars map[string]Var, funcs map[string]Func) (VecExpr, error) {
+	p := &parser{vars: vars, funcs: funcs, vector: true, Parser: Parser{Ops: withIndex(DefaultOps())}}
+	e, err := p.parse(input)
+	if err != nil {
+		return nil, err
+	}
+	vec, err := veccheck(e)
+	if err != nil {
+		return nil, inputError(input, err)
+	}
+	return &vecResult{e: e, vec: vec}, nil
+}
+
+// Checks that vectors are only used as the result of the expression and
+// returns whether the expression is a vector
+func veccheck(e Expr) (bool, error) {
+	num := func(e Expr) error {
+		var err error
+		Walk(e, func(e Expr) bool {
+			if _, ok := e.(*vecExpr); ok {
+				err = ErrTypeMismatch
+			}
+			return err == nil
+		})
+		return err
+	}
+	switch e := e.(type) {
+	case *vecExpr:
+		for _, item := range e.items {
+			if err := num(item); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case *ternaryExpr:
+		if err := num(e.cond); err != nil {
+			return false, err
+		}
+		a, err := veccheck(e.a)
+		if err != nil {
+			return false, err
+		}
+		b, err := veccheck(e.b)
+		if err != nil {
+			return false, err
+		} else if a != b {
+			return false, ErrTypeMismatch
+		}
+		return a, nil
+	case *binaryExpr:
+		if e.op == comma {
+			if err := num(e.a); err != nil {
+				return false, err
+			}
+			return veccheck(e.b)
+		}
+	}
+	return false, num(e)
+}
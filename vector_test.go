@@ -0,0 +1,111 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParseVector(t *testing.T) {
+	vars := map[string]Var{"x": NewVar(2)}
+	for input, v := range map[string]string{
+		"2+3":                         "[5]",
+		"[]":                          "[]",
+		"[1, 2, 3]":                   "[1 2 3]",
+		"[x, x*2, -x]":                "[2 4 -2]",
+		"sum([1,2,3]) == 6":           "[1]",
+		"len([1, 2, 3])":              "[3]",
+		"len([])":                     "[0]",
+		"sum([1, 2], 3, [x])":         "[8]",
+		"max([4, 9, x])":              "[9]",
+		"[10,20,30][1] == 20":         "[1]",
+		"[10, 20, 30][x]":             "[30]",
+		"[10, 20, 30][x-2]":           "[10]",
+		"[10, 20, 30][x+1]":           "[0]",
+		"[10, 20, 30][0.5]":           "[0]",
+		"[10, 20, 30][-1]":            "[0]",
+		"[10, 20][1] * [3][0]":        "[60]",
+		"[][x]":                       "[0]",
+		"[(1, 2), 3]":                 "[2 3]",
+		"y = 3, [y, y+1]":             "[3 4]",
+		"x > 1 ? [1, 2] : [3]":        "[1 2]",
+		"[sum([1, 2]), [5, 6][1]]":    "[3 6]",
+		"[1, 2][[1, 0][0]]":           "[2]",
+		"[1, 2, 3][x == 2 ? 0 : 1]":   "[1]",
+		"[y = 4, y * 2][(y = 1) - 1]": "[4]",
+		"[10,20]@0 == 10":             "[1]",
+		"[10, 20, 30] @ x":            "[30]",
+		"[1, 2]@1*3":                  "[6]",
+		"[2, 3]@0**2":                 "[4]",
+		"-[2, 3]@1":                   "[-3]",
+		"[1, 2]@(x-1) + [5]@0":        "[7]",
+	} {
+		if e, err := ParseVector(input, vars, Builtins()); err != nil {
+			t.Error(input, err)
+		} else if res := fmt.Sprint(e.EvalVec()); res != v {
+			t.Error(input, res, v)
+		}
+	}
+
+	// Only the selected element is evaluated
+	calls := 0
+	funcs := map[string]Func{"f": func(c *FuncContext) Num { calls++; return c.Arg(0) }}
+	e, err := ParseVector("[f(1), f(2), f(3)][x]", vars, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := e.EvalVec(); len(res) != 1 || res[0] != 3 || calls != 1 {
+		t.Error(res, calls)
+	}
+}
+
+func TestParseVectorError(t *testing.T) {
+	for input, e := range map[string]error{
+		"[1, 2] + 1":      ErrTypeMismatch,
+		"-[1]":            ErrTypeMismatch,
+		"[[1, 2], 3]":     ErrTypeMismatch,
+		"[1, 2][0][0]":    ErrTypeMismatch,
+		"x[0]":            ErrTypeMismatch,
+		"x = [1, 2]":      ErrTypeMismatch,
+		"x ? [1] : 2":     ErrTypeMismatch,
+		"[1] ? 2 : 3":     ErrTypeMismatch,
+		"[1], 2":          ErrTypeMismatch,
+		"f([1] + 1)":      ErrTypeMismatch,
+		"[1, 2":           ErrParen,
+		"[1, 2)":          ErrParen,
+		"(1, 2]":          ErrParen,
+		"[1, 2,]":         ErrParen,
+		"1]":              ErrParen,
+		"[1, 2][]":        ErrOperandMissing,
+		"x ? [1 : 2]":     ErrTernary,
+		"f[1]":            ErrBadCall,
+		"[1, (2]":         ErrParen,
+		"[1][0] [2]":      ErrTypeMismatch,
+		"[1, 2][0, 1]][0": ErrParen,
+		"x@0":             ErrTypeMismatch,
+		"[1]@[0]":         ErrTypeMismatch,
+		"[1]@":            ErrOperandMissing,
+	} {
+		funcs := map[string]Func{"f": func(c *FuncContext) Num { return 0 }}
+		if res, err := ParseVector(input, map[string]Var{}, funcs); !errors.Is(err, e) {
+			t.Error(input, res, err, e)
+		}
+	}
+
+	// Vectors are not supported by other parsers
+	for _, input := range []string{"[1, 2]", "[1][0]", "x[0]", "2@3"} {
+		if _, err := Parse(input, map[string]Var{}, map[string]Func{}); !errors.Is(err, ErrBadOp) {
+			t.Error(input, err)
+		}
+	}
+
+	// Other parsers may still define "@"
+	ops, err := DefaultOps().With("@", 5, LeftAssoc, func(a, b Num) Num { return a*10 + b })
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Parser{Ops: ops}
+	if e, err := p.Parse("2@3", map[string]Var{}, map[string]Func{}); err != nil || e.Eval() != 23 {
+		t.Error(e, err)
+	}
+}
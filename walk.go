@@ -0,0 +1,164 @@
+package expr
+
+import "sort"
+
+// ConstNode is a constant expression
+type ConstNode interface {
+	Expr
+	Value() Num
+}
+
+// UnaryNode is an expression of an unary operator, such as "-" or "!"
+type UnaryNode interface {
+	Expr
+	Op() string
+	Arg() Expr
+}
+
+// BinaryNode is an expression of a binary operator, such as "+" or "="
+type BinaryNode interface {
+	Expr
+	Op() string
+	Left() Expr
+	Right() Expr
+}
+
+// ConditionalNode is an expression of a conditional operator "?:"
+type ConditionalNode interface {
+	Expr
+	Cond() Expr
+	Then() Expr
+	Else() Expr
+}
+
+func (e *constExpr) Value() Num { return e.value }
+
+func (e *unaryExpr) Op() string { return e.symbol() }
+func (e *unaryExpr) Arg() Expr  { return e.arg }
+
+func (e *binaryExpr) Op() string  { return e.symbol() }
+func (e *binaryExpr) Left() Expr  { return e.a }
+func (e *binaryExpr) Right() Expr { return e.b }
+
+func (e *ternaryExpr) Cond() Expr { return e.cond }
+func (e *ternaryExpr) Then() Expr { return e.a }
+func (e *ternaryExpr) Else() Expr { return e.b }
+
+// Walk traverses the expression tree in pre-order calling fn for each node.
+// If fn returns false the children of the node are not visited. Nodes are
+// either ConstNode, UnaryNode, BinaryNode, ConditionalNode, Var or
+// *FuncContext.
+func Walk(e Expr, fn func(Expr) bool) {
+	if e == nil || !fn(e) {
+		return
+	}
+	switch e := e.(type) {
+	case *unaryExpr:
+		Walk(e.arg, fn)
+	case *binaryExpr:
+		Walk(e.a, fn)
+		Walk(e.b, fn)
+	case *ternaryExpr:
+		Walk(e.cond, fn)
+		Walk(e.a, fn)
+		Walk(e.b, fn)
+	case *FuncContext:
+		for _, arg := range e.Args {
+			Walk(arg, fn)
+		}
+	case *vecExpr:
+		for _, item := range e.items {
+			Walk(item, fn)
+		}
+	}
+}
+
+// Vars returns the sorted names of all variables referenced by the
+// expression. Only variables created by NewVar or NewAtomicVar, or
+// automatically created by Parse are named.
+func Vars(e Expr) []string {
+	set := map[string]bool{}
+	Walk(e, func(e Expr) bool {
+		if v, ok := e.(namedVar); ok && v.varName() != "" {
+			set[v.varName()] = true
+		}
+		return true
+	})
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Funcs returns the sorted names of all functions called by the expression
+func Funcs(e Expr) []string {
+	set := map[string]bool{}
+	Walk(e, func(e Expr) bool {
+		if f, ok := e.(*FuncContext); ok && f.name != "" {
+			set[f.name] = true
+		}
+		return true
+	})
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns all named variables referenced by the expression, grouped by name
+func namedVars(e Expr) map[string][]Var {
+	vars := map[string][]Var{}
+	seen := map[Var]bool{}
+	Walk(e, func(e Expr) bool {
+		if v, ok := e.(namedVar); ok && v.varName() != "" && !seen[v] {
+			seen[v] = true
+			vars[v.varName()] = append(vars[v.varName()], v)
+		}
+		return true
+	})
+	return vars
+}
+
+// Cost estimates how expensive the expression is to evaluate. Each node costs
+// 1, except for power that costs 4 and function calls that cost 10, plus the
+// cost of their arguments.
+func Cost(e Expr) int {
+	cost := 0
+	Walk(e, func(e Expr) bool {
+		switch e := e.(type) {
+		case *FuncContext:
+			cost = cost + 10
+		case *binaryExpr:
+			if e.op&^opFlags == power {
+				cost = cost + 4
+			} else {
+				cost++
+			}
+		default:
+			cost++
+		}
+		return true
+	})
+	return cost
+}
+
+// Statements returns the expressions separated by top-level commas, in the
+// order they are evaluated. Expression without commas is a single statement.
+func Statements(e Expr) []Expr {
+	return list(e)
+}
+
+// EvalEach evaluates the statements of the expression one by one and returns
+// the result of each statement
+func EvalEach(e Expr) []Num {
+	stmts := Statements(e)
+	res := make([]Num, len(stmts))
+	for i, stmt := range stmts {
+		res[i] = stmt.Eval()
+	}
+	return res
+}
@@ -0,0 +1,191 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	env := map[string]Var{}
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			return 0
+		},
+	}
+	e, err := Parse("x+y*z", env, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	Walk(e, func(e Expr) bool {
+		if v, ok := e.(Var); ok {
+			for name, v2 := range env {
+				if v == v2 {
+					names = append(names, name)
+				}
+			}
+		}
+		return true
+	})
+	sort.Strings(names)
+	if len(names) != 3 || names[0] != "x" || names[1] != "y" || names[2] != "z" {
+		t.Error(names)
+	}
+
+	e, err = Parse("-1 + f(2, x ? 3 : 4) * x", env, funcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := []string{}
+	Walk(e, func(e Expr) bool {
+		switch e := e.(type) {
+		case ConstNode:
+			nodes = append(nodes, fmt.Sprint(e.Value()))
+		case UnaryNode:
+			nodes = append(nodes, "u"+e.Op())
+		case BinaryNode:
+			nodes = append(nodes, e.Op())
+		case ConditionalNode:
+			nodes = append(nodes, "?:")
+		case *FuncContext:
+			nodes = append(nodes, "f")
+		case Var:
+			nodes = append(nodes, "x")
+		}
+		return true
+	})
+	if s := strings.Join(nodes, " "); s != "+ u- 1 * f 2 ?: x 3 4 x" {
+		t.Error(s)
+	}
+
+	// Children are skipped if callback returns false
+	count := 0
+	Walk(e, func(e Expr) bool {
+		count++
+		_, ok := e.(*FuncContext)
+		return !ok
+	})
+	if count != 6 {
+		t.Error(count)
+	}
+}
+
+func TestVars(t *testing.T) {
+	env := map[string]Var{"x": NewVar(1), "z": NewAtomicVar(2)}
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			return 0
+		},
+	}
+	for input, names := range map[string]string{
+		"":                    "",
+		"2+3":                 "",
+		"x":                   "x",
+		"x+f(y)":              "x y",
+		"f(y)+x":              "x y",
+		"y=x*x, z ? a : b+y":  "a b x y z",
+		"-f(f(c), 1) && !x":   "c x",
+		"(x, x), (y, x), z=1": "x y z",
+	} {
+		if e, err := Parse(input, env, funcs); err != nil {
+			t.Error(input, err)
+		} else if s := strings.Join(Vars(e), " "); s != names {
+			t.Error(input, s, names)
+		}
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	f := func(c *FuncContext) Num { return 0 }
+	funcs := map[string]Func{"f": f, "g": f, "h": f}
+	for input, names := range map[string]string{
+		"":                  "",
+		"x+2":               "",
+		"a+f(g(x))":         "f g",
+		"g(f(1), f(2)) + 1": "f g",
+		"x ? h() : g(f(y))": "f g h",
+	} {
+		if e, err := Parse(input, map[string]Var{}, funcs); err != nil {
+			t.Error(input, err)
+		} else if s := strings.Join(Funcs(e), " "); s != names {
+			t.Error(input, s, names)
+		}
+	}
+	if e, err := Parse("g(1)", map[string]Var{}, funcs); err != nil {
+		t.Error(err)
+	} else if name := e.(*FuncContext).Name(); name != "g" {
+		t.Error(name)
+	}
+}
+
+func TestCost(t *testing.T) {
+	funcs := map[string]Func{
+		"f": func(c *FuncContext) Num {
+			return 0
+		},
+	}
+	for input, cost := range map[string]int{
+		"":          1,
+		"x":         1,
+		"2+3":       3,
+		"-x*2":      4,
+		"x**2":      6,
+		"f(x, 1)":   12,
+		"x ? 1 : 2": 4,
+		"x=f(f(1))": 23,
+	} {
+		// Parser options set operator flags, which must not change the cost
+		for _, p := range []*Parser{{}, {IntMode: true}, {NormalizeZero: true, OddRoots: true}} {
+			if e, err := p.Parse(input, map[string]Var{}, funcs); err != nil {
+				t.Error(input, err)
+			} else if n := Cost(e); n != cost {
+				t.Error(input, *p, n, cost)
+			}
+		}
+	}
+
+	p := &Parser{MaxCost: 100}
+	if _, err := p.Parse("x*2 + f(x)", map[string]Var{}, funcs); err != nil {
+		t.Error(err)
+	}
+	deep := strings.Repeat("f(", 20) + "1" + strings.Repeat(")", 20)
+	if _, err := p.Parse(deep, map[string]Var{}, funcs); !errors.Is(err, ErrTooComplex) {
+		t.Error(err)
+	}
+	long := strings.Repeat("x+", 100) + "x"
+	if _, err := p.Parse(long, map[string]Var{}, funcs); !errors.Is(err, ErrTooComplex) {
+		t.Error(err)
+	}
+	if _, err := Parse(long, map[string]Var{}, funcs); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStatements(t *testing.T) {
+	for input, results := range map[string]string{
+		"1, 2, 3":         "[1 2 3]",
+		"a=1, b=2, a+b":   "[1 2 3]",
+		"42":              "[42]",
+		"":                "[0]",
+		"(1, 2), 3":       "[2 3]",
+		"f(1, 2), x=f(3)": "[1 3]",
+		"x ? 1 : 2, 3":    "[2 3]",
+	} {
+		e, err := Parse(input, map[string]Var{}, map[string]Func{
+			"f": func(c *FuncContext) Num { return c.Arg(0) },
+		})
+		if err != nil {
+			t.Error(input, err)
+			continue
+		}
+		if s := fmt.Sprint(EvalEach(e)); s != results {
+			t.Error(input, s, results)
+		}
+		if n := len(Statements(e)); n != strings.Count(results, " ")+1 {
+			t.Error(input, n)
+		}
+	}
+}